@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // вы можете использовать ApiError в коде, который получается в результате генерации
@@ -12,12 +16,41 @@ import (
 type ApiError struct {
 	HTTPStatus int
 	Err        error
+	// необязательный машиночитаемый код ошибки, например "user_deleted"
+	Code string
+	// необязательные подробности, отдаются клиенту как есть
+	Details interface{}
 }
 
 func (ae ApiError) Error() string {
 	return ae.Err.Error()
 }
 
+func (ae ApiError) Unwrap() error {
+	return ae.Err
+}
+
+// ErrUserBanned - ошибка без HTTP-статуса, статус задаётся в аннотации метода
+var ErrUserBanned = errors.New("user banned")
+
+// slowDelay имитирует медленное хранилище для логинов с префиксом slow_,
+// методы при этом не следят за ctx
+var slowDelay = 300 * time.Millisecond
+
+// slowRunning и slowMaxRunning - сколько медленных вызовов идёт сейчас и сколько шло одновременно,
+// по ним тесты видят, сколько методов на самом деле работает
+var slowRunning, slowMaxRunning atomic.Int32
+
+func simulateSlowStorage(login string) {
+	if strings.HasPrefix(login, "slow_") {
+		running := slowRunning.Add(1)
+		defer slowRunning.Add(-1)
+		for max := slowMaxRunning.Load(); running > max && !slowMaxRunning.CompareAndSwap(max, running); max = slowMaxRunning.Load() {
+		}
+		time.Sleep(slowDelay)
+	}
+}
+
 // ----------------
 
 const (
@@ -26,6 +59,7 @@ const (
 	statusAdmin     = 20
 )
 
+// apigen:cors {"origins": ["https://app.example.com"], "headers": ["X-Auth", "Content-Type"], "credentials": true, "max_age": "10m"}
 type MyApi struct {
 	statuses map[string]int
 	users    map[string]*User
@@ -57,6 +91,14 @@ type ProfileParams struct {
 	Login string `apivalidator:"required"`
 }
 
+// Validate вызывается сгенерированным кодом после проверок из тегов
+func (in ProfileParams) Validate() error {
+	if strings.ContainsAny(in.Login, " \t") {
+		return fmt.Errorf("login must not contain spaces")
+	}
+	return nil
+}
+
 type CreateParams struct {
 	Login  string `apivalidator:"required,min=10"`
 	Name   string `apivalidator:"paramname=full_name"`
@@ -64,6 +106,14 @@ type CreateParams struct {
 	Age    int    `apivalidator:"min=0,max=128"`
 }
 
+// CreateV2Params - параметры /v2/user/create: статус переименован в role
+type CreateV2Params struct {
+	Login string `apivalidator:"required,min=10"`
+	Name  string `apivalidator:"paramname=full_name"`
+	Role  string `apivalidator:"enum=user|moderator|admin,default=user"`
+	Age   int    `apivalidator:"min=0,max=128"`
+}
+
 type User struct {
 	ID       uint64 `json:"id"`
 	Login    string `json:"login"`
@@ -75,35 +125,49 @@ type NewUser struct {
 	ID uint64 `json:"id"`
 }
 
-// apigen:api {"url": "/user/profile", "auth": false}
+// apigen:api {"url": "/user/profile", "auth": false, "errors": {"ErrUserBanned": 403}, "cors": {"origins": ["*"]}, "cache": {"max_age": "60s", "etag": true}, "compress": true}
 func (h *MyApi) Profile(ctx context.Context, in ProfileParams) (*User, error) {
 
 	if in.Login == "bad_user" {
 		return nil, fmt.Errorf("bad user")
 	}
 
+	if in.Login == "banned_user" {
+		return nil, fmt.Errorf("profile %s: %w", in.Login, ErrUserBanned)
+	}
+
+	if in.Login == "deleted_user" {
+		return nil, fmt.Errorf("profile %s: %w", in.Login, ApiError{
+			HTTPStatus: http.StatusGone,
+			Err:        fmt.Errorf("user deleted"),
+			Code:       "user_deleted",
+			Details:    map[string]string{"login": in.Login},
+		})
+	}
+
 	h.mu.RLock()
 	user, exist := h.users[in.Login]
 	h.mu.RUnlock()
 	if !exist {
-		return nil, ApiError{http.StatusNotFound, fmt.Errorf("user not exist")}
+		return nil, ApiError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("user not exist")}
 	}
 
 	return user, nil
 }
 
-// apigen:api {"url": "/user/create", "auth": true, "method": "POST"}
+// apigen:api {"url": "/user/create", "auth": true, "method": "POST", "timeout": "100ms", "max_body": "4KB", "consumes": ["application/x-www-form-urlencoded"], "deprecated": true, "deprecated_at": "2026-01-01", "sunset": "2027-01-01", "successor": "/v2/user/create", "idempotent": true}
 func (h *MyApi) Create(ctx context.Context, in CreateParams) (*NewUser, error) {
 	if in.Login == "bad_username" {
 		return nil, fmt.Errorf("bad user")
 	}
+	simulateSlowStorage(in.Login)
 
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
 	_, exist := h.users[in.Login]
 	if exist {
-		return nil, ApiError{http.StatusConflict, fmt.Errorf("user %s exist", in.Login)}
+		return nil, ApiError{HTTPStatus: http.StatusConflict, Err: fmt.Errorf("user %s exist", in.Login)}
 	}
 
 	id := h.nextID
@@ -118,6 +182,21 @@ func (h *MyApi) Create(ctx context.Context, in CreateParams) (*NewUser, error) {
 	return &NewUser{id}, nil
 }
 
+// apigen:api {"url": "/user/create", "auth": true, "method": "POST", "version": "v2", "max_body": "4KB"}
+func (h *MyApi) CreateV2(ctx context.Context, in CreateV2Params) (*NewUser, error) {
+	return h.Create(ctx, CreateParams{
+		Login:  in.Login,
+		Name:   in.Name,
+		Status: in.Role,
+		Age:    in.Age,
+	})
+}
+
+// apigen:api {"url": "/users/{login}", "method": "GET"}
+func (h *MyApi) User(ctx context.Context, in ProfileParams) (*User, error) {
+	return h.Profile(ctx, in)
+}
+
 // 2-я часть
 // это похожая структура, с теми же методами, но у них другие параметры!
 // код, созданный вашим кодогенератором работает с конкретной струткурой, про другие ничего не знает
@@ -137,6 +216,21 @@ type OtherCreateParams struct {
 	Level    int    `apivalidator:"min=1,max=50"`
 }
 
+// имена, которые нельзя занять через API
+var reservedUsernames = map[string]bool{
+	"root":  true,
+	"admin": true,
+}
+
+// Validate вызывается сгенерированным кодом после проверок из тегов,
+// ApiError сохраняет свой статус
+func (in OtherCreateParams) Validate(ctx context.Context) error {
+	if reservedUsernames[in.Username] {
+		return ApiError{HTTPStatus: http.StatusConflict, Err: fmt.Errorf("username %s is reserved", in.Username)}
+	}
+	return nil
+}
+
 type OtherUser struct {
 	ID       uint64 `json:"id"`
 	Login    string `json:"login"`
@@ -144,7 +238,7 @@ type OtherUser struct {
 	Level    int    `json:"level"`
 }
 
-// apigen:api {"url": "/user/create", "auth": true, "method": "POST"}
+// apigen:api {"url": "/user/create", "auth": true, "method": "POST", "ratelimit": {"rate": 10, "burst": 20, "key": "header:X-Client"}, "produces": ["application/json", "application/xml"]}
 func (srv *OtherApi) Create(ctx context.Context, in OtherCreateParams) (*OtherUser, error) {
 	return &OtherUser{
 		ID:       12,
@@ -153,3 +247,13 @@ func (srv *OtherApi) Create(ctx context.Context, in OtherCreateParams) (*OtherUs
 		Level:    in.Level,
 	}, nil
 }
+
+// apigen:api {"url": "/user/check", "auth": true, "method": "POST", "aggregate_errors": true, "ratelimit": "100/s", "max_inflight": 4, "queue_timeout": "50ms", "timeout": "100ms", "timeout_status": 503}
+func (srv *OtherApi) Check(ctx context.Context, in OtherCreateParams) (*OtherUser, error) {
+	simulateSlowStorage(in.Username)
+	return &OtherUser{
+		Login:    in.Username,
+		FullName: in.Name,
+		Level:    in.Level,
+	}, nil
+}
@@ -5,462 +5,3635 @@ import "encoding/json"
 import "strconv"
 import "strings"
 import "fmt"
+import "errors"
+import "context"
+import "time"
+import "sync"
+import "sort"
+import "io"
+import "bytes"
+import "log/slog"
+import "crypto/rand"
+import "crypto/sha256"
+import "compress/gzip"
+import "compress/zlib"
+import "encoding/hex"
+import "math"
+import "net"
+import "net/url"
+import "mime"
+import "encoding/xml"
+import "unicode"
+import "slices"
+import "encoding/binary"
+import "log"
+import "runtime/debug"
 
 
 type Response map[string]interface{}
 
 func writeJsonResponse(w http.ResponseWriter, response interface{}, status int) {
-  jsonResponse, _ := json.Marshal(response)
-  w.WriteHeader(status)
-  _, err := w.Write(jsonResponse)
+  jsonResponse, err := json.Marshal(response)
   if err != nil {
-    panic("Unexpected error")
+    jsonResponse = []byte(`{"error":"internal server error"}`)
+    status = http.StatusInternalServerError
+  }
+  if w.Header().Get("Content-Type") == "" {
+    w.Header().Set("Content-Type", "application/json; charset=utf-8")
+  }
+  w.WriteHeader(status)
+  if _, err := w.Write(jsonResponse); err != nil {
+    WriteErrorHook(err)
   }
 }
 
-type IntMaxValidator struct {
-  rule string
-  paramName string
-  Max int
+// ResponseEncoder кодирует ответ в один из форматов, которые клиент может запросить в Accept
+type ResponseEncoder interface {
+  ContentType() string
+  Encode(w io.Writer, v interface{}) error
 }
 
-type IntMinValidator struct {
-  rule string
-  paramName string
-  Min int
+// ResponseEncoders - известные форматы ответа по media type,
+// сюда можно добавить свой формат и указать его в produces аннотации
+var ResponseEncoders = map[string]ResponseEncoder{
+  "application/json":    JSONEncoder{},
+  "application/xml":     XMLEncoder{},
+  "application/msgpack": MsgpackEncoder{},
 }
 
-type StringMaxValidator struct {
-  rule string
-  paramName string
-  Max int
+// DefaultProduces - форматы ответа методов без produces в аннотации, первый используется без Accept
+var DefaultProduces = []string{"application/json", "application/xml", "application/msgpack"}
+
+// буферы больше этого размера не возвращаются в пул, чтобы он не держал память после редких больших ответов
+const maxPooledBuffer = 64 << 10
+
+var bufferPool = sync.Pool{
+  New: func() interface{} {
+    return new(bytes.Buffer)
+  },
 }
 
-type StringMinValidator struct {
-  rule string
-  paramName string
-  Min int
+// writeResponse кодирует ответ в буфер из пула и только потом пишет заголовки,
+// поэтому при ошибке кодирования ещё можно ответить ошибкой
+func writeResponse(w http.ResponseWriter, encoder ResponseEncoder, response interface{}, status int) error {
+  buf := bufferPool.Get().(*bytes.Buffer)
+  defer releaseBuffer(buf)
+
+  if err := encoder.Encode(buf, response); err != nil {
+    return err
+  }
+  writeBody(w, encoder, buf, status)
+  return nil
 }
 
-type EnumValidator struct {
-  rule string
-  paramName string
-  list map[string]int
+func releaseBuffer(buf *bytes.Buffer) {
+  if buf.Cap() <= maxPooledBuffer {
+    buf.Reset()
+    bufferPool.Put(buf)
+  }
 }
 
-type RequiredValidator struct {
-  rule string
-  paramName string
+func writeBody(w http.ResponseWriter, encoder ResponseEncoder, buf *bytes.Buffer, status int) {
+  w.Header().Set("Content-Type", encoder.ContentType())
+  w.WriteHeader(status)
+  if _, err := w.Write(buf.Bytes()); err != nil {
+    WriteErrorHook(err)
+  }
 }
 
-func (v IntMaxValidator) Validate(val interface{}) (bool, error) {
-  num := val.(int)
+// ETagger - необязательный интерфейс результата метода: своя версия ресурса для ETag
+// вместо хеша закодированного ответа. Формат ответа к версии добавляется сам,
+// а в ней допустимы только видимые ASCII-символы без кавычек и обратного слеша
+type ETagger interface {
+  ETag() string
+}
 
-  if num > v.Max {
-    return false, fmt.Errorf(v.paramName + " must be <= %v", v.Max)
+// writeCachedResponse пишет ответ на GET и HEAD с Cache-Control и, если нужно, со strong ETag,
+// а при совпавшем If-None-Match отвечает 304 без тела. Ответы на остальные методы не кешируются.
+// Заголовки кеширования ставятся только вместе с ответом, чтобы 500 из-за ошибки
+// кодирования или невалидной версии ETagger-а не стал кешируемым
+func writeCachedResponse(w http.ResponseWriter, r *http.Request, encoder ResponseEncoder, response, result interface{}, status int, cacheControl string, etag bool) error {
+  if r.Method != http.MethodGet && r.Method != http.MethodHead {
+    return writeResponse(w, encoder, response, status)
   }
-  
-  return true, nil
-}
 
-func (v IntMinValidator) Validate(val interface{}) (bool, error) {
-  num := val.(int)
+  tag := ""
+  if tagger, ok := result.(ETagger); ok && etag {
+    version := tagger.ETag()
+    if !validETag(version) {
+      return fmt.Errorf("invalid ETag %q of %T", version, result)
+    }
+    // одна версия ресурса в JSON и XML - разные представления
+    format := sha256.Sum256([]byte(encoder.ContentType()))
+    tag = "\"" + version + "-" + hex.EncodeToString(format[:4]) + "\""
+    // для 304 ответ не кодируется
+    if notModified(r, tag) {
+      setCacheHeaders(w, cacheControl, tag)
+      w.WriteHeader(http.StatusNotModified)
+      return nil
+    }
+  }
 
-  if num < v.Min {
-    return false, fmt.Errorf(v.paramName + " must be >= %v", v.Min)
+  buf := bufferPool.Get().(*bytes.Buffer)
+  defer releaseBuffer(buf)
+  if err := encoder.Encode(buf, response); err != nil {
+    return err
   }
-  
-  return true, nil
+  if etag && tag == "" {
+    sum := sha256.Sum256(buf.Bytes())
+    tag = "\"" + hex.EncodeToString(sum[:16]) + "\""
+  }
+  setCacheHeaders(w, cacheControl, tag)
+  if tag != "" && notModified(r, tag) {
+    w.WriteHeader(http.StatusNotModified)
+    return nil
+  }
+  writeBody(w, encoder, buf, status)
+  return nil
 }
 
-func (v StringMaxValidator) Validate(val interface{}) (bool, error) {
-  l := len(val.(string))
-
-  if v.Max > 0 && l > v.Max {
-    return false, fmt.Errorf(v.paramName + " must be <= %v", v.Max)
+// setCacheHeaders ставит заголовки кеширования ответа, tag = "" - без ETag
+func setCacheHeaders(w http.ResponseWriter, cacheControl, tag string) {
+  header := w.Header()
+  header.Set("Cache-Control", cacheControl)
+  header.Add("Vary", "Accept")
+  if tag != "" {
+    header.Set("ETag", tag)
   }
-  
-  return true, nil
 }
 
-func (v StringMinValidator) Validate(val interface{}) (bool, error) {
-  l := len(val.(string))
+// validETag проверяет, что версию можно поставить в кавычки ETag как есть.
+// Обратный слеш etagc из RFC 9110 допускает, но клиенты и прокси принимают его за экранирование
+func validETag(version string) bool {
+  if version == "" {
+    return false
+  }
+  for i := 0; i < len(version); i++ {
+    if c := version[i]; c <= ' ' || c == '"' || c == '\\' || c >= 0x7f {
+      return false
+    }
+  }
+  return true
+}
 
-  if v.Min > 0 && l < v.Min {
-    return false, fmt.Errorf(v.paramName + " len must be >= %v", v.Min)
+// notModified сообщает, есть ли ETag в If-None-Match запроса, 304 пишет вызывающий
+func notModified(r *http.Request, tag string) bool {
+  for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+    candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+    if candidate == tag || candidate == "*" {
+      return true
+    }
   }
-  
-  return true, nil
+  return false
 }
 
-func (v EnumValidator) Validate(val interface{}) (bool, error) {
-  item := val.(string)
+// writeErrorResponse пишет ответ с ошибкой, а если его не удалось закодировать -
+// хотя бы текст ошибки в JSON
+func writeErrorResponse(w http.ResponseWriter, encoder ResponseEncoder, response Response, status int) {
+  if err := writeResponse(w, encoder, response, status); err != nil {
+    writeJsonResponse(w, Response{"error": response["error"]}, status)
+  }
+}
 
-  if _,ok := v.list[item]; !ok {
-	return false, fmt.Errorf(v.paramName + " must be one of [" + strings.Join(strings.Split(strings.Split(v.rule, "=")[1], "|"), ", ") + "]")
+// negotiate выбирает формат ответа из produces по заголовку Accept с учётом q,
+// при равном q побеждает формат, стоящий раньше в produces
+func negotiate(r *http.Request, produces []string) (ResponseEncoder, bool) {
+  accept := r.Header.Get("Accept")
+  var best ResponseEncoder
+  bestQ := 0.0
+  for _, mediaType := range produces {
+    encoder, ok := ResponseEncoders[mediaType]
+    if !ok {
+      // формат убрали из ResponseEncoders после генерации
+      continue
+    }
+    q := 1.0
+    if accept != "" {
+      q = acceptQuality(accept, mediaType)
+    }
+    if q > bestQ {
+      best, bestQ = encoder, q
+    }
   }
-  
-  return true, nil
+  return best, best != nil
 }
 
-func (v RequiredValidator) Validate(val interface{}) (bool, error) {
-  l := len(val.(string))
+// acceptQuality возвращает q самой точной записи Accept, подходящей под mediaType
+func acceptQuality(accept, mediaType string) float64 {
+  q, specificity := 0.0, -1
+  for _, item := range strings.Split(accept, ",") {
+    accepted, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+    if err != nil {
+      continue
+    }
+
+    current := -1
+    switch {
+    case accepted == mediaType:
+      current = 2
+    case strings.HasSuffix(accepted, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(accepted, "*")):
+      current = 1
+    case accepted == "*/*":
+      current = 0
+    }
+    if current <= specificity {
+      continue
+    }
 
-  if l == 0 {
-	return false, fmt.Errorf(v.paramName + " must me not empty")
+    specificity, q = current, 1.0
+    if value, ok := params["q"]; ok {
+      if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+        q = parsed
+      }
+    }
   }
-  
-  return true, nil
+  return q
 }
 
-func (h *OtherApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-    switch r.URL.Path {
+// JSONEncoder - ответ в JSON
+type JSONEncoder struct{}
 
-    case "/user/create":
-		
-		token := r.Header.Get("X-Auth")
-		if token != "100500" {
-			writeJsonResponse(w, Response{"error": "unauthorized"}, http.StatusForbidden)
-			return
-		}
-		
-		
-		if r.Method != "POST" {
-			writeJsonResponse(w, Response{"error": "bad method"}, http.StatusNotAcceptable)
-			return
-		}
-		
-        h.handlerCreate(w, r)
+func (JSONEncoder) ContentType() string {
+  return "application/json; charset=utf-8"
+}
 
-    default:
-        // 404
-		writeJsonResponse(w, Response{"error": "unknown method"}, http.StatusNotFound)
-    }
+func (JSONEncoder) Encode(w io.Writer, v interface{}) error {
+  return json.NewEncoder(w).Encode(v)
 }
 
-func (h *OtherApi) handlerCreate(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	status := http.StatusOK
-    errorMessage := ""
-	
-    // валидирование параметров
-	// заполнение структуры params
-	params := OtherCreateParams{}
-    paramName := ""
+// jsonTree переводит ответ в дерево из map, slice и скаляров так же, как его видит JSON,
+// чтобы XML и MessagePack учитывали json-теги структур
+func jsonTree(v interface{}) (interface{}, error) {
+  data, err := json.Marshal(v)
+  if err != nil {
+    return nil, err
+  }
+  decoder := json.NewDecoder(bytes.NewReader(data))
+  decoder.UseNumber()
+  var tree interface{}
+  err = decoder.Decode(&tree)
+  return tree, err
+}
 
-	
+func sortedKeys(m map[string]interface{}) []string {
+  keys := make([]string, 0, len(m))
+  for key := range m {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  return keys
+}
 
-    paramName = strings.ToLower("Username")
-    
+// XMLEncoder - ответ в XML: объекты становятся элементами с именами ключей,
+// элементы массивов - элементами item
+type XMLEncoder struct{}
 
-    
-    params.Username = r.FormValue(paramName)
-    
-    
-	
-    if ok, err := (RequiredValidator{"required", paramName}).Validate(params.Username); !ok && err != nil {
-      writeJsonResponse(w, Response{
-        "error": err.Error(),
-      }, http.StatusBadRequest)
-      return
+func (XMLEncoder) ContentType() string {
+  return "application/xml; charset=utf-8"
+}
+
+func (XMLEncoder) Encode(w io.Writer, v interface{}) error {
+  tree, err := jsonTree(v)
+  if err != nil {
+    return err
+  }
+  buf := &bytes.Buffer{}
+  buf.WriteString(xml.Header)
+  writeXMLNode(buf, "response", tree)
+  _, err = w.Write(buf.Bytes())
+  return err
+}
+
+func writeXMLNode(buf *bytes.Buffer, name string, node interface{}) {
+  buf.WriteString("<" + name + ">")
+  writeXMLValue(buf, node)
+  buf.WriteString("</" + name + ">")
+}
+
+func writeXMLValue(buf *bytes.Buffer, node interface{}) {
+  switch value := node.(type) {
+  case map[string]interface{}:
+    for _, key := range sortedKeys(value) {
+      if xmlName(key) {
+        writeXMLNode(buf, key, value[key])
+        continue
+      }
+      // ключ, который не годится в имя элемента, уходит в атрибут
+      buf.WriteString("<entry key=\"")
+      xml.EscapeText(buf, []byte(key))
+      buf.WriteString("\">")
+      writeXMLValue(buf, value[key])
+      buf.WriteString("</entry>")
+    }
+  case []interface{}:
+    for _, item := range value {
+      writeXMLNode(buf, "item", item)
     }
+  case string:
+    xml.EscapeText(buf, []byte(value))
+  case nil:
+  default:
+    fmt.Fprint(buf, value)
+  }
+}
 
-    if ok, err := (StringMinValidator{"min=3", paramName, 3 }).Validate(params.Username); !ok && err != nil {
-      writeJsonResponse(w, Response{
-        "error": err.Error(),
-      }, http.StatusBadRequest)
-      return
+// xmlName проверяет, что ключ объекта можно записать именем элемента XML как есть
+func xmlName(key string) bool {
+  if key == "" || strings.HasPrefix(strings.ToLower(key), "xml") {
+    return false
+  }
+  for i, c := range key {
+    switch {
+    case c == '_' || unicode.IsLetter(c):
+    case i > 0 && (c == '-' || c == '.' || unicode.IsDigit(c)):
+    default:
+      return false
     }
+  }
+  return true
+}
 
-    
+// MsgpackEncoder - ответ в MessagePack, ключи объектов отсортированы
+type MsgpackEncoder struct{}
 
-    paramName = strings.ToLower("Name")
-    paramName = "account_name"
+func (MsgpackEncoder) ContentType() string {
+  return "application/msgpack"
+}
 
-    
-    params.Name = r.FormValue(paramName)
-    
-    
-	
-    
+func (MsgpackEncoder) Encode(w io.Writer, v interface{}) error {
+  tree, err := jsonTree(v)
+  if err != nil {
+    return err
+  }
+  buf := &bytes.Buffer{}
+  writeMsgpack(buf, tree)
+  _, err = w.Write(buf.Bytes())
+  return err
+}
 
-    paramName = strings.ToLower("Class")
-    
+func writeMsgpackHeader(buf *bytes.Buffer, size int, fix byte, fixLimit int, codes [3]byte) {
+  switch {
+  case size < fixLimit:
+    buf.WriteByte(fix | byte(size))
+  case codes[0] != 0 && size <= math.MaxUint8:
+    buf.WriteByte(codes[0])
+    buf.WriteByte(byte(size))
+  case size <= math.MaxUint16:
+    buf.WriteByte(codes[1])
+    binary.Write(buf, binary.BigEndian, uint16(size))
+  default:
+    buf.WriteByte(codes[2])
+    binary.Write(buf, binary.BigEndian, uint32(size))
+  }
+}
 
-    
-    params.Class = r.FormValue(paramName)
-    
-    
-	
-	if params.Class == "" {
-	 params.Class = "warrior"
-	}
-    if ok, err := (EnumValidator{"enum=warrior|sorcerer|rouge", paramName, map[string]int{ "warrior":1, "sorcerer":1, "rouge": 1 }}).Validate(params.Class); !ok && err != nil {
-      writeJsonResponse(w, Response{
-        "error": err.Error(),
-      }, http.StatusBadRequest)
+func writeMsgpackInt(buf *bytes.Buffer, num int64) {
+  switch {
+  case num >= 0 && num < 128:
+    buf.WriteByte(byte(num))
+  case num >= -32 && num < 0:
+    buf.WriteByte(byte(int8(num)))
+  case num >= 0 && num <= math.MaxUint8:
+    buf.WriteByte(0xcc)
+    buf.WriteByte(byte(num))
+  case num >= 0 && num <= math.MaxUint16:
+    buf.WriteByte(0xcd)
+    binary.Write(buf, binary.BigEndian, uint16(num))
+  case num >= 0 && num <= math.MaxUint32:
+    buf.WriteByte(0xce)
+    binary.Write(buf, binary.BigEndian, uint32(num))
+  case num >= 0:
+    buf.WriteByte(0xcf)
+    binary.Write(buf, binary.BigEndian, uint64(num))
+  case num >= math.MinInt8:
+    buf.WriteByte(0xd0)
+    buf.WriteByte(byte(int8(num)))
+  case num >= math.MinInt16:
+    buf.WriteByte(0xd1)
+    binary.Write(buf, binary.BigEndian, int16(num))
+  case num >= math.MinInt32:
+    buf.WriteByte(0xd2)
+    binary.Write(buf, binary.BigEndian, int32(num))
+  default:
+    buf.WriteByte(0xd3)
+    binary.Write(buf, binary.BigEndian, num)
+  }
+}
+
+func writeMsgpack(buf *bytes.Buffer, node interface{}) {
+  switch value := node.(type) {
+  case nil:
+    buf.WriteByte(0xc0)
+  case bool:
+    if value {
+      buf.WriteByte(0xc3)
+    } else {
+      buf.WriteByte(0xc2)
+    }
+  case json.Number:
+    if num, err := value.Int64(); err == nil {
+      writeMsgpackInt(buf, num)
       return
     }
+    num, _ := value.Float64()
+    buf.WriteByte(0xcb)
+    binary.Write(buf, binary.BigEndian, num)
+  case string:
+    writeMsgpackHeader(buf, len(value), 0xa0, 32, [3]byte{0xd9, 0xda, 0xdb})
+    buf.WriteString(value)
+  case []interface{}:
+    writeMsgpackHeader(buf, len(value), 0x90, 16, [3]byte{0, 0xdc, 0xdd})
+    for _, item := range value {
+      writeMsgpack(buf, item)
+    }
+  case map[string]interface{}:
+    writeMsgpackHeader(buf, len(value), 0x80, 16, [3]byte{0, 0xde, 0xdf})
+    for _, key := range sortedKeys(value) {
+      writeMsgpack(buf, key)
+      writeMsgpack(buf, value[key])
+    }
+  }
+}
 
-    
+// PanicHook получает панику из сгенерированного обработчика вместе со стеком
+var PanicHook = func(r *http.Request, recovered interface{}, stack []byte) {
+  log.Printf("panic serving %s: %v\n%s", r.URL.Path, recovered, stack)
+}
 
-    paramName = strings.ToLower("Level")
-    
+// WriteErrorHook получает ошибки записи ответа клиенту, а также ошибки кодирования ответа,
+// о которых клиент узнаёт только как о 500
+var WriteErrorHook = func(err error) {
+  log.Printf("write response: %v", err)
+}
 
-    
-    
-    value, err := strconv.Atoi(r.FormValue(paramName))
-    if err != nil {
-      writeJsonResponse(w, Response{"error": paramName + " must be int"}, http.StatusBadRequest)
-      return
-	}
-	params.Level = value
-    
-	
-    if ok, err := (IntMinValidator{"min=1", paramName, 1 }).Validate(params.Level); !ok && err != nil {
-      writeJsonResponse(w, Response{
-        "error": err.Error(),
-      }, http.StatusBadRequest)
-      return
-    }
+// recoverPanic превращает панику в ответ 500 в стандартном формате ошибок
+func recoverPanic(w http.ResponseWriter, r *http.Request) {
+  recovered := recover()
+  if recovered == nil {
+    return
+  }
+  if recovered == http.ErrAbortHandler {
+    panic(recovered)
+  }
+  stack := debug.Stack()
+  if gp, ok := recovered.(goroutinePanic); ok {
+    recovered, stack = gp.value, gp.stack
+  }
+  PanicHook(r, recovered, stack)
+  writeError(w, r, http.StatusInternalServerError, errors.New("internal server error"))
+}
 
-    if ok, err := (IntMaxValidator{"max=50", paramName, 50 }).Validate(params.Level); !ok && err != nil {
-      writeJsonResponse(w, Response{
-        "error": err.Error(),
-      }, http.StatusBadRequest)
-      return
-    }
+// RouteInfo описывает метод API, для которого сгенерирован обработчик
+type RouteInfo struct {
+  Api        string
+  URL        string
+  // пустая строка - метод принимает любой HTTP-метод
+  HTTPMethod string
+  MethodName string
+  Auth       bool
+  // версия из аннотации, пустая строка - метод без версии
+  Version string
+  // метод устарел; Deprecation - значение одноимённого заголовка "@<unix-время>",
+  // Sunset - дата отключения в формате HTTP-date, Successor - Url замены
+  Deprecated  bool
+  Deprecation string
+  Sunset      string
+  Successor   string
+}
 
-    
+// CallFunc вызывает следующий перехватчик в цепочке или сам метод API
+type CallFunc func(ctx context.Context) (interface{}, error)
 
-	result, err := h.Create(ctx, params)
+// Interceptor вызывается вокруг метода API после заполнения и валидации параметров,
+// params - указатель на структуру параметров метода, например *CreateParams.
+// Ошибка перехватчика обрабатывается так же, как ошибка метода
+type Interceptor func(ctx context.Context, route RouteInfo, params interface{}, next CallFunc) (interface{}, error)
 
-	// прочие обработки
-	if err != nil {
-		switch err.(type) {
-		case ApiError:
-			err := err.(ApiError)
-			status = err.HTTPStatus
-			errorMessage = err.Error()
-		default:
-            status = http.StatusInternalServerError
-			errorMessage = err.Error()
-		} 
+func intercept(ctx context.Context, route RouteInfo, params interface{}, interceptors []Interceptor, call CallFunc) (interface{}, error) {
+  if len(interceptors) == 0 {
+    return call(ctx)
+  }
+  return interceptors[0](ctx, route, params, func(ctx context.Context) (interface{}, error) {
+    return intercept(ctx, route, params, interceptors[1:], call)
+  })
+}
 
-		writeJsonResponse(w, Response{
-			"error": errorMessage,
-    	}, status)
-		return 
-	}
+// statusRecorder запоминает статус ответа для метрик и логов
+type statusRecorder struct {
+  http.ResponseWriter
+  status      int
+  wroteHeader bool
+  // ошибка, с которой завершился запрос
+  err error
+}
 
-	writeJsonResponse(w, Response{
-        "error": "",
-		"response": result,
-    }, status)
+func (rec *statusRecorder) WriteHeader(status int) {
+  if !rec.wroteHeader {
+    rec.status = status
+    rec.wroteHeader = true
+  }
+  rec.ResponseWriter.WriteHeader(status)
 }
 
-func (h *MyApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-    switch r.URL.Path {
+func (rec *statusRecorder) Write(data []byte) (int, error) {
+  rec.wroteHeader = true
+  return rec.ResponseWriter.Write(data)
+}
 
-    case "/user/profile":
-		
-		
-        h.handlerProfile(w, r)
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+  return rec.ResponseWriter
+}
 
-    case "/user/create":
-		
-		token := r.Header.Get("X-Auth")
-		if token != "100500" {
-			writeJsonResponse(w, Response{"error": "unauthorized"}, http.StatusForbidden)
-			return
-		}
-		
-		
-		if r.Method != "POST" {
-			writeJsonResponse(w, Response{"error": "bad method"}, http.StatusNotAcceptable)
-			return
-		}
-		
-        h.handlerCreate(w, r)
+// AccessLog - логгер для access-логов сгенерированных обработчиков, nil отключает их
+var AccessLog *slog.Logger
 
-    default:
-        // 404
-		writeJsonResponse(w, Response{"error": "unknown method"}, http.StatusNotFound)
-    }
+// PrincipalFunc возвращает пользователя запроса для access-лога, лимитов и ключей идемпотентности,
+// пустая строка - аноним. По умолчанию пользователь определяется токеном X-Auth,
+// в лог попадает только начало его хеша
+var PrincipalFunc = func(r *http.Request) string {
+  token := r.Header.Get("X-Auth")
+  if token == "" {
+    return ""
+  }
+  sum := sha256.Sum256([]byte(token))
+  return "x-auth:" + hex.EncodeToString(sum[:8])
 }
 
-func (h *MyApi) handlerProfile(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	status := http.StatusOK
-    errorMessage := ""
-	
-    // валидирование параметров
-	// заполнение структуры params
-	params := ProfileParams{}
-    paramName := ""
+func logAccess(r *http.Request, route RouteInfo, rec *statusRecorder, latency time.Duration) {
+  if AccessLog == nil {
+    return
+  }
 
-	
+  attrs := []slog.Attr{
+    slog.String("request_id", RequestIDFromContext(r.Context())),
+    slog.String("api", route.Api),
+    slog.String("route", r.URL.Path),
+    slog.String("method", route.MethodName),
+    slog.String("http_method", r.Method),
+    slog.Int("status", rec.status),
+    slog.Duration("latency", latency),
+  }
+  if principal := PrincipalFunc(r); principal != "" {
+    attrs = append(attrs, slog.String("principal", principal))
+  }
+  if route.Deprecated {
+    attrs = append(attrs, slog.Bool("deprecated", true))
+  }
+  if rec.err != nil {
+    var fieldErr FieldError
+    var fieldErrs ValidationErrors
+    if errors.As(rec.err, &fieldErr) || errors.As(rec.err, &fieldErrs) {
+      attrs = append(attrs, slog.String("validation", rec.err.Error()))
+    } else {
+      attrs = append(attrs, slog.String("error", rec.err.Error()))
+    }
+  }
 
-    paramName = strings.ToLower("Login")
-    
+  level := slog.LevelInfo
+  if rec.status >= 500 {
+    level = slog.LevelError
+  }
+  AccessLog.LogAttrs(r.Context(), level, "api request", attrs...)
+}
 
-    
-    params.Login = r.FormValue(paramName)
-    
-    
-	
-    if ok, err := (RequiredValidator{"required", paramName}).Validate(params.Login); !ok && err != nil {
-      writeJsonResponse(w, Response{
-        "error": err.Error(),
-      }, http.StatusBadRequest)
-      return
-    }
+// SpanContext - контекст трассировки в терминах W3C Trace Context
+type SpanContext struct {
+  TraceID string
+  SpanID  string
+  Sampled bool
+}
 
-    
+// Traceparent возвращает значение заголовка traceparent для исходящих запросов
+func (sc SpanContext) Traceparent() string {
+  flags := "00"
+  if sc.Sampled {
+    flags = "01"
+  }
+  return "00-" + sc.TraceID + "-" + sc.SpanID + "-" + flags
+}
 
-	result, err := h.Profile(ctx, params)
+// Span - вызов одного метода API
+type Span struct {
+  // имя span-а - url метода API
+  Name         string
+  Context      SpanContext
+  ParentSpanID string
+  Start        time.Time
+  End          time.Time
+  Attributes   map[string]string
+  Status       int
+  Err          string
+}
 
-	// прочие обработки
-	if err != nil {
-		switch err.(type) {
-		case ApiError:
-			err := err.(ApiError)
-			status = err.HTTPStatus
-			errorMessage = err.Error()
-		default:
-            status = http.StatusInternalServerError
-			errorMessage = err.Error()
-		} 
+// SpanExporter получает завершённые span-ы
+type SpanExporter interface {
+  ExportSpan(span Span)
+}
 
-		writeJsonResponse(w, Response{
-			"error": errorMessage,
-    	}, status)
-		return 
-	}
+// Tracer - куда отправлять span-ы, nil отключает трассировку
+var Tracer SpanExporter
 
-	writeJsonResponse(w, Response{
-        "error": "",
-		"response": result,
-    }, status)
+// InMemorySpanExporter хранит span-ы в памяти, например для тестов
+type InMemorySpanExporter struct {
+  mu    sync.Mutex
+  spans []Span
 }
 
-func (h *MyApi) handlerCreate(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	status := http.StatusOK
-    errorMessage := ""
-	
-    // валидирование параметров
-	// заполнение структуры params
-	params := CreateParams{}
-    paramName := ""
+func (e *InMemorySpanExporter) ExportSpan(span Span) {
+  e.mu.Lock()
+  e.spans = append(e.spans, span)
+  e.mu.Unlock()
+}
 
-	
+// Spans возвращает копию всех экспортированных span-ов
+func (e *InMemorySpanExporter) Spans() []Span {
+  e.mu.Lock()
+  defer e.mu.Unlock()
+  return append([]Span(nil), e.spans...)
+}
 
-    paramName = strings.ToLower("Login")
-    
+type spanContextKey struct{}
 
-    
-    params.Login = r.FormValue(paramName)
-    
-    
-	
-    if ok, err := (RequiredValidator{"required", paramName}).Validate(params.Login); !ok && err != nil {
-      writeJsonResponse(w, Response{
-        "error": err.Error(),
-      }, http.StatusBadRequest)
-      return
-    }
+// SpanContextFromContext возвращает контекст трассировки из ctx, который передаётся в методы API
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+  sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+  return sc, ok
+}
 
-    if ok, err := (StringMinValidator{"min=10", paramName, 10 }).Validate(params.Login); !ok && err != nil {
-      writeJsonResponse(w, Response{
-        "error": err.Error(),
-      }, http.StatusBadRequest)
-      return
+// parseTraceparent разбирает заголовок traceparent версии 00
+func parseTraceparent(value string) (SpanContext, bool) {
+  parts := strings.Split(value, "-")
+  if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+    return SpanContext{}, false
+  }
+  for _, part := range parts[1:] {
+    if _, err := hex.DecodeString(part); err != nil {
+      return SpanContext{}, false
     }
+  }
+  // нулевые trace-id и span-id недопустимы
+  if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+    return SpanContext{}, false
+  }
+  flags, _ := hex.DecodeString(parts[3])
+  return SpanContext{TraceID: parts[1], SpanID: parts[2], Sampled: flags[0]&1 == 1}, true
+}
 
-    
+func randomHex(size int) string {
+  buf := make([]byte, size)
+  rand.Read(buf)
+  return hex.EncodeToString(buf)
+}
 
-    paramName = strings.ToLower("Name")
-    paramName = "full_name"
+// startSpan продолжает трассу из заголовка traceparent или начинает новую
+// и кладёт контекст нового span-а в контекст запроса
+func startSpan(r *http.Request) (*http.Request, *Span) {
+  if Tracer == nil {
+    return r, nil
+  }
 
-    
-    params.Name = r.FormValue(paramName)
-    
-    
-	
-    
+  span := &Span{
+    Context: SpanContext{SpanID: randomHex(8), Sampled: true},
+    Start:   time.Now(),
+  }
+  if parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+    span.Context.TraceID = parent.TraceID
+    span.Context.Sampled = parent.Sampled
+    span.ParentSpanID = parent.SpanID
+  } else {
+    span.Context.TraceID = randomHex(16)
+  }
 
-    paramName = strings.ToLower("Status")
-    
+  return r.WithContext(context.WithValue(r.Context(), spanContextKey{}, span.Context)), span
+}
 
-    
-    params.Status = r.FormValue(paramName)
-    
-    
-	
-	if params.Status == "" {
-	 params.Status = "user"
-	}
-    if ok, err := (EnumValidator{"enum=user|moderator|admin", paramName, map[string]int{ "user":1, "moderator":1, "admin": 1 }}).Validate(params.Status); !ok && err != nil {
-      writeJsonResponse(w, Response{
-        "error": err.Error(),
-      }, http.StatusBadRequest)
-      return
-    }
+// finishSpan экспортирует span, если трасса сэмплирована: с родителем -00 контекст
+// передаётся в метод и дальше, но сам span не отправляется
+func finishSpan(span *Span, route RouteInfo, rec *statusRecorder) {
+  if span == nil || Tracer == nil || !span.Context.Sampled {
+    return
+  }
 
-    
+  span.Name = route.URL
+  if span.Name == "" {
+    span.Name = route.MethodName
+  }
+  span.End = time.Now()
+  span.Status = rec.status
+  span.Attributes = map[string]string{
+    "api":    route.Api,
+    "method": route.MethodName,
+  }
+  if rec.err != nil {
+    span.Err = rec.err.Error()
+  }
+  Tracer.ExportSpan(*span)
+}
 
-    paramName = strings.ToLower("Age")
-    
+// RateLimiter решает, можно ли выполнить ещё один запрос с ключом key при лимите
+// rate запросов в секунду и всплеске до burst; при отказе возвращает, через сколько повторить
+type RateLimiter interface {
+  Allow(key string, rate float64, burst int) (bool, time.Duration)
+}
 
-    
-    
-    value, err := strconv.Atoi(r.FormValue(paramName))
-    if err != nil {
-      writeJsonResponse(w, Response{"error": paramName + " must be int"}, http.StatusBadRequest)
-      return
-	}
-	params.Age = value
-    
-	
-    if ok, err := (IntMinValidator{"min=0", paramName, 0 }).Validate(params.Age); !ok && err != nil {
-      writeJsonResponse(w, Response{
-        "error": err.Error(),
-      }, http.StatusBadRequest)
-      return
-    }
+// RateLimitStore хранит состояние лимитов всех методов API,
+// его можно заменить распределённой реализацией RateLimiter.
+// Корзина определяется API, маршрутом из аннотации и клиентом, но не экземпляром:
+// экземпляры API и их монтирования в Mux расходуют один лимит, как и процессы
+// за общим распределённым хранилищем
+var RateLimitStore RateLimiter = NewTokenBucketLimiter()
+
+type tokenBucket struct {
+  tokens float64
+  last   time.Time
+  // за сколько пустая корзина заполняется до burst
+  refill time.Duration
+}
 
-    if ok, err := (IntMaxValidator{"max=128", paramName, 128 }).Validate(params.Age); !ok && err != nil {
-      writeJsonResponse(w, Response{
-        "error": err.Error(),
-      }, http.StatusBadRequest)
-      return
-    }
+// TokenBucketLimiter - RateLimiter в памяти процесса по алгоритму token bucket
+type TokenBucketLimiter struct {
+  // Now - текущее время, подменяется в тестах
+  Now func() time.Time
 
-    
+  mu      sync.Mutex
+  buckets map[string]*tokenBucket
+  calls   int
+}
+
+func NewTokenBucketLimiter() *TokenBucketLimiter {
+  return &TokenBucketLimiter{
+    Now:     time.Now,
+    buckets: make(map[string]*tokenBucket),
+  }
+}
 
-	result, err := h.Create(ctx, params)
+func (l *TokenBucketLimiter) Allow(key string, rate float64, burst int) (bool, time.Duration) {
+  now := l.Now()
 
-	// прочие обработки
-	if err != nil {
-		switch err.(type) {
-		case ApiError:
-			err := err.(ApiError)
-			status = err.HTTPStatus
-			errorMessage = err.Error()
-		default:
-            status = http.StatusInternalServerError
-			errorMessage = err.Error()
-		} 
+  l.mu.Lock()
+  defer l.mu.Unlock()
 
-		writeJsonResponse(w, Response{
-			"error": errorMessage,
-    	}, status)
-		return 
-	}
+  l.calls++
+  if l.calls%1024 == 0 {
+    l.sweep(now)
+  }
 
-	writeJsonResponse(w, Response{
-        "error": "",
-		"response": result,
-    }, status)
+  bucket, ok := l.buckets[key]
+  if !ok {
+    refill := time.Duration(float64(burst) / rate * float64(time.Second))
+    bucket = &tokenBucket{tokens: float64(burst), last: now, refill: refill}
+    l.buckets[key] = bucket
+  }
+
+  bucket.tokens = math.Min(float64(burst), bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+  bucket.last = now
+  if bucket.tokens >= 1 {
+    bucket.tokens--
+    return true, 0
+  }
+
+  return false, time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+}
+
+// sweep удаляет корзины, которые успели бы заполниться до конца,
+// чтобы map не рос от разовых клиентов
+func (l *TokenBucketLimiter) sweep(now time.Time) {
+  for key, bucket := range l.buckets {
+    if now.Sub(bucket.last) > bucket.refill {
+      delete(l.buckets, key)
+    }
+  }
+}
+
+// CompressMinSize - ответы меньше этого размера в байтах отдаются без сжатия
+var CompressMinSize = 1024
+
+// compressor - gzip.Writer или zlib.Writer, которые можно переиспользовать через Reset
+type compressor interface {
+  io.WriteCloser
+  Reset(w io.Writer)
+}
+
+// compressors - пулы writer-ов по content-coding; deflate в HTTP - это формат zlib
+var compressors = map[string]*sync.Pool{
+  "gzip": {New: func() interface{} {
+    return gzip.NewWriter(io.Discard)
+  }},
+  "deflate": {New: func() interface{} {
+    return zlib.NewWriter(io.Discard)
+  }},
+}
+
+// incompressibleTypes - уже сжатые форматы, которые не стоит сжимать ещё раз
+var incompressibleTypes = map[string]bool{
+  "application/gzip":             true,
+  "application/x-gzip":           true,
+  "application/zip":              true,
+  "application/zstd":             true,
+  "application/x-7z-compressed":  true,
+  "application/x-rar-compressed": true,
+  "font/woff":                    true,
+  "font/woff2":                   true,
+}
+
+func compressible(contentType string) bool {
+  mediaType, _, err := mime.ParseMediaType(contentType)
+  if err != nil {
+    return contentType == ""
+  }
+  if mediaType == "image/svg+xml" {
+    return true
+  }
+  for _, prefix := range []string{"image/", "video/", "audio/"} {
+    if strings.HasPrefix(mediaType, prefix) {
+      return false
+    }
+  }
+  return !incompressibleTypes[mediaType]
+}
+
+// negotiateEncoding выбирает gzip или deflate по Accept-Encoding с учётом q,
+// при равном q предпочитается gzip; пустая строка - ответ без сжатия
+func negotiateEncoding(acceptEncoding string) string {
+  qualities := make(map[string]float64, 3)
+  for _, item := range strings.Split(acceptEncoding, ",") {
+    coding, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+    coding = strings.ToLower(strings.TrimSpace(coding))
+    if coding == "" {
+      continue
+    }
+
+    q := 1.0
+    if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+      if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+        q = parsed
+      }
+    }
+    qualities[coding] = q
+  }
+
+  best, bestQ := "", 0.0
+  for _, coding := range []string{"gzip", "deflate"} {
+    // явно указанный coding важнее "*"
+    q, ok := qualities[coding]
+    if !ok {
+      q = qualities["*"]
+    }
+    if q > bestQ {
+      best, bestQ = coding, q
+    }
+  }
+  return best
+}
+
+// compressWriter копит начало ответа до CompressMinSize и только потом решает,
+// сжимать ли его: маленькие, уже сжатые и пустые ответы уходят как есть
+type compressWriter struct {
+  http.ResponseWriter
+  encoding string
+  status   int
+  buf      []byte
+  decided  bool
+  writer   compressor
+}
+
+// newCompressWriter добавляет Vary: Accept-Encoding и возвращает обёртку над w,
+// если клиент принимает gzip или deflate, иначе nil
+func newCompressWriter(w http.ResponseWriter, r *http.Request) *compressWriter {
+  w.Header().Add("Vary", "Accept-Encoding")
+  encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+  if encoding == "" {
+    return nil
+  }
+  return &compressWriter{ResponseWriter: w, encoding: encoding}
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+  if status < 200 {
+    cw.ResponseWriter.WriteHeader(status)
+    return
+  }
+  if cw.status == 0 {
+    cw.status = status
+  }
+}
+
+func (cw *compressWriter) Write(data []byte) (int, error) {
+  if cw.status == 0 {
+    cw.status = http.StatusOK
+  }
+  if !cw.decided {
+    if len(cw.buf)+len(data) < CompressMinSize {
+      cw.buf = append(cw.buf, data...)
+      return len(data), nil
+    }
+    if err := cw.decide(true); err != nil {
+      return 0, err
+    }
+  }
+  if cw.writer != nil {
+    return cw.writer.Write(data)
+  }
+  return cw.ResponseWriter.Write(data)
+}
+
+// decide пишет заголовки и накопленное начало ответа, сжимая его, если large
+// и формат ответа того стоит
+func (cw *compressWriter) decide(large bool) error {
+  cw.decided = true
+  header := cw.Header()
+  if large && header.Get("Content-Encoding") == "" && compressible(header.Get("Content-Type")) &&
+    cw.status != http.StatusNoContent && cw.status != http.StatusNotModified {
+    header.Set("Content-Encoding", cw.encoding)
+    header.Del("Content-Length")
+    // сжатое тело отличается от того, по которому считался strong ETag
+    if etag := header.Get("ETag"); strings.HasPrefix(etag, "\"") {
+      header.Set("ETag", "W/"+etag)
+    }
+    cw.writer = compressors[cw.encoding].Get().(compressor)
+    cw.writer.Reset(cw.ResponseWriter)
+  }
+  cw.ResponseWriter.WriteHeader(cw.status)
+
+  buf := cw.buf
+  cw.buf = nil
+  if len(buf) == 0 {
+    return nil
+  }
+  var err error
+  if cw.writer != nil {
+    _, err = cw.writer.Write(buf)
+  } else {
+    _, err = cw.ResponseWriter.Write(buf)
+  }
+  return err
+}
+
+// Close дописывает ответ и возвращает writer в пул
+func (cw *compressWriter) Close() {
+  if !cw.decided {
+    if cw.status == 0 {
+      // ответ не начат, например метод запаниковал - пусть отвечает recoverPanic
+      return
+    }
+    if err := cw.decide(false); err != nil {
+      WriteErrorHook(err)
+    }
+  }
+  if cw.writer == nil {
+    return
+  }
+  if err := cw.writer.Close(); err != nil {
+    WriteErrorHook(err)
+  }
+  cw.writer.Reset(io.Discard)
+  compressors[cw.encoding].Put(cw.writer)
+  cw.writer = nil
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+  return cw.ResponseWriter
+}
+
+// IdempotencyKeyHeader - заголовок с ключом идемпотентности запроса
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+var (
+  // ErrIdempotencyKeyInUse - запрос с этим ключом ещё выполняется
+  ErrIdempotencyKeyInUse = errors.New("request with this idempotency key is in progress")
+  // ErrIdempotencyKeyMismatch - ключ уже использован с другими параметрами
+  ErrIdempotencyKeyMismatch = errors.New("idempotency key was used with different params")
+)
+
+// StoredResponse - сохранённый ответ на первый запрос с ключом идемпотентности
+type StoredResponse struct {
+  Status int
+  Header http.Header
+  Body   []byte
+}
+
+// IdempotencyStore хранит ответы методов с "idempotent": true по ключам идемпотентности.
+// Begin занимает свободный ключ и возвращает nil, nil; для ключа с сохранённым ответом
+// возвращает этот ответ, а для занятого ключа - ErrIdempotencyKeyInUse или,
+// если отпечаток параметров другой, ErrIdempotencyKeyMismatch.
+// Save сохраняет ответ занятого ключа, Release освобождает ключ без ответа
+type IdempotencyStore interface {
+  Begin(key, fingerprint string) (*StoredResponse, error)
+  Save(key string, response StoredResponse)
+  Release(key string)
+}
+
+// IdempotencyResponses хранит ответы всех методов API,
+// его можно заменить распределённой реализацией IdempotencyStore
+var IdempotencyResponses IdempotencyStore = NewMemoryIdempotencyStore(24 * time.Hour)
+
+type idempotencyEntry struct {
+  fingerprint string
+  // nil - запрос ещё выполняется
+  response *StoredResponse
+  expires  time.Time
+}
+
+// MemoryIdempotencyStore - IdempotencyStore в памяти процесса, ключи живут TTL
+type MemoryIdempotencyStore struct {
+  TTL time.Duration
+  // Now - текущее время, подменяется в тестах
+  Now func() time.Time
+
+  mu      sync.Mutex
+  entries map[string]*idempotencyEntry
+  calls   int
+}
+
+func NewMemoryIdempotencyStore(ttl time.Duration) *MemoryIdempotencyStore {
+  return &MemoryIdempotencyStore{
+    TTL:     ttl,
+    Now:     time.Now,
+    entries: make(map[string]*idempotencyEntry),
+  }
+}
+
+func (s *MemoryIdempotencyStore) Begin(key, fingerprint string) (*StoredResponse, error) {
+  now := s.Now()
+
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.calls++
+  if s.calls%1024 == 0 {
+    s.sweep(now)
+  }
+
+  entry, ok := s.entries[key]
+  if !ok || now.After(entry.expires) {
+    s.entries[key] = &idempotencyEntry{fingerprint: fingerprint, expires: now.Add(s.TTL)}
+    return nil, nil
+  }
+  if entry.fingerprint != fingerprint {
+    return nil, ErrIdempotencyKeyMismatch
+  }
+  if entry.response == nil {
+    return nil, ErrIdempotencyKeyInUse
+  }
+  return entry.response, nil
+}
+
+func (s *MemoryIdempotencyStore) Save(key string, response StoredResponse) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if entry, ok := s.entries[key]; ok {
+    entry.response = &response
+    entry.expires = s.Now().Add(s.TTL)
+  }
+}
+
+func (s *MemoryIdempotencyStore) Release(key string) {
+  s.mu.Lock()
+  delete(s.entries, key)
+  s.mu.Unlock()
+}
+
+// sweep удаляет ключи с истёкшим TTL, чтобы map не рос от разовых клиентов
+func (s *MemoryIdempotencyStore) sweep(now time.Time) {
+  for key, entry := range s.entries {
+    if now.After(entry.expires) {
+      delete(s.entries, key)
+    }
+  }
+}
+
+// idempotencyRecorder запоминает ответ метода, чтобы сохранить его по ключу идемпотентности
+type idempotencyRecorder struct {
+  http.ResponseWriter
+  key    string
+  status int
+  body   bytes.Buffer
+  // ответ сохранит recorder из detach
+  detached bool
+}
+
+// beginIdempotent занимает ключ идемпотентности запроса. Если ответ уже готов -
+// повторяет его, если ключ занят или использован с другими параметрами - отвечает
+// 409 или 422; в этих случаях done = true и метод вызывать не нужно
+func beginIdempotent(w http.ResponseWriter, r *http.Request, route RouteInfo, key string) (*idempotencyRecorder, bool) {
+  // у анонимов одно пространство ключей, и чужой ключ отдал бы чужой ответ
+  principal := PrincipalFunc(r)
+  if principal == "" {
+    writeError(w, r, http.StatusBadRequest, errors.New(IdempotencyKeyHeader+" requires an authenticated client"))
+    return nil, true
+  }
+  // ключи разных методов и пользователей не пересекаются
+  key = route.Api + "." + route.MethodName + " " + principal + " " + key
+  sum := sha256.Sum256([]byte(r.Method + " " + r.URL.Path + "?" + r.Form.Encode()))
+
+  stored, err := IdempotencyResponses.Begin(key, hex.EncodeToString(sum[:]))
+  switch {
+  case errors.Is(err, ErrIdempotencyKeyMismatch):
+    writeError(w, r, http.StatusUnprocessableEntity, err)
+    return nil, true
+  case err != nil:
+    writeError(w, r, http.StatusConflict, err)
+    return nil, true
+  case stored != nil:
+    // заголовки, которые уже выставил этот запрос (CORS, Deprecation), остаются его, Vary объединяется
+    header := w.Header()
+    for name, values := range stored.Header {
+      current, ok := header[name]
+      switch {
+      case !ok:
+        header[name] = values
+      case name == "Vary":
+        for _, value := range values {
+          if !slices.Contains(current, value) {
+            header.Add("Vary", value)
+          }
+        }
+      }
+    }
+    w.Header().Set("Idempotent-Replayed", "true")
+    w.WriteHeader(stored.Status)
+    if _, err := w.Write(stored.Body); err != nil {
+      WriteErrorHook(err)
+    }
+    return nil, true
+  }
+  return &idempotencyRecorder{ResponseWriter: w, key: key}, false
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+  rec.status = status
+  rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(data []byte) (int, error) {
+  if rec.status == 0 {
+    rec.status = http.StatusOK
+  }
+  rec.body.Write(data)
+  return rec.ResponseWriter.Write(data)
+}
+
+func (rec *idempotencyRecorder) Unwrap() http.ResponseWriter {
+  return rec.ResponseWriter
+}
+
+// detach оставляет ключ занятым после ответа клиенту и возвращает recorder,
+// в который запишется и по ключу сохранится ответ метода, когда тот завершится
+func (rec *idempotencyRecorder) detach() *idempotencyRecorder {
+  rec.detached = true
+  return &idempotencyRecorder{
+    ResponseWriter: &detachedResponse{header: rec.Header().Clone()},
+    key:            rec.key,
+  }
+}
+
+// finish сохраняет ответ метода. Ответы 5xx, 499 и паника не сохраняются,
+// чтобы повтор с тем же ключом мог выполнить метод ещё раз
+func (rec *idempotencyRecorder) finish() {
+  if rec.detached {
+    return
+  }
+  if rec.status == 0 || rec.status >= 500 || rec.status == StatusClientClosedRequest {
+    IdempotencyResponses.Release(rec.key)
+    return
+  }
+
+  header := rec.Header().Clone()
+  header.Del(RequestIDHeader)
+  // CORS зависит от Origin повтора, его заголовки повтор ставит сам
+  for name := range header {
+    if strings.HasPrefix(name, "Access-Control-") {
+      delete(header, name)
+    }
+  }
+  // сохраняется несжатое тело, повтор сожмётся по Accept-Encoding нового запроса
+  header.Del("Content-Encoding")
+  IdempotencyResponses.Save(rec.key, StoredResponse{
+    Status: rec.status,
+    Header: header,
+    Body:   bytes.Clone(rec.body.Bytes()),
+  })
+}
+
+// detachedResponse принимает ответ метода, который завершился уже после ответа клиенту
+type detachedResponse struct {
+  header http.Header
+}
+
+func (d *detachedResponse) Header() http.Header {
+  return d.header
+}
+
+func (d *detachedResponse) Write(data []byte) (int, error) {
+  return len(data), nil
+}
+
+func (d *detachedResponse) WriteHeader(int) {}
+
+// rateLimitKey возвращает клиента запроса для лимита: ip, principal или header:<имя>
+func rateLimitKey(r *http.Request, key string) string {
+  client := ""
+  switch {
+  case key == "principal":
+    client = PrincipalFunc(r)
+  case strings.HasPrefix(key, "header:"):
+    client = r.Header.Get(strings.TrimPrefix(key, "header:"))
+  }
+  if client != "" {
+    return key + "=" + client
+  }
+
+  // без principal-а или заголовка ограничиваем по ip
+  host, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil {
+    host = r.RemoteAddr
+  }
+  return "ip=" + host
+}
+
+// allowRequest проверяет лимит метода API и отвечает 429, если он исчерпан
+func allowRequest(w http.ResponseWriter, r *http.Request, route RouteInfo, rate float64, burst int, key string) bool {
+  ok, retryAfter := RateLimitStore.Allow(route.Api+" "+route.URL+" "+rateLimitKey(r, key), rate, burst)
+  if ok {
+    return true
+  }
+  w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+  writeError(w, r, http.StatusTooManyRequests, errors.New("rate limit exceeded"))
+  return false
+}
+
+// CORSConfig - настройки CORS метода API
+type CORSConfig struct {
+  // "*" - любой источник
+  Origins []string
+  // пустой список - HTTP-метод из аннотации, для методов без него GET и POST
+  Methods     []string
+  Headers     []string
+  Credentials bool
+  // в секундах, 0 - не отправлять Access-Control-Max-Age
+  MaxAge int
+}
+
+func (c *CORSConfig) allowedOrigin(origin string) string {
+  for _, allowed := range c.Origins {
+    if allowed == origin {
+      return origin
+    }
+    if allowed == "*" {
+      return "*"
+    }
+  }
+  return ""
+}
+
+func (c *CORSConfig) allowedMethods(route RouteInfo) []string {
+  if len(c.Methods) > 0 {
+    return c.Methods
+  }
+  if route.HTTPMethod != "" {
+    return []string{route.HTTPMethod}
+  }
+  return []string{http.MethodGet, http.MethodPost}
+}
+
+// handleCORS добавляет CORS-заголовки к ответу и сам отвечает на preflight-запрос,
+// возвращает true, если запрос уже обработан
+func handleCORS(w http.ResponseWriter, r *http.Request, route RouteInfo, cors *CORSConfig) bool {
+  origin := r.Header.Get("Origin")
+  if origin == "" {
+    return false
+  }
+
+  w.Header().Add("Vary", "Origin")
+  allowedOrigin := cors.allowedOrigin(origin)
+  preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+  if allowedOrigin == "" {
+    if preflight {
+      writeError(w, r, http.StatusForbidden, errors.New("cors origin not allowed"))
+    }
+    return preflight
+  }
+
+  w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
+  // кодогенератор не пропускает "*" вместе с credentials
+  if cors.Credentials && allowedOrigin != "*" {
+    w.Header().Set("Access-Control-Allow-Credentials", "true")
+  }
+  if !preflight {
+    return false
+  }
+
+  methods := cors.allowedMethods(route)
+  requested := r.Header.Get("Access-Control-Request-Method")
+  allowed := false
+  for _, method := range methods {
+    allowed = allowed || method == requested
+  }
+  if !allowed {
+    writeError(w, r, http.StatusForbidden, errors.New("cors method not allowed"))
+    return true
+  }
+
+  w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+  if len(cors.Headers) > 0 {
+    w.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.Headers, ", "))
+  }
+  if cors.MaxAge > 0 {
+    w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+  }
+  w.WriteHeader(http.StatusNoContent)
+  return true
+}
+
+// limitBody ограничивает тело запроса и сразу разбирает форму,
+// чтобы ответить 413, а не ошибкой валидации пустых параметров
+func limitBody(w http.ResponseWriter, r *http.Request, maxBody int64) bool {
+  r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+  err := r.ParseForm()
+  if err == nil {
+    return true
+  }
+
+  var tooLarge *http.MaxBytesError
+  if errors.As(err, &tooLarge) {
+    writeError(w, r, http.StatusRequestEntityTooLarge, errors.New("request body too large"))
+  } else {
+    writeError(w, r, http.StatusBadRequest, err)
+  }
+  return false
+}
+
+// checkContentType отвечает 415, если у запроса есть тело с Content-Type не из списка
+func checkContentType(w http.ResponseWriter, r *http.Request, consumes []string) bool {
+  if r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+    return true
+  }
+
+  mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+  if err == nil {
+    for _, allowed := range consumes {
+      if mediaType == allowed {
+        return true
+      }
+    }
+  }
+
+  writeError(w, r, http.StatusUnsupportedMediaType, errors.New("unsupported content type, expected one of ["+strings.Join(consumes, ", ")+"]"))
+  return false
+}
+
+// requestValue возвращает параметр пути, а если такого нет - параметр из формы или query
+func requestValue(r *http.Request, name string) string {
+  if value := r.PathValue(name); value != "" {
+    return value
+  }
+  return r.FormValue(name)
+}
+
+// nextSegment отрезает от пути "/a/b" первый сегмент и возвращает "a" и "/b"
+func nextSegment(path string) (string, string) {
+  path = path[1:]
+  if i := strings.IndexByte(path, '/'); i >= 0 {
+    return path[:i], path[i:]
+  }
+  return path, ""
+}
+
+// pathSegment возвращает n-й сегмент пути, считая с нуля
+func pathSegment(path string, n int) string {
+  segment := ""
+  for i := 0; i <= n && path != ""; i++ {
+    segment, path = nextSegment(path)
+  }
+  return segment
+}
+
+// pathTail возвращает остаток пути начиная с n-го сегмента, без ведущего "/"
+func pathTail(path string, n int) string {
+  for i := 0; i < n && path != ""; i++ {
+    _, path = nextSegment(path)
+  }
+  return strings.TrimPrefix(path, "/")
+}
+
+// toggleTrailingSlash добавляет или убирает "/" в конце пути, для корня возвращает ""
+// originalPath возвращает путь запроса до http.StripPrefix
+func originalPath(r *http.Request) string {
+  if u, err := url.ParseRequestURI(r.RequestURI); err == nil && u.Path != "" {
+    return u.Path
+  }
+  return r.URL.Path
+}
+
+func toggleTrailingSlash(path string) string {
+  switch {
+  case path == "/" || path == "":
+    return ""
+  case strings.HasSuffix(path, "/"):
+    return path[:len(path)-1]
+  }
+  return path + "/"
+}
+
+// VersionHeader - заголовок с версией API для стратегии версионирования header
+const VersionHeader = "Accept-Version"
+
+// requestVersion возвращает запрошенную клиентом версию API: из заголовка Accept-Version
+// или из параметра version в Accept, например "application/json; version=v2"
+func requestVersion(r *http.Request, strategy string) string {
+  if strategy == "header" {
+    return r.Header.Get(VersionHeader)
+  }
+  for _, item := range strings.Split(r.Header.Get("Accept"), ",") {
+    if _, params, err := mime.ParseMediaType(strings.TrimSpace(item)); err == nil && params["version"] != "" {
+      return params["version"]
+    }
+  }
+  return ""
+}
+
+// routesOverlap сообщает, может ли один путь подойти под оба шаблона маршрутов;
+// обычный путь запроса - шаблон без параметров, так что функция годится и для сопоставления
+func routesOverlap(a, b string) bool {
+  for a != "" && b != "" {
+    segmentA, restA := nextSegment(a)
+    segmentB, restB := nextSegment(b)
+    paramA, paramB := strings.HasPrefix(segmentA, "{"), strings.HasPrefix(segmentB, "{")
+    switch {
+    case strings.HasSuffix(segmentA, "...}") || strings.HasSuffix(segmentB, "...}"):
+      return true
+    case paramA && paramB:
+    case paramA && segmentB == "", paramB && segmentA == "":
+      return false
+    case !paramA && !paramB && segmentA != segmentB:
+      return false
+    }
+    a, b = restA, restB
+  }
+  return a == b
+}
+
+// Mountable - API, которое можно смонтировать в Mux: сгенерированный API, его Handler или другой Mux
+type Mountable interface {
+  http.Handler
+  Routes() []RouteInfo
+}
+
+// Mount - API и префикс пути, под которым оно обслуживается, "" - корень
+type Mount struct {
+  Prefix string
+  API    Mountable
+}
+
+type mountedAPI struct {
+  prefix  string
+  routes  []RouteInfo
+  handler http.Handler
+  // под тем же префиксом смонтированы другие API, нужно сверять маршруты
+  shared bool
+}
+
+// Mux объединяет несколько API под своими префиксами
+type Mux struct {
+  mounts []mountedAPI
+  routes []RouteInfo
+}
+
+// NewMux собирает Mux и возвращает ошибку, если маршруты разных API
+// с учётом префиксов могут подойти под один и тот же путь
+func NewMux(mounts ...Mount) (*Mux, error) {
+  mux := &Mux{}
+  prefixes := make(map[string]int, len(mounts))
+  for _, m := range mounts {
+    prefix := strings.TrimSuffix(m.Prefix, "/")
+    if prefix != "" && !strings.HasPrefix(prefix, "/") {
+      return nil, fmt.Errorf("mount prefix %q must start with /", m.Prefix)
+    }
+
+    // свои маршруты API различает сам: статический сегмент важнее параметра,
+    // а маршруты с одним Url разных версий выбирает по версии
+    mounted := mux.routes
+    routes := m.API.Routes()
+    for _, route := range routes {
+      route.URL = prefix + route.URL
+      for _, other := range mounted {
+        if routesOverlap(route.URL, other.URL) {
+          return nil, fmt.Errorf("route %s %s.%s overlaps %s %s.%s", route.URL, route.Api, route.MethodName, other.URL, other.Api, other.MethodName)
+        }
+      }
+      mux.routes = append(mux.routes, route)
+    }
+
+    var handler http.Handler = m.API
+    if prefix != "" {
+      handler = http.StripPrefix(prefix, m.API)
+    }
+    mux.mounts = append(mux.mounts, mountedAPI{prefix: prefix, routes: routes, handler: handler})
+    prefixes[prefix]++
+  }
+
+  for i := range mux.mounts {
+    mux.mounts[i].shared = prefixes[mux.mounts[i].prefix] > 1
+  }
+  // более длинный префикс проверяется раньше
+  sort.SliceStable(mux.mounts, func(i, j int) bool {
+    return len(mux.mounts[i].prefix) > len(mux.mounts[j].prefix)
+  })
+  return mux, nil
+}
+
+// Routes возвращает маршруты всех API с префиксами, поэтому Mux можно смонтировать в другой Mux
+func (mux *Mux) Routes() []RouteInfo {
+  return append([]RouteInfo(nil), mux.routes...)
+}
+
+func (mux *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  path := r.URL.Path
+  for _, m := range mux.mounts {
+    if m.prefix != "" && path != m.prefix && !strings.HasPrefix(path, m.prefix+"/") {
+      continue
+    }
+    if m.shared && !m.serves(strings.TrimPrefix(path, m.prefix)) {
+      continue
+    }
+    m.handler.ServeHTTP(w, r)
+    return
+  }
+  writeError(w, r, http.StatusNotFound, errors.New("unknown method"))
+}
+
+func (m mountedAPI) serves(path string) bool {
+  for _, route := range m.routes {
+    if routesOverlap(route.URL, path) {
+      return true
+    }
+  }
+  return false
+}
+
+// RequestIDHeader - заголовок, из которого берётся и в который возвращается id запроса
+const RequestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// RequestIDFromContext возвращает id запроса из ctx, который передаётся в методы API
+func RequestIDFromContext(ctx context.Context) string {
+  id, _ := ctx.Value(requestIDKey{}).(string)
+  return id
+}
+
+// withRequestID берёт id запроса из заголовка или генерирует новый,
+// возвращает его в ответе и кладёт в контекст запроса
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+  id := r.Header.Get(RequestIDHeader)
+  if id == "" {
+    buf := make([]byte, 16)
+    rand.Read(buf)
+    id = hex.EncodeToString(buf)
+  }
+  w.Header().Set(RequestIDHeader, id)
+  return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// MetricsHook получает результат каждого запроса к сгенерированным обработчикам
+type MetricsHook interface {
+  ObserveRequest(route RouteInfo, status int, latency time.Duration)
+}
+
+// InFlightHook - необязательное расширение MetricsHook,
+// получает число выполняющихся вызовов методов с max_inflight
+type InFlightHook interface {
+  ObserveInFlight(route RouteInfo, inFlight int)
+}
+
+// DeprecationHook - необязательное расширение MetricsHook,
+// получает каждый вызов устаревшего метода
+type DeprecationHook interface {
+  ObserveDeprecated(route RouteInfo)
+}
+
+// markDeprecated добавляет к ответу заголовки Deprecation, Sunset и Link
+// и сообщает о вызове устаревшего метода в DeprecationHook
+func markDeprecated(w http.ResponseWriter, route RouteInfo) {
+  w.Header().Set("Deprecation", route.Deprecation)
+  if route.Sunset != "" {
+    w.Header().Set("Sunset", route.Sunset)
+  }
+  if route.Successor != "" {
+    w.Header().Add("Link", "<"+route.Successor+">; rel=\"successor-version\"")
+  }
+  if hook, ok := Metrics.(DeprecationHook); ok {
+    hook.ObserveDeprecated(route)
+  }
+}
+
+func observeInFlight(route RouteInfo, inFlight int) {
+  if hook, ok := Metrics.(InFlightHook); ok {
+    hook.ObserveInFlight(route, inFlight)
+  }
+}
+
+// acquireSlot ждёт места в bulkhead не дольше queueTimeout и отвечает 503, если не дождался
+func acquireSlot(w http.ResponseWriter, r *http.Request, route RouteInfo, bulkhead chan struct{}, queueTimeout time.Duration) bool {
+  select {
+  case bulkhead <- struct{}{}:
+    observeInFlight(route, len(bulkhead))
+    return true
+  default:
+  }
+
+  if queueTimeout > 0 {
+    timer := time.NewTimer(queueTimeout)
+    defer timer.Stop()
+    select {
+    case bulkhead <- struct{}{}:
+      observeInFlight(route, len(bulkhead))
+      return true
+    case <-timer.C:
+    case <-r.Context().Done():
+    }
+  }
+
+  writeError(w, r, http.StatusServiceUnavailable, errors.New("too many concurrent requests"))
+  return false
+}
+
+func releaseSlot(route RouteInfo, bulkhead chan struct{}) {
+  <-bulkhead
+  observeInFlight(route, len(bulkhead))
+}
+
+// Metrics - куда отправлять метрики, nil отключает их сбор
+var Metrics MetricsHook = DefaultMetrics
+
+// DefaultMetrics собирает метрики всех API, отдаёт их в формате Prometheus через ServeHTTP
+var DefaultMetrics = NewPrometheusMetrics()
+
+// границы корзин гистограммы длительности запросов в секундах
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metricsRoute struct {
+  api    string
+  method string
+}
+
+type metricsStatus struct {
+  metricsRoute
+  status int
+}
+
+type latencyHistogram struct {
+  buckets []uint64
+  sum     float64
+  count   uint64
+}
+
+// PrometheusMetrics считает запросы, ошибки по статусам и длительность запросов
+// по каждому методу API и отдаёт их в текстовом формате Prometheus
+type PrometheusMetrics struct {
+  mu         sync.Mutex
+  requests   map[metricsStatus]uint64
+  latency    map[metricsRoute]*latencyHistogram
+  inFlight   map[metricsRoute]int
+  deprecated map[metricsRoute]uint64
+}
+
+func NewPrometheusMetrics() *PrometheusMetrics {
+  return &PrometheusMetrics{
+    requests:   make(map[metricsStatus]uint64),
+    latency:    make(map[metricsRoute]*latencyHistogram),
+    inFlight:   make(map[metricsRoute]int),
+    deprecated: make(map[metricsRoute]uint64),
+  }
+}
+
+func (m *PrometheusMetrics) ObserveDeprecated(route RouteInfo) {
+  m.mu.Lock()
+  m.deprecated[metricsRoute{route.Api, route.MethodName}]++
+  m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) ObserveInFlight(route RouteInfo, inFlight int) {
+  m.mu.Lock()
+  m.inFlight[metricsRoute{route.Api, route.MethodName}] = inFlight
+  m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) ObserveRequest(route RouteInfo, status int, latency time.Duration) {
+  key := metricsRoute{route.Api, route.MethodName}
+  seconds := latency.Seconds()
+
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  m.requests[metricsStatus{key, status}]++
+
+  hist, ok := m.latency[key]
+  if !ok {
+    hist = &latencyHistogram{buckets: make([]uint64, len(latencyBuckets))}
+    m.latency[key] = hist
+  }
+  for i, le := range latencyBuckets {
+    if seconds <= le {
+      hist.buckets[i]++
+    }
+  }
+  hist.sum += seconds
+  hist.count++
+}
+
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+  m.WriteTo(w)
+}
+
+// WriteTo пишет метрики в текстовом формате Prometheus, строки отсортированы по меткам
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  out := &bytes.Buffer{}
+
+  statuses := make([]metricsStatus, 0, len(m.requests))
+  for key := range m.requests {
+    statuses = append(statuses, key)
+  }
+  sort.Slice(statuses, func(i, j int) bool {
+    if statuses[i].metricsRoute != statuses[j].metricsRoute {
+      return routeLess(statuses[i].metricsRoute, statuses[j].metricsRoute)
+    }
+    return statuses[i].status < statuses[j].status
+  })
+
+  out.WriteString("# HELP apigen_requests_total Total number of API requests.\n")
+  out.WriteString("# TYPE apigen_requests_total counter\n")
+  for _, key := range statuses {
+    fmt.Fprintf(out, "apigen_requests_total{api=%q,method=%q,status=\"%d\"} %d\n", key.api, key.method, key.status, m.requests[key])
+  }
+
+  out.WriteString("# HELP apigen_request_errors_total Total number of API requests answered with an error status.\n")
+  out.WriteString("# TYPE apigen_request_errors_total counter\n")
+  for _, key := range statuses {
+    if key.status >= 400 {
+      fmt.Fprintf(out, "apigen_request_errors_total{api=%q,method=%q,status=\"%d\"} %d\n", key.api, key.method, key.status, m.requests[key])
+    }
+  }
+
+  routes := make([]metricsRoute, 0, len(m.latency))
+  for key := range m.latency {
+    routes = append(routes, key)
+  }
+  sort.Slice(routes, func(i, j int) bool {
+    return routeLess(routes[i], routes[j])
+  })
+
+  out.WriteString("# HELP apigen_request_duration_seconds API request latency.\n")
+  out.WriteString("# TYPE apigen_request_duration_seconds histogram\n")
+  for _, key := range routes {
+    hist := m.latency[key]
+    for i, le := range latencyBuckets {
+      fmt.Fprintf(out, "apigen_request_duration_seconds_bucket{api=%q,method=%q,le=\"%s\"} %d\n", key.api, key.method, strconv.FormatFloat(le, 'g', -1, 64), hist.buckets[i])
+    }
+    fmt.Fprintf(out, "apigen_request_duration_seconds_bucket{api=%q,method=%q,le=\"+Inf\"} %d\n", key.api, key.method, hist.count)
+    fmt.Fprintf(out, "apigen_request_duration_seconds_sum{api=%q,method=%q} %s\n", key.api, key.method, strconv.FormatFloat(hist.sum, 'g', -1, 64))
+    fmt.Fprintf(out, "apigen_request_duration_seconds_count{api=%q,method=%q} %d\n", key.api, key.method, hist.count)
+  }
+
+  inFlight := make([]metricsRoute, 0, len(m.inFlight))
+  for key := range m.inFlight {
+    inFlight = append(inFlight, key)
+  }
+  sort.Slice(inFlight, func(i, j int) bool {
+    return routeLess(inFlight[i], inFlight[j])
+  })
+
+  out.WriteString("# HELP apigen_requests_in_flight Number of API calls being served by methods with max_inflight.\n")
+  out.WriteString("# TYPE apigen_requests_in_flight gauge\n")
+  for _, key := range inFlight {
+    fmt.Fprintf(out, "apigen_requests_in_flight{api=%q,method=%q} %d\n", key.api, key.method, m.inFlight[key])
+  }
+
+  deprecated := make([]metricsRoute, 0, len(m.deprecated))
+  for key := range m.deprecated {
+    deprecated = append(deprecated, key)
+  }
+  sort.Slice(deprecated, func(i, j int) bool {
+    return routeLess(deprecated[i], deprecated[j])
+  })
+
+  out.WriteString("# HELP apigen_deprecated_requests_total Total number of calls to deprecated API methods.\n")
+  out.WriteString("# TYPE apigen_deprecated_requests_total counter\n")
+  for _, key := range deprecated {
+    fmt.Fprintf(out, "apigen_deprecated_requests_total{api=%q,method=%q} %d\n", key.api, key.method, m.deprecated[key])
+  }
+
+  return out.WriteTo(w)
+}
+
+func routeLess(a, b metricsRoute) bool {
+  if a.api != b.api {
+    return a.api < b.api
+  }
+  return a.method < b.method
+}
+
+// goroutinePanic переносит панику метода API из горутины callWithTimeout
+// в горутину обработчика вместе с исходным стеком
+type goroutinePanic struct {
+  value interface{}
+  stack []byte
+}
+
+type callResult[T any] struct {
+  result T
+  err    error
+  panic  *goroutinePanic
+}
+
+// methodCall следит за горутинами метода из callWithTimeout одного запроса:
+// по дедлайну или отключению клиента обработчик отвечает сразу, а метод продолжает работать
+type methodCall struct {
+  mu      sync.Mutex
+  running int
+  // callWithTimeout вернулась раньше, чем метод завершился
+  early  bool
+  result interface{}
+  err    error
+  after  []func(result interface{}, err error)
+}
+
+type methodCallKey struct{}
+
+// trackMethodCall кладёт methodCall в контекст запроса, если его там ещё нет
+func trackMethodCall(r *http.Request) (*http.Request, *methodCall) {
+  if call, ok := r.Context().Value(methodCallKey{}).(*methodCall); ok {
+    return r, call
+  }
+  call := &methodCall{}
+  return r.WithContext(context.WithValue(r.Context(), methodCallKey{}, call)), call
+}
+
+// afterMethod вызывает f с результатом метода, когда завершатся все его горутины:
+// сразу, если их нет, иначе - из последней завершившейся горутины
+func (c *methodCall) afterMethod(f func(result interface{}, err error)) {
+  c.mu.Lock()
+  if c.running > 0 {
+    c.after = append(c.after, f)
+    c.mu.Unlock()
+    return
+  }
+  result, err := c.result, c.err
+  c.mu.Unlock()
+  f(result, err)
+}
+
+// detached сообщает, что обработчик получил ошибку дедлайна или отмены раньше результата метода,
+// и afterMethod получит настоящий результат
+func (c *methodCall) detached() bool {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.early
+}
+
+// start, detach и finish отмечают горутину метода, nil - запрос без methodCall
+func (c *methodCall) start() {
+  if c == nil {
+    return
+  }
+  c.mu.Lock()
+  c.running++
+  c.mu.Unlock()
+}
+
+func (c *methodCall) detach() {
+  if c == nil {
+    return
+  }
+  c.mu.Lock()
+  c.early = true
+  c.mu.Unlock()
+}
+
+func (c *methodCall) finish(result interface{}, err error) {
+  if c == nil {
+    return
+  }
+  c.mu.Lock()
+  c.running--
+  c.result, c.err = result, err
+  var after []func(interface{}, error)
+  if c.running == 0 {
+    after, c.after = c.after, nil
+  }
+  c.mu.Unlock()
+  for _, f := range after {
+    f(result, err)
+  }
+}
+
+// callWithTimeout вызывает метод API с дедлайном в отдельной горутине,
+// чтобы ответить по его истечении, даже если метод не следит за ctx.
+// О горутине, которая переживёт обработчик, узнаёт methodCall из ctx
+func callWithTimeout[T any](ctx context.Context, timeout time.Duration, call func(context.Context) (T, error)) (T, error) {
+  ctx, cancel := context.WithTimeout(ctx, timeout)
+  defer cancel()
+
+  tracked, _ := ctx.Value(methodCallKey{}).(*methodCall)
+  tracked.start()
+  done := make(chan callResult[T], 1)
+  go func() {
+    res := callResult[T]{}
+    defer func() {
+      if recovered := recover(); recovered != nil {
+        res.panic = &goroutinePanic{recovered, debug.Stack()}
+        res.err = fmt.Errorf("panic: %v", recovered)
+      }
+      tracked.finish(res.result, res.err)
+      done <- res
+    }()
+    res.result, res.err = call(ctx)
+  }()
+
+  select {
+  case res := <-done:
+    if res.panic != nil {
+      panic(*res.panic)
+    }
+    return res.result, res.err
+  case <-ctx.Done():
+    tracked.detach()
+    var zero T
+    return zero, ctx.Err()
+  }
+}
+
+// ErrorEncoder пишет в ответ ошибку routing-а, авторизации, валидации или метода API
+type ErrorEncoder func(w http.ResponseWriter, r *http.Request, status int, err error)
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+  if rec := findStatusRecorder(w); rec != nil {
+    rec.err = err
+  }
+  EncodeError(w, r, status, err)
+}
+
+// findStatusRecorder находит statusRecorder под обёртками ResponseWriter-а с методом Unwrap
+func findStatusRecorder(w http.ResponseWriter) *statusRecorder {
+  for {
+    switch current := w.(type) {
+    case *statusRecorder:
+      return current
+    case interface{ Unwrap() http.ResponseWriter }:
+      w = current.Unwrap()
+    default:
+      return nil
+    }
+  }
+}
+
+// StatusClientClosedRequest - статус запроса, клиент которого отключился,
+// не дождавшись ответа метода (как в nginx)
+const StatusClientClosedRequest = 499
+
+// errorAs сообщает, есть ли в цепочке err ошибка типа T
+func errorAs[T error](err error) bool {
+  var target T
+  return errors.As(err, &target)
+}
+
+// LegacyErrorEncoder пишет ошибку в виде {"error": "..."},
+// ошибки валидации всех параметров - в виде {"error": "validation failed", "fields": [...]}
+func LegacyErrorEncoder(w http.ResponseWriter, r *http.Request, status int, err error) {
+  // ошибка пишется в формате из Accept, если он известен, иначе в JSON
+  encoder, ok := negotiate(r, DefaultProduces)
+  if !ok {
+    encoder = JSONEncoder{}
+  }
+  var errs ValidationErrors
+  if errors.As(err, &errs) {
+    writeErrorResponse(w, encoder, Response{"error": "validation failed", "fields": errs}, status)
+    return
+  }
+  response := Response{"error": err.Error()}
+  code, details := apiErrorExtras(err)
+  if code != "" {
+    response["code"] = code
+  }
+  if details != nil {
+    response["details"] = details
+  }
+  writeErrorResponse(w, encoder, response, status)
+}
+
+// ProblemErrorEncoder пишет ошибку в формате application/problem+json (RFC 7807)
+func ProblemErrorEncoder(w http.ResponseWriter, r *http.Request, status int, err error) {
+  problem := Response{
+    "type":     "about:blank",
+    "title":    http.StatusText(status),
+    "status":   status,
+    "detail":   err.Error(),
+    "instance": r.URL.Path,
+  }
+  var errs ValidationErrors
+  if errors.As(err, &errs) {
+    problem["detail"] = "validation failed"
+    problem["fields"] = errs
+  }
+  code, details := apiErrorExtras(err)
+  if code != "" {
+    problem["code"] = code
+  }
+  if details != nil {
+    problem["details"] = details
+  }
+  w.Header().Set("Content-Type", "application/problem+json")
+  writeJsonResponse(w, problem, status)
+}
+
+// FieldError - ошибка валидации одного параметра запроса
+type FieldError struct {
+  Param   string `json:"param"`
+  Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+  return e.Param + " " + e.Message
+}
+
+// ValidationErrors - ошибки валидации по всем невалидным параметрам
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+  msgs := make([]string, 0, len(e))
+  for _, fe := range e {
+    msgs = append(msgs, fe.Error())
+  }
+  return strings.Join(msgs, "; ")
+}
+
+func (e ValidationErrors) has(param string) bool {
+  for _, fe := range e {
+    if fe.Param == param {
+      return true
+    }
+  }
+  return false
+}
+
+type requestParams interface {
+  bind(r *http.Request, all bool) error
+  validate(all bool) error
+}
+
+// bindAndValidateAll собирает ошибки заполнения и валидации по всем параметрам,
+// параметр, который не удалось разобрать, повторно не валидируется
+func bindAndValidateAll(p requestParams, r *http.Request) error {
+  errs := ValidationErrors{}
+  if err := p.bind(r, true); err != nil {
+    errs = append(errs, err.(ValidationErrors)...)
+  }
+  if err := p.validate(true); err != nil {
+    for _, fe := range err.(ValidationErrors) {
+      if !errs.has(fe.Param) {
+        errs = append(errs, fe)
+      }
+    }
+  }
+  if len(errs) > 0 {
+    return errs
+  }
+  return nil
+}
+
+// EncodeError используется всеми сгенерированными обработчиками,
+// по умолчанию задаётся флагом кодогенератора -error-encoder
+var EncodeError ErrorEncoder = LegacyErrorEncoder
+
+// apiErrorExtras достаёт из ApiError в цепочке err машиночитаемый код и подробности
+func apiErrorExtras(err error) (code string, details interface{}) {
+  var apiErr ApiError
+  if !errors.As(err, &apiErr) {
+    return "", nil
+  }
+  code = apiErr.Code
+  details = apiErr.Details
+  return code, details
+}
+
+// BindRequest заполняет ProfileParams из параметров запроса
+func (p *ProfileParams) BindRequest(r *http.Request) error {
+    return p.bind(r, false)
+}
+
+func (p *ProfileParams) bind(r *http.Request, all bool) error {
+    var errs ValidationErrors
+	
+    
+    p.Login = requestValue(r, "login")
+    
+    
+	
+    p.setDefaults()
+    if len(errs) > 0 {
+      return errs
+    }
+    return nil
+}
+
+// setDefaults подставляет значения по умолчанию из тегов в незаполненные поля
+func (p *ProfileParams) setDefaults() {
+	
+}
+
+// Check - единая точка проверки ProfileParams и вне HTTP: подставляет значения по умолчанию,
+// проверяет теги apivalidator и вызывает пользовательский Validate
+func (p *ProfileParams) Check(ctx context.Context) error {
+    p.setDefaults()
+    if err := p.validate(false); err != nil {
+      return err
+    }
+    return p.Validate()
+}
+
+// ValidateTags проверяет ProfileParams по правилам из тегов apivalidator
+// и возвращает первую найденную ошибку
+func (p *ProfileParams) ValidateTags() error {
+    return p.validate(false)
+}
+
+// ValidateAll проверяет ProfileParams по правилам из тегов apivalidator
+// и возвращает ValidationErrors со всеми невалидными параметрами
+func (p *ProfileParams) ValidateAll() error {
+    return p.validate(true)
+}
+
+// проверки сгенерированы как прямые сравнения полей, а тексты ошибок
+// посчитаны при генерации, поэтому валидный запрос проходит без аллокаций
+func (p *ProfileParams) validate(all bool) error {
+    var errs ValidationErrors
+	
+	
+	if p.Login == "" {
+      if !all {
+        return FieldError{ "login", "must me not empty" }
+      }
+      errs = append(errs, FieldError{ "login", "must me not empty" })
+    }
+	
+	
+    if len(errs) > 0 {
+      return errs
+    }
+    return nil
+}
+
+// BindRequest заполняет CreateParams из параметров запроса
+func (p *CreateParams) BindRequest(r *http.Request) error {
+    return p.bind(r, false)
+}
+
+func (p *CreateParams) bind(r *http.Request, all bool) error {
+    var errs ValidationErrors
+	
+    
+    p.Login = requestValue(r, "login")
+    
+    
+	
+    
+    p.Name = requestValue(r, "full_name")
+    
+    
+	
+    
+    p.Status = requestValue(r, "status")
+    
+    
+	
+    
+    
+    if num, err := strconv.Atoi(requestValue(r, "age")); err != nil {
+      if !all {
+        return FieldError{"age", "must be int"}
+      }
+      errs = append(errs, FieldError{"age", "must be int"})
+    } else {
+      p.Age = num
+    }
+    
+	
+    p.setDefaults()
+    if len(errs) > 0 {
+      return errs
+    }
+    return nil
+}
+
+// setDefaults подставляет значения по умолчанию из тегов в незаполненные поля
+func (p *CreateParams) setDefaults() {
+	
+    if p.Status == "" {
+      p.Status = "user"
+    }
+}
+
+// Check - единая точка проверки CreateParams и вне HTTP: подставляет значения по умолчанию,
+// проверяет теги apivalidator
+func (p *CreateParams) Check(ctx context.Context) error {
+    p.setDefaults()
+    if err := p.validate(false); err != nil {
+      return err
+    }
+    return nil
+}
+
+// Validate проверяет CreateParams по правилам из тегов apivalidator
+// и возвращает первую найденную ошибку
+func (p *CreateParams) Validate() error {
+    return p.validate(false)
+}
+
+// ValidateAll проверяет CreateParams по правилам из тегов apivalidator
+// и возвращает ValidationErrors со всеми невалидными параметрами
+func (p *CreateParams) ValidateAll() error {
+    return p.validate(true)
+}
+
+// проверки сгенерированы как прямые сравнения полей, а тексты ошибок
+// посчитаны при генерации, поэтому валидный запрос проходит без аллокаций
+func (p *CreateParams) validate(all bool) error {
+    var errs ValidationErrors
+	
+	
+	if p.Login == "" {
+      if !all {
+        return FieldError{ "login", "must me not empty" }
+      }
+      errs = append(errs, FieldError{ "login", "must me not empty" })
+    } else if len(p.Login) < 10 {
+      if !all {
+        return FieldError{ "login", "len must be >= 10" }
+      }
+      errs = append(errs, FieldError{ "login", "len must be >= 10" })
+    }
+	
+	switch p.Status {
+    case "user", "moderator", "admin":
+    default:
+      if !all {
+        return FieldError{ "status", "must be one of [user, moderator, admin]" }
+      }
+      errs = append(errs, FieldError{ "status", "must be one of [user, moderator, admin]" })
+    }
+	
+	if p.Age < 0 {
+      if !all {
+        return FieldError{ "age", "must be >= 0" }
+      }
+      errs = append(errs, FieldError{ "age", "must be >= 0" })
+    } else if p.Age > 128 {
+      if !all {
+        return FieldError{ "age", "must be <= 128" }
+      }
+      errs = append(errs, FieldError{ "age", "must be <= 128" })
+    }
+	
+	
+    if len(errs) > 0 {
+      return errs
+    }
+    return nil
+}
+
+// BindRequest заполняет CreateV2Params из параметров запроса
+func (p *CreateV2Params) BindRequest(r *http.Request) error {
+    return p.bind(r, false)
+}
+
+func (p *CreateV2Params) bind(r *http.Request, all bool) error {
+    var errs ValidationErrors
+	
+    
+    p.Login = requestValue(r, "login")
+    
+    
+	
+    
+    p.Name = requestValue(r, "full_name")
+    
+    
+	
+    
+    p.Role = requestValue(r, "role")
+    
+    
+	
+    
+    
+    if num, err := strconv.Atoi(requestValue(r, "age")); err != nil {
+      if !all {
+        return FieldError{"age", "must be int"}
+      }
+      errs = append(errs, FieldError{"age", "must be int"})
+    } else {
+      p.Age = num
+    }
+    
+	
+    p.setDefaults()
+    if len(errs) > 0 {
+      return errs
+    }
+    return nil
+}
+
+// setDefaults подставляет значения по умолчанию из тегов в незаполненные поля
+func (p *CreateV2Params) setDefaults() {
+	
+    if p.Role == "" {
+      p.Role = "user"
+    }
+}
+
+// Check - единая точка проверки CreateV2Params и вне HTTP: подставляет значения по умолчанию,
+// проверяет теги apivalidator
+func (p *CreateV2Params) Check(ctx context.Context) error {
+    p.setDefaults()
+    if err := p.validate(false); err != nil {
+      return err
+    }
+    return nil
+}
+
+// Validate проверяет CreateV2Params по правилам из тегов apivalidator
+// и возвращает первую найденную ошибку
+func (p *CreateV2Params) Validate() error {
+    return p.validate(false)
+}
+
+// ValidateAll проверяет CreateV2Params по правилам из тегов apivalidator
+// и возвращает ValidationErrors со всеми невалидными параметрами
+func (p *CreateV2Params) ValidateAll() error {
+    return p.validate(true)
+}
+
+// проверки сгенерированы как прямые сравнения полей, а тексты ошибок
+// посчитаны при генерации, поэтому валидный запрос проходит без аллокаций
+func (p *CreateV2Params) validate(all bool) error {
+    var errs ValidationErrors
+	
+	
+	if p.Login == "" {
+      if !all {
+        return FieldError{ "login", "must me not empty" }
+      }
+      errs = append(errs, FieldError{ "login", "must me not empty" })
+    } else if len(p.Login) < 10 {
+      if !all {
+        return FieldError{ "login", "len must be >= 10" }
+      }
+      errs = append(errs, FieldError{ "login", "len must be >= 10" })
+    }
+	
+	switch p.Role {
+    case "user", "moderator", "admin":
+    default:
+      if !all {
+        return FieldError{ "role", "must be one of [user, moderator, admin]" }
+      }
+      errs = append(errs, FieldError{ "role", "must be one of [user, moderator, admin]" })
+    }
+	
+	if p.Age < 0 {
+      if !all {
+        return FieldError{ "age", "must be >= 0" }
+      }
+      errs = append(errs, FieldError{ "age", "must be >= 0" })
+    } else if p.Age > 128 {
+      if !all {
+        return FieldError{ "age", "must be <= 128" }
+      }
+      errs = append(errs, FieldError{ "age", "must be <= 128" })
+    }
+	
+	
+    if len(errs) > 0 {
+      return errs
+    }
+    return nil
+}
+
+// BindRequest заполняет OtherCreateParams из параметров запроса
+func (p *OtherCreateParams) BindRequest(r *http.Request) error {
+    return p.bind(r, false)
+}
+
+func (p *OtherCreateParams) bind(r *http.Request, all bool) error {
+    var errs ValidationErrors
+	
+    
+    p.Username = requestValue(r, "username")
+    
+    
+	
+    
+    p.Name = requestValue(r, "account_name")
+    
+    
+	
+    
+    p.Class = requestValue(r, "class")
+    
+    
+	
+    
+    
+    if num, err := strconv.Atoi(requestValue(r, "level")); err != nil {
+      if !all {
+        return FieldError{"level", "must be int"}
+      }
+      errs = append(errs, FieldError{"level", "must be int"})
+    } else {
+      p.Level = num
+    }
+    
+	
+    p.setDefaults()
+    if len(errs) > 0 {
+      return errs
+    }
+    return nil
+}
+
+// setDefaults подставляет значения по умолчанию из тегов в незаполненные поля
+func (p *OtherCreateParams) setDefaults() {
+	
+    if p.Class == "" {
+      p.Class = "warrior"
+    }
+}
+
+// Check - единая точка проверки OtherCreateParams и вне HTTP: подставляет значения по умолчанию,
+// проверяет теги apivalidator и вызывает пользовательский Validate
+func (p *OtherCreateParams) Check(ctx context.Context) error {
+    p.setDefaults()
+    if err := p.validate(false); err != nil {
+      return err
+    }
+    return p.Validate(ctx)
+}
+
+// ValidateTags проверяет OtherCreateParams по правилам из тегов apivalidator
+// и возвращает первую найденную ошибку
+func (p *OtherCreateParams) ValidateTags() error {
+    return p.validate(false)
+}
+
+// ValidateAll проверяет OtherCreateParams по правилам из тегов apivalidator
+// и возвращает ValidationErrors со всеми невалидными параметрами
+func (p *OtherCreateParams) ValidateAll() error {
+    return p.validate(true)
+}
+
+// проверки сгенерированы как прямые сравнения полей, а тексты ошибок
+// посчитаны при генерации, поэтому валидный запрос проходит без аллокаций
+func (p *OtherCreateParams) validate(all bool) error {
+    var errs ValidationErrors
+	
+	
+	if p.Username == "" {
+      if !all {
+        return FieldError{ "username", "must me not empty" }
+      }
+      errs = append(errs, FieldError{ "username", "must me not empty" })
+    } else if len(p.Username) < 3 {
+      if !all {
+        return FieldError{ "username", "len must be >= 3" }
+      }
+      errs = append(errs, FieldError{ "username", "len must be >= 3" })
+    }
+	
+	switch p.Class {
+    case "warrior", "sorcerer", "rouge":
+    default:
+      if !all {
+        return FieldError{ "class", "must be one of [warrior, sorcerer, rouge]" }
+      }
+      errs = append(errs, FieldError{ "class", "must be one of [warrior, sorcerer, rouge]" })
+    }
+	
+	if p.Level < 1 {
+      if !all {
+        return FieldError{ "level", "must be >= 1" }
+      }
+      errs = append(errs, FieldError{ "level", "must be >= 1" })
+    } else if p.Level > 50 {
+      if !all {
+        return FieldError{ "level", "must be <= 50" }
+      }
+      errs = append(errs, FieldError{ "level", "must be <= 50" })
+    }
+	
+	
+    if len(errs) > 0 {
+      return errs
+    }
+    return nil
+}
+
+
+
+var corsMyApiProfile = &CORSConfig{
+	Origins:     []string{"*"},
+	Methods:     []string(nil),
+	Headers:     []string(nil),
+	Credentials: false,
+	MaxAge:      0,
+}
+
+
+// responseMyApiProfile - ответ MyApi.Profile без промежуточного map
+type responseMyApiProfile struct {
+	Error    string `json:"error"`
+	Response *User `json:"response"`
+}
+
+var routeMyApiProfile = RouteInfo{
+	Api:        "MyApi",
+	URL:        "/user/profile",
+	HTTPMethod: "",
+	MethodName: "Profile",
+	Auth:       false,
+	Version:    "",
+	
+}
+
+
+var corsMyApiCreate = &CORSConfig{
+	Origins:     []string{"https://app.example.com"},
+	Methods:     []string(nil),
+	Headers:     []string{"X-Auth", "Content-Type"},
+	Credentials: true,
+	MaxAge:      600,
+}
+
+
+// responseMyApiCreate - ответ MyApi.Create без промежуточного map
+type responseMyApiCreate struct {
+	Error    string `json:"error"`
+	Response *NewUser `json:"response"`
+}
+
+var routeMyApiCreate = RouteInfo{
+	Api:        "MyApi",
+	URL:        "/user/create",
+	HTTPMethod: "POST",
+	MethodName: "Create",
+	Auth:       true,
+	Version:    "",
+	
+	Deprecated:  true,
+	Deprecation: "@1767225600",
+	Sunset:      "Fri, 01 Jan 2027 00:00:00 GMT",
+	Successor:   "/v2/user/create",
+	
+}
+
+
+var corsMyApiCreateV2 = &CORSConfig{
+	Origins:     []string{"https://app.example.com"},
+	Methods:     []string(nil),
+	Headers:     []string{"X-Auth", "Content-Type"},
+	Credentials: true,
+	MaxAge:      600,
+}
+
+
+// responseMyApiCreateV2 - ответ MyApi.CreateV2 без промежуточного map
+type responseMyApiCreateV2 struct {
+	Error    string `json:"error"`
+	Response *NewUser `json:"response"`
+}
+
+var routeMyApiCreateV2 = RouteInfo{
+	Api:        "MyApi",
+	URL:        "/v2/user/create",
+	HTTPMethod: "POST",
+	MethodName: "CreateV2",
+	Auth:       true,
+	Version:    "v2",
+	
+}
+
+
+var corsMyApiUser = &CORSConfig{
+	Origins:     []string{"https://app.example.com"},
+	Methods:     []string(nil),
+	Headers:     []string{"X-Auth", "Content-Type"},
+	Credentials: true,
+	MaxAge:      600,
+}
+
+
+// responseMyApiUser - ответ MyApi.User без промежуточного map
+type responseMyApiUser struct {
+	Error    string `json:"error"`
+	Response *User `json:"response"`
+}
+
+var routeMyApiUser = RouteInfo{
+	Api:        "MyApi",
+	URL:        "/users/{login}",
+	HTTPMethod: "GET",
+	MethodName: "User",
+	Auth:       false,
+	Version:    "",
+	
+}
+
+
+// MyApiHandler - MyApi с цепочкой перехватчиков вокруг методов API
+type MyApiHandler struct {
+	api          *MyApi
+	interceptors []Interceptor
+}
+
+// NewMyApiHandler оборачивает api, перехватчики вызываются в порядке передачи
+func NewMyApiHandler(api *MyApi, interceptors ...Interceptor) *MyApiHandler {
+	return &MyApiHandler{api, interceptors}
+}
+
+func (h *MyApiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.api.serveHTTP(w, r, h.interceptors)
+}
+
+// Routes возвращает маршруты MyApi, чтобы смонтировать его в Mux
+func (h *MyApiHandler) Routes() []RouteInfo {
+	return h.api.Routes()
+}
+
+// Routes возвращает маршруты MyApi в порядке объявления методов
+func (h *MyApi) Routes() []RouteInfo {
+	return []RouteInfo{ 
+		routeMyApiProfile,
+		routeMyApiCreate,
+		routeMyApiCreateV2,
+		routeMyApiUser,
+	}
+}
+
+func (h *MyApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.serveHTTP(w, r, nil)
+}
+
+var routeMyApiUnknown = RouteInfo{Api: "MyApi", MethodName: "unknown"}
+
+func (h *MyApi) serveHTTP(w http.ResponseWriter, r *http.Request, interceptors []Interceptor) {
+    rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+    w = rec
+    route := routeMyApiUnknown
+    start := time.Now()
+    r = withRequestID(w, r)
+    r, span := startSpan(r)
+    defer func() {
+      latency := time.Since(start)
+      finishSpan(span, route, rec)
+      if Metrics != nil {
+        Metrics.ObserveRequest(route, rec.status, latency)
+      }
+      logAccess(r, route, rec, latency)
+    }()
+    defer recoverPanic(w, r)
+
+    path := r.URL.Path
+    if !strings.HasPrefix(path, "/") {
+      // http.StripPrefix("/v2/", ...) оставляет путь без ведущего "/"
+      path = "/" + path
+    }
+    match := matchMyApi(path)
+    
+    
+
+    switch match {
+
+    case 0:
+		route = routeMyApiProfile
+		
+		
+		
+		if handleCORS(w, r, route, corsMyApiProfile) {
+			return
+		}
+		
+		
+		
+		
+		
+        h.handlerProfile(w, r, interceptors)
+
+    case 1:
+		route = routeMyApiCreate
+		
+		markDeprecated(w, route)
+		
+		
+		
+		if handleCORS(w, r, route, corsMyApiCreate) {
+			return
+		}
+		
+		
+		token := r.Header.Get("X-Auth")
+		if token != "100500" {
+			writeError(w, r, http.StatusForbidden, errors.New("unauthorized"))
+			return
+		}
+		
+		
+		if r.Method != "POST" {
+			writeError(w, r, http.StatusNotAcceptable, errors.New("bad method"))
+			return
+		}
+		
+		
+		
+        h.handlerCreate(w, r, interceptors)
+
+    case 2:
+		route = routeMyApiCreateV2
+		
+		
+		
+		if handleCORS(w, r, route, corsMyApiCreateV2) {
+			return
+		}
+		
+		
+		token := r.Header.Get("X-Auth")
+		if token != "100500" {
+			writeError(w, r, http.StatusForbidden, errors.New("unauthorized"))
+			return
+		}
+		
+		
+		if r.Method != "POST" {
+			writeError(w, r, http.StatusNotAcceptable, errors.New("bad method"))
+			return
+		}
+		
+		
+		
+        h.handlerCreateV2(w, r, interceptors)
+
+    case 3:
+		route = routeMyApiUser
+		
+		
+		r.SetPathValue("login", pathSegment(path, 1))
+		
+		
+		if handleCORS(w, r, route, corsMyApiUser) {
+			return
+		}
+		
+		
+		
+		if r.Method != "GET" {
+			writeError(w, r, http.StatusNotAcceptable, errors.New("bad method"))
+			return
+		}
+		
+		
+		
+        h.handlerUser(w, r, interceptors)
+
+    default:
+        // 404
+		writeError(w, r, http.StatusNotFound, errors.New("unknown method"))
+    }
+}
+
+// matchMyApi находит индекс маршрута для пути запроса, -1 - маршрут не найден
+func matchMyApi(p0 string) int {
+	if p0 != "" {
+		s0, p1 := nextSegment(p0)
+		switch s0 {
+		case "user":
+			if p1 != "" {
+				s1, p2 := nextSegment(p1)
+				switch s1 {
+				case "create":
+					if p2 == "" {
+						return 1
+					}
+				case "profile":
+					if p2 == "" {
+						return 0
+					}
+				}
+			}
+		case "users":
+			if p1 != "" {
+				s1, p2 := nextSegment(p1)
+				if s1 != "" {
+					if p2 == "" {
+						return 3
+					}
+				}
+			}
+		case "v2":
+			if p1 != "" {
+				s1, p2 := nextSegment(p1)
+				switch s1 {
+				case "user":
+					if p2 != "" {
+						s2, p3 := nextSegment(p2)
+						switch s2 {
+						case "create":
+							if p3 == "" {
+								return 2
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return -1
+}
+
+
+
+func (h *MyApi) handlerProfile(w http.ResponseWriter, r *http.Request, interceptors []Interceptor) {
+	
+	ctx := r.Context()
+
+	
+	if compressed := newCompressWriter(w, r); compressed != nil {
+		w = compressed
+		defer compressed.Close()
+	}
+	
+
+	encoder, ok := negotiate(r, DefaultProduces)
+	if !ok {
+		writeError(w, r, http.StatusNotAcceptable, errors.New("not acceptable"))
+		return
+	}
+
+	
+	
+	if !limitBody(w, r, 10485760) {
+		return
+	}
+	
+	
+	// заполнение структуры params
+	params := ProfileParams{}
+	
+	if err := params.BindRequest(r); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// валидирование параметров по тегам и пользовательским Validate,
+	// ApiError из Validate сохраняет свой статус
+	if err := params.Check(ctx); err != nil {
+		status := http.StatusBadRequest
+		var apiErr ApiError
+		if errors.As(err, &apiErr) {
+			status = apiErr.HTTPStatus
+		}
+		writeError(w, r, status, err)
+		return
+	}
+	
+
+	
+
+	
+
+	result, err := intercept(ctx, routeMyApiProfile, &params, interceptors, func(ctx context.Context) (interface{}, error) {
+		
+		return h.Profile(ctx, params)
+		
+	})
+
+	// respond пишет ответ по результату метода
+	respond := func(w http.ResponseWriter, result interface{}, err error) {
+		status := http.StatusOK
+		if err != nil {
+			var apiErr ApiError
+			switch {
+			case errors.As(err, &apiErr):
+				status = apiErr.HTTPStatus
+			
+			case errors.Is(err, context.Canceled) && ctx.Err() != nil:
+				// клиент закрыл соединение, это не ошибка сервера
+				status = StatusClientClosedRequest
+			
+			case errors.Is(err, ErrUserBanned):
+				status = 403
+			
+			default:
+	            status = http.StatusInternalServerError
+			} 
+
+			writeError(w, r, status, err)
+			return 
+		}
+
+		// перехватчик мог подменить результат, тогда пишем его через Response
+		var response interface{} = Response{"error": "", "response": result}
+		if typed, ok := result.(*User); ok {
+			response = &responseMyApiProfile{Response: typed}
+		}
+		
+		if err := writeCachedResponse(w, r, encoder, response, result, status, "max-age=60", true); err != nil {
+		
+			WriteErrorHook(fmt.Errorf("encode response: %w", err))
+			writeError(w, r, http.StatusInternalServerError, errors.New("internal server error"))
+		}
+	}
+
+	
+	respond(w, result, err)
+}
+
+func (h *MyApi) handlerCreate(w http.ResponseWriter, r *http.Request, interceptors []Interceptor) {
+	
+	var call *methodCall
+	r, call = trackMethodCall(r)
+	
+	ctx := r.Context()
+
+	
+
+	encoder, ok := negotiate(r, DefaultProduces)
+	if !ok {
+		writeError(w, r, http.StatusNotAcceptable, errors.New("not acceptable"))
+		return
+	}
+
+	
+	if !checkContentType(w, r, []string{"application/x-www-form-urlencoded"}) {
+		return
+	}
+	
+	
+	if !limitBody(w, r, 4096) {
+		return
+	}
+	
+	
+	// заполнение структуры params
+	params := CreateParams{}
+	
+	if err := params.BindRequest(r); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// валидирование параметров по тегам и пользовательским Validate,
+	// ApiError из Validate сохраняет свой статус
+	if err := params.Check(ctx); err != nil {
+		status := http.StatusBadRequest
+		var apiErr ApiError
+		if errors.As(err, &apiErr) {
+			status = apiErr.HTTPStatus
+		}
+		writeError(w, r, status, err)
+		return
+	}
+	
+
+	
+
+	
+	var idempotent *idempotencyRecorder
+	if key := r.Header.Get(IdempotencyKeyHeader); key != "" {
+		var done bool
+		idempotent, done = beginIdempotent(w, r, routeMyApiCreate, key)
+		if done {
+			return
+		}
+		w = idempotent
+		defer idempotent.finish()
+	}
+	
+
+	result, err := intercept(ctx, routeMyApiCreate, &params, interceptors, func(ctx context.Context) (interface{}, error) {
+		
+		return callWithTimeout(ctx, 100000000, func(ctx context.Context) (*NewUser, error) {
+			return h.Create(ctx, params)
+		})
+		
+	})
+
+	// respond пишет ответ по результату метода
+	respond := func(w http.ResponseWriter, result interface{}, err error) {
+		status := http.StatusOK
+		if err != nil {
+			var apiErr ApiError
+			switch {
+			case errors.As(err, &apiErr):
+				status = apiErr.HTTPStatus
+			
+			case errors.Is(err, context.DeadlineExceeded):
+				status = 504
+			
+			case errors.Is(err, context.Canceled) && ctx.Err() != nil:
+				// клиент закрыл соединение, это не ошибка сервера
+				status = StatusClientClosedRequest
+			
+			default:
+	            status = http.StatusInternalServerError
+			} 
+
+			writeError(w, r, status, err)
+			return 
+		}
+
+		// перехватчик мог подменить результат, тогда пишем его через Response
+		var response interface{} = Response{"error": "", "response": result}
+		if typed, ok := result.(*NewUser); ok {
+			response = &responseMyApiCreate{Response: typed}
+		}
+		
+		if err := writeResponse(w, encoder, response, status); err != nil {
+		
+			WriteErrorHook(fmt.Errorf("encode response: %w", err))
+			writeError(w, r, http.StatusInternalServerError, errors.New("internal server error"))
+		}
+	}
+
+	
+	if idempotent != nil && call.detached() {
+		// метод ещё работает после дедлайна или отключения клиента: ключ остаётся занятым,
+		// чтобы повтор не запустил метод второй раз, а когда метод завершится - по ключу сохранится его ответ
+		late := idempotent.detach()
+		call.afterMethod(func(result interface{}, err error) {
+			respond(late, result, err)
+			late.finish()
+		})
+	}
+	
+	respond(w, result, err)
+}
+
+func (h *MyApi) handlerCreateV2(w http.ResponseWriter, r *http.Request, interceptors []Interceptor) {
+	
+	ctx := r.Context()
+
+	
+
+	encoder, ok := negotiate(r, DefaultProduces)
+	if !ok {
+		writeError(w, r, http.StatusNotAcceptable, errors.New("not acceptable"))
+		return
+	}
+
+	
+	
+	if !limitBody(w, r, 4096) {
+		return
+	}
+	
+	
+	// заполнение структуры params
+	params := CreateV2Params{}
+	
+	if err := params.BindRequest(r); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// валидирование параметров по тегам и пользовательским Validate,
+	// ApiError из Validate сохраняет свой статус
+	if err := params.Check(ctx); err != nil {
+		status := http.StatusBadRequest
+		var apiErr ApiError
+		if errors.As(err, &apiErr) {
+			status = apiErr.HTTPStatus
+		}
+		writeError(w, r, status, err)
+		return
+	}
+	
+
+	
+
+	
+
+	result, err := intercept(ctx, routeMyApiCreateV2, &params, interceptors, func(ctx context.Context) (interface{}, error) {
+		
+		return h.CreateV2(ctx, params)
+		
+	})
+
+	// respond пишет ответ по результату метода
+	respond := func(w http.ResponseWriter, result interface{}, err error) {
+		status := http.StatusOK
+		if err != nil {
+			var apiErr ApiError
+			switch {
+			case errors.As(err, &apiErr):
+				status = apiErr.HTTPStatus
+			
+			case errors.Is(err, context.Canceled) && ctx.Err() != nil:
+				// клиент закрыл соединение, это не ошибка сервера
+				status = StatusClientClosedRequest
+			
+			default:
+	            status = http.StatusInternalServerError
+			} 
+
+			writeError(w, r, status, err)
+			return 
+		}
+
+		// перехватчик мог подменить результат, тогда пишем его через Response
+		var response interface{} = Response{"error": "", "response": result}
+		if typed, ok := result.(*NewUser); ok {
+			response = &responseMyApiCreateV2{Response: typed}
+		}
+		
+		if err := writeResponse(w, encoder, response, status); err != nil {
+		
+			WriteErrorHook(fmt.Errorf("encode response: %w", err))
+			writeError(w, r, http.StatusInternalServerError, errors.New("internal server error"))
+		}
+	}
+
+	
+	respond(w, result, err)
+}
+
+func (h *MyApi) handlerUser(w http.ResponseWriter, r *http.Request, interceptors []Interceptor) {
+	
+	ctx := r.Context()
+
+	
+
+	encoder, ok := negotiate(r, DefaultProduces)
+	if !ok {
+		writeError(w, r, http.StatusNotAcceptable, errors.New("not acceptable"))
+		return
+	}
+
+	
+	
+	if !limitBody(w, r, 10485760) {
+		return
+	}
+	
+	
+	// заполнение структуры params
+	params := ProfileParams{}
+	
+	if err := params.BindRequest(r); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// валидирование параметров по тегам и пользовательским Validate,
+	// ApiError из Validate сохраняет свой статус
+	if err := params.Check(ctx); err != nil {
+		status := http.StatusBadRequest
+		var apiErr ApiError
+		if errors.As(err, &apiErr) {
+			status = apiErr.HTTPStatus
+		}
+		writeError(w, r, status, err)
+		return
+	}
+	
+
+	
+
+	
+
+	result, err := intercept(ctx, routeMyApiUser, &params, interceptors, func(ctx context.Context) (interface{}, error) {
+		
+		return h.User(ctx, params)
+		
+	})
+
+	// respond пишет ответ по результату метода
+	respond := func(w http.ResponseWriter, result interface{}, err error) {
+		status := http.StatusOK
+		if err != nil {
+			var apiErr ApiError
+			switch {
+			case errors.As(err, &apiErr):
+				status = apiErr.HTTPStatus
+			
+			case errors.Is(err, context.Canceled) && ctx.Err() != nil:
+				// клиент закрыл соединение, это не ошибка сервера
+				status = StatusClientClosedRequest
+			
+			default:
+	            status = http.StatusInternalServerError
+			} 
+
+			writeError(w, r, status, err)
+			return 
+		}
+
+		// перехватчик мог подменить результат, тогда пишем его через Response
+		var response interface{} = Response{"error": "", "response": result}
+		if typed, ok := result.(*User); ok {
+			response = &responseMyApiUser{Response: typed}
+		}
+		
+		if err := writeResponse(w, encoder, response, status); err != nil {
+		
+			WriteErrorHook(fmt.Errorf("encode response: %w", err))
+			writeError(w, r, http.StatusInternalServerError, errors.New("internal server error"))
+		}
+	}
+
+	
+	respond(w, result, err)
+}
+
+
+
+
+// responseOtherApiCreate - ответ OtherApi.Create без промежуточного map
+type responseOtherApiCreate struct {
+	Error    string `json:"error"`
+	Response *OtherUser `json:"response"`
+}
+
+var routeOtherApiCreate = RouteInfo{
+	Api:        "OtherApi",
+	URL:        "/user/create",
+	HTTPMethod: "POST",
+	MethodName: "Create",
+	Auth:       true,
+	Version:    "",
+	
+}
+
+
+
+// bulkheadOtherApiCheck ограничивает число одновременных вызовов OtherApi.Check.
+// Он один на процесс: все экземпляры OtherApi и все их монтирования в Mux
+// делят max_inflight, как и ресурс, который за ним стоит
+var bulkheadOtherApiCheck = make(chan struct{}, 4)
+
+// responseOtherApiCheck - ответ OtherApi.Check без промежуточного map
+type responseOtherApiCheck struct {
+	Error    string `json:"error"`
+	Response *OtherUser `json:"response"`
+}
+
+var routeOtherApiCheck = RouteInfo{
+	Api:        "OtherApi",
+	URL:        "/user/check",
+	HTTPMethod: "POST",
+	MethodName: "Check",
+	Auth:       true,
+	Version:    "",
+	
+}
+
+
+// OtherApiHandler - OtherApi с цепочкой перехватчиков вокруг методов API
+type OtherApiHandler struct {
+	api          *OtherApi
+	interceptors []Interceptor
+}
+
+// NewOtherApiHandler оборачивает api, перехватчики вызываются в порядке передачи
+func NewOtherApiHandler(api *OtherApi, interceptors ...Interceptor) *OtherApiHandler {
+	return &OtherApiHandler{api, interceptors}
+}
+
+func (h *OtherApiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.api.serveHTTP(w, r, h.interceptors)
+}
+
+// Routes возвращает маршруты OtherApi, чтобы смонтировать его в Mux
+func (h *OtherApiHandler) Routes() []RouteInfo {
+	return h.api.Routes()
+}
+
+// Routes возвращает маршруты OtherApi в порядке объявления методов
+func (h *OtherApi) Routes() []RouteInfo {
+	return []RouteInfo{ 
+		routeOtherApiCreate,
+		routeOtherApiCheck,
+	}
+}
+
+func (h *OtherApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.serveHTTP(w, r, nil)
+}
+
+var routeOtherApiUnknown = RouteInfo{Api: "OtherApi", MethodName: "unknown"}
+
+func (h *OtherApi) serveHTTP(w http.ResponseWriter, r *http.Request, interceptors []Interceptor) {
+    rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+    w = rec
+    route := routeOtherApiUnknown
+    start := time.Now()
+    r = withRequestID(w, r)
+    r, span := startSpan(r)
+    defer func() {
+      latency := time.Since(start)
+      finishSpan(span, route, rec)
+      if Metrics != nil {
+        Metrics.ObserveRequest(route, rec.status, latency)
+      }
+      logAccess(r, route, rec, latency)
+    }()
+    defer recoverPanic(w, r)
+
+    path := r.URL.Path
+    if !strings.HasPrefix(path, "/") {
+      // http.StripPrefix("/v2/", ...) оставляет путь без ведущего "/"
+      path = "/" + path
+    }
+    match := matchOtherApi(path)
+    
+    
+
+    switch match {
+
+    case 0:
+		route = routeOtherApiCreate
+		
+		
+		
+		
+		token := r.Header.Get("X-Auth")
+		if token != "100500" {
+			writeError(w, r, http.StatusForbidden, errors.New("unauthorized"))
+			return
+		}
+		
+		
+		if r.Method != "POST" {
+			writeError(w, r, http.StatusNotAcceptable, errors.New("bad method"))
+			return
+		}
+		
+		
+		if !allowRequest(w, r, route, 10, 20, "header:X-Client") {
+			return
+		}
+		
+		
+        h.handlerCreate(w, r, interceptors)
+
+    case 1:
+		route = routeOtherApiCheck
+		
+		
+		
+		
+		token := r.Header.Get("X-Auth")
+		if token != "100500" {
+			writeError(w, r, http.StatusForbidden, errors.New("unauthorized"))
+			return
+		}
+		
+		
+		if r.Method != "POST" {
+			writeError(w, r, http.StatusNotAcceptable, errors.New("bad method"))
+			return
+		}
+		
+		
+		if !allowRequest(w, r, route, 100, 100, "ip") {
+			return
+		}
+		
+		
+		if !acquireSlot(w, r, route, bulkheadOtherApiCheck, 50000000) {
+			return
+		}
+		
+		// по дедлайну метод продолжает работать в своей горутине, место освобождается, когда он завершится
+		var call *methodCall
+		r, call = trackMethodCall(r)
+		defer call.afterMethod(func(interface{}, error) { releaseSlot(route, bulkheadOtherApiCheck) })
+		
+		
+        h.handlerCheck(w, r, interceptors)
+
+    default:
+        // 404
+		writeError(w, r, http.StatusNotFound, errors.New("unknown method"))
+    }
+}
+
+// matchOtherApi находит индекс маршрута для пути запроса, -1 - маршрут не найден
+func matchOtherApi(p0 string) int {
+	if p0 != "" {
+		s0, p1 := nextSegment(p0)
+		switch s0 {
+		case "user":
+			if p1 != "" {
+				s1, p2 := nextSegment(p1)
+				switch s1 {
+				case "check":
+					if p2 == "" {
+						return 1
+					}
+				case "create":
+					if p2 == "" {
+						return 0
+					}
+				}
+			}
+		}
+	}
+	return -1
+}
+
+
+
+func (h *OtherApi) handlerCreate(w http.ResponseWriter, r *http.Request, interceptors []Interceptor) {
+	
+	ctx := r.Context()
+
+	
+
+	encoder, ok := negotiate(r, []string{"application/json", "application/xml"})
+	if !ok {
+		writeError(w, r, http.StatusNotAcceptable, errors.New("not acceptable"))
+		return
+	}
+
+	
+	
+	if !limitBody(w, r, 10485760) {
+		return
+	}
+	
+	
+	// заполнение структуры params
+	params := OtherCreateParams{}
+	
+	if err := params.BindRequest(r); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// валидирование параметров по тегам и пользовательским Validate,
+	// ApiError из Validate сохраняет свой статус
+	if err := params.Check(ctx); err != nil {
+		status := http.StatusBadRequest
+		var apiErr ApiError
+		if errors.As(err, &apiErr) {
+			status = apiErr.HTTPStatus
+		}
+		writeError(w, r, status, err)
+		return
+	}
+	
+
+	
+
+	
+
+	result, err := intercept(ctx, routeOtherApiCreate, &params, interceptors, func(ctx context.Context) (interface{}, error) {
+		
+		return h.Create(ctx, params)
+		
+	})
+
+	// respond пишет ответ по результату метода
+	respond := func(w http.ResponseWriter, result interface{}, err error) {
+		status := http.StatusOK
+		if err != nil {
+			var apiErr ApiError
+			switch {
+			case errors.As(err, &apiErr):
+				status = apiErr.HTTPStatus
+			
+			case errors.Is(err, context.Canceled) && ctx.Err() != nil:
+				// клиент закрыл соединение, это не ошибка сервера
+				status = StatusClientClosedRequest
+			
+			default:
+	            status = http.StatusInternalServerError
+			} 
+
+			writeError(w, r, status, err)
+			return 
+		}
+
+		// перехватчик мог подменить результат, тогда пишем его через Response
+		var response interface{} = Response{"error": "", "response": result}
+		if typed, ok := result.(*OtherUser); ok {
+			response = &responseOtherApiCreate{Response: typed}
+		}
+		
+		if err := writeResponse(w, encoder, response, status); err != nil {
+		
+			WriteErrorHook(fmt.Errorf("encode response: %w", err))
+			writeError(w, r, http.StatusInternalServerError, errors.New("internal server error"))
+		}
+	}
+
+	
+	respond(w, result, err)
+}
+
+func (h *OtherApi) handlerCheck(w http.ResponseWriter, r *http.Request, interceptors []Interceptor) {
+	
+	ctx := r.Context()
+
+	
+
+	encoder, ok := negotiate(r, DefaultProduces)
+	if !ok {
+		writeError(w, r, http.StatusNotAcceptable, errors.New("not acceptable"))
+		return
+	}
+
+	
+	
+	if !limitBody(w, r, 10485760) {
+		return
+	}
+	
+	
+	// заполнение структуры params
+	params := OtherCreateParams{}
+	
+	if err := bindAndValidateAll(&params, r); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	
+
+	
+	// пользовательская валидация, которую нельзя выразить тегами
+	if err := params.Validate(ctx); err != nil {
+		status := http.StatusBadRequest
+		var apiErr ApiError
+		if errors.As(err, &apiErr) {
+			status = apiErr.HTTPStatus
+		}
+		writeError(w, r, status, err)
+		return
+	}
+	
+
+	
+
+	result, err := intercept(ctx, routeOtherApiCheck, &params, interceptors, func(ctx context.Context) (interface{}, error) {
+		
+		return callWithTimeout(ctx, 100000000, func(ctx context.Context) (*OtherUser, error) {
+			return h.Check(ctx, params)
+		})
+		
+	})
+
+	// respond пишет ответ по результату метода
+	respond := func(w http.ResponseWriter, result interface{}, err error) {
+		status := http.StatusOK
+		if err != nil {
+			var apiErr ApiError
+			switch {
+			case errors.As(err, &apiErr):
+				status = apiErr.HTTPStatus
+			
+			case errors.Is(err, context.DeadlineExceeded):
+				status = 503
+			
+			case errors.Is(err, context.Canceled) && ctx.Err() != nil:
+				// клиент закрыл соединение, это не ошибка сервера
+				status = StatusClientClosedRequest
+			
+			default:
+	            status = http.StatusInternalServerError
+			} 
+
+			writeError(w, r, status, err)
+			return 
+		}
+
+		// перехватчик мог подменить результат, тогда пишем его через Response
+		var response interface{} = Response{"error": "", "response": result}
+		if typed, ok := result.(*OtherUser); ok {
+			response = &responseOtherApiCheck{Response: typed}
+		}
+		
+		if err := writeResponse(w, encoder, response, status); err != nil {
+		
+			WriteErrorHook(fmt.Errorf("encode response: %w", err))
+			writeError(w, r, http.StatusInternalServerError, errors.New("internal server error"))
+		}
+	}
+
+	
+	respond(w, result, err)
 }
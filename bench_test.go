@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// discardWriter - ResponseWriter, который ничего не хранит, чтобы в бенчмарки не попадали аллокации recorder-а
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+var benchUser = &User{ID: 42, Login: "rvasily", FullName: "Vasily Romanov", Status: statusAdmin}
+
+// BenchmarkResponseMap - прежний путь: Response-map и json.Marshal на каждый ответ
+func BenchmarkResponseMap(b *testing.B) {
+	w := &discardWriter{header: http.Header{}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		writeJsonResponse(w, Response{"error": "", "response": benchUser}, http.StatusOK)
+	}
+}
+
+// BenchmarkResponseTyped - типизированный ответ метода и json.Encoder в буфер из пула
+func BenchmarkResponseTyped(b *testing.B) {
+	w := &discardWriter{header: http.Header{}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		writeResponse(w, JSONEncoder{}, &responseMyApiProfile{Response: benchUser}, http.StatusOK)
+	}
+}
+
+var benchCreateParams = CreateParams{Login: "new_user_login", Name: "New User", Status: "moderator", Age: 32}
+
+// BenchmarkValidate - проверка валидных параметров по тегам, без reflect и аллокаций
+func BenchmarkValidate(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p := benchCreateParams
+		if err := p.Validate(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkValidateAll - то же для режима со сбором всех ошибок
+func BenchmarkValidateAll(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p := benchCreateParams
+		if err := p.ValidateAll(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestValidateNoAllocs(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		p := benchCreateParams
+		p.Validate()
+		p.ValidateAll()
+	})
+	if allocs != 0 {
+		t.Errorf("valid params must not allocate, got %v allocs per run", allocs)
+	}
+}
+
+var benchPaths = []string{"/user/profile", "/user/create", "/v2/user/create", "/users/rvasily", "/user/unknown"}
+
+// matchSwitch - прежняя маршрутизация в том виде, в каком её генерировал шаблон до дерева:
+// switch r.URL.Path с case на Url каждого метода MyApi. /users/{login} так не найти,
+// поэтому этот путь в бенчмарке для switch всегда промах
+func matchSwitch(path string) int {
+	switch path {
+	case "/user/profile":
+		return 0
+	case "/user/create":
+		return 1
+	case "/v2/user/create":
+		return 2
+	}
+	return -1
+}
+
+func TestMatchSwitchInSync(t *testing.T) {
+	for _, route := range NewMyApi().Routes() {
+		if strings.Contains(route.URL, "{") {
+			continue
+		}
+		if got, expected := matchSwitch(route.URL), matchMyApi(route.URL); got != expected {
+			t.Errorf("%s: switch gives %d, router %d - update matchSwitch", route.URL, got, expected)
+		}
+	}
+}
+
+func BenchmarkRouteSwitch(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		matchSwitch(benchPaths[i%len(benchPaths)])
+	}
+}
+
+// BenchmarkRouteTrie - вложенные switch по сегментам, включая параметр пути
+func BenchmarkRouteTrie(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		matchMyApi(benchPaths[i%len(benchPaths)])
+	}
+}
@@ -4,19 +4,29 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"go/types"
+	"io"
 	"log"
+	"math"
+	"net/http"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
 const (
 	API_METHOD_PREFIX    = "// apigen:api"
+	API_CORS_PREFIX      = "// apigen:cors"
 	API_VALIDATOR_PREFIX = "apivalidator"
 )
 
@@ -24,342 +34,3454 @@ type ApiConfig struct {
 	Url    string
 	Auth   bool
 	Method string
+	// вернуть ошибки по всем невалидным параметрам сразу, а не только первую
+	AggregateErrors bool `json:"aggregate_errors"`
+	// статусы для sentinel-ошибок и типов ошибок: {"ErrNotFound": 404, "*LimitError": 429}
+	Errors map[string]int
+	// дедлайн вызова метода, например "2s", и статус ответа при его истечении
+	Timeout       string
+	TimeoutStatus int `json:"timeout_status"`
+	// "10/s" или {"rate": 10, "burst": 20, "key": "ip|principal|header:X-Client"}
+	Ratelimit json.RawMessage
+	// сколько вызовов метода может выполняться одновременно и сколько ждать свободного места
+	MaxInflight  int    `json:"max_inflight"`
+	QueueTimeout string `json:"queue_timeout"`
+	// настройки CORS метода, заменяют настройки всего API
+	Cors *corsConfig
+	// максимальный размер тела запроса, например "1MB"
+	MaxBody string `json:"max_body"`
+	// допустимые Content-Type тела запроса
+	Consumes []string
+	// форматы ответа в порядке предпочтения, по умолчанию все встроенные
+	Produces []string
+	// версия API, например "v2"; как клиент её выбирает, задаёт флаг -versioning
+	Version string
+	// метод устарел: с какой даты (по умолчанию - дата генерации), дата отключения "2027-01-01" и Url, на который переходить
+	Deprecated   bool
+	DeprecatedAt string `json:"deprecated_at"`
+	Sunset       string
+	Successor    string
+	// кеширование успешного ответа: {"max_age": "60s", "etag": true}
+	Cache *cacheConfig
+	// повтор запроса с тем же Idempotency-Key получает сохранённый ответ первого
+	Idempotent bool
+	// сжимать ответ gzip или deflate, если клиент их принимает; по умолчанию - флаг -compress
+	Compress *bool
+}
+
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize разбирает размер вида 512KB, 1MB или число байт
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	unit := int64(1)
+	for _, item := range sizeUnits {
+		if strings.HasSuffix(value, item.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, item.suffix))
+			unit = item.size
+			break
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size * unit, nil
+}
+
+// corsConfig задаётся флагами кодогенератора, аннотацией apigen:cors у структуры API
+// или полем cors в аннотации метода
+type corsConfig struct {
+	Origins     []string
+	Methods     []string
+	Headers     []string
+	Credentials bool
+	MaxAge      string `json:"max_age"`
+	// max_age в секундах, считается кодогенератором
+	MaxAgeSeconds int `json:"-"`
+}
+
+func (c *corsConfig) prepare() error {
+	for _, origin := range c.Origins {
+		// браузер не примет "*" с credentials, а отражать любой Origin с ними небезопасно
+		if origin == "*" && c.Credentials {
+			return fmt.Errorf(`origins "*" can not be used with credentials`)
+		}
+	}
+	if c.MaxAge == "" {
+		return nil
+	}
+	maxAge, err := time.ParseDuration(c.MaxAge)
+	if err != nil {
+		return err
+	}
+	c.MaxAgeSeconds = int(maxAge.Seconds())
+	return nil
+}
+
+type cacheConfig struct {
+	MaxAge string `json:"max_age"`
+	Etag   bool
+	// значение Cache-Control, считается кодогенератором
+	Control string `json:"-"`
+}
+
+func (c *cacheConfig) prepare() error {
+	if c.MaxAge == "" {
+		// без max_age клиент должен каждый раз сверять ETag
+		c.Control = "no-cache"
+		return nil
+	}
+	maxAge, err := time.ParseDuration(c.MaxAge)
+	if err != nil {
+		return err
+	}
+	c.Control = fmt.Sprintf("max-age=%d", int(maxAge.Seconds()))
+	return nil
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	items := strings.Split(value, ",")
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+	return items
+}
+
+type rateLimit struct {
+	// запросов в секунду
+	Rate  float64
+	Burst int
+	// ip, principal или header:<имя заголовка>
+	Key string
+}
+
+// rateUnits - во сколько секунд укладывается единица из записи "10/s"
+var rateUnits = map[string]float64{
+	"s": 1,
+	"m": 60,
+	"h": 3600,
+}
+
+// parseRateLimit разбирает лимит из аннотации, nil - лимита нет
+func parseRateLimit(raw json.RawMessage) (*rateLimit, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	limit := &rateLimit{Key: "ip"}
+	short := ""
+	if err := json.Unmarshal(raw, &short); err == nil {
+		parts := strings.SplitN(short, "/", 2)
+		if len(parts) != 2 || rateUnits[parts[1]] == 0 {
+			return nil, fmt.Errorf("bad rate limit %q, expected like 10/s", short)
+		}
+		count, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad rate limit %q: %v", short, err)
+		}
+		limit.Rate = count / rateUnits[parts[1]]
+		limit.Burst = int(count)
+	} else if err := json.Unmarshal(raw, limit); err != nil {
+		return nil, err
+	}
+
+	if limit.Rate <= 0 {
+		return nil, fmt.Errorf("rate limit must be positive")
+	}
+	if limit.Burst <= 0 {
+		limit.Burst = int(math.Ceil(limit.Rate))
+	}
+	if limit.Key != "ip" && limit.Key != "principal" && !strings.HasPrefix(limit.Key, "header:") {
+		return nil, fmt.Errorf("bad rate limit key %q", limit.Key)
+	}
+
+	return limit, nil
+}
+
+type errorCase struct {
+	Cond   string
+	Status int
 }
 
 type requestParam struct {
-	ParamName  string
+	ParamName string
+	// имя параметра в запросе: paramname из тега или имя поля в нижнем регистре
+	QueryName  string
 	ParamType  string
 	Validators string
-	Parsers    string
+	Defaults   string
+	// правила из тега apivalidator как есть, для спецификации
+	Rules string
+}
+
+type paramsTplParams struct {
+	ParamsName    string
+	Params        []requestParam
+	HasValidators bool
+	ValidateHook  string
+}
+
+type apiTplParams struct {
+	ApiName string
+	Cases   []handlerTplParams
+	// версии методов с одинаковым Url, пусто - выбирать версию не нужно
+	Versions []versionSlot
+	// стратегия версионирования и заголовок, от которого зависит ответ
+	Versioning  string
+	VersionVary string
+	// код функции match{{.ApiName}}, собранный из дерева маршрутов
+	Router string
+	// что делать с путём, который отличается от маршрута только "/" в конце
+	TrailingSlash string
+}
+
+// versionSlot - методы API с одним Url, различающиеся версией
+type versionSlot struct {
+	// метод, который находит роутер: без версии, а если такого нет - первый объявленный
+	Default int
+	// метод без версии обслуживает запросы с любой неизвестной версией
+	Fallback bool
+	Cases    []versionCase
+}
+
+type versionCase struct {
+	Version string
+	Index   int
+}
+
+// pathParam - параметр пути {name} или {name...} и номер его сегмента в URL
+type pathParam struct {
+	Name     string
+	Segment  int
+	Wildcard bool
+}
+
+type handlerTplParams struct {
+	ApiName    string
+	MethodName string
+	ParamsName string
+	Params     []requestParam
+	Config     ApiConfig
+	// "" - у структуры параметров нет метода Validate,
+	// "plain" - есть Validate() error, "ctx" - есть Validate(ctx) error
+	ValidateHook string
+	ErrorCases   []errorCase
+	// тип первого результата метода, например *User
+	ResultType string
+	// дедлайн в наносекундах, 0 - без дедлайна
+	Timeout       int64
+	TimeoutStatus int
+	RateLimit     *rateLimit
+	// ожидание места в bulkhead в наносекундах, 0 - не ждать
+	QueueTimeout int64
+	// итоговые настройки CORS метода, nil - CORS выключен
+	CORS *corsConfig
+	// максимальный размер тела запроса в байтах, 0 - без ограничения
+	MaxBody int64
+	// параметры пути из Url, их значения доступны через r.PathValue
+	PathParams []pathParam
+	// значение заголовка Deprecation по RFC 9745: "@" и unix-время даты deprecated_at
+	Deprecation string
+	// дата отключения устаревшего метода в формате HTTP-date для заголовка Sunset
+	Sunset string
+	// сжимать ответ по Accept-Encoding
+	Compress bool
+}
+
+var (
+	apiTpl = template.Must(template.New("apiTpl").Parse(`
+{{range .Cases}}
+{{if .CORS}}
+var cors{{.ApiName}}{{.MethodName}} = &CORSConfig{
+	Origins:     {{printf "%#v" .CORS.Origins}},
+	Methods:     {{printf "%#v" .CORS.Methods}},
+	Headers:     {{printf "%#v" .CORS.Headers}},
+	Credentials: {{.CORS.Credentials}},
+	MaxAge:      {{.CORS.MaxAgeSeconds}},
+}
+{{end}}
+{{if .Config.MaxInflight}}
+// bulkhead{{.ApiName}}{{.MethodName}} ограничивает число одновременных вызовов {{.ApiName}}.{{.MethodName}}.
+// Он один на процесс: все экземпляры {{.ApiName}} и все их монтирования в Mux
+// делят max_inflight, как и ресурс, который за ним стоит
+var bulkhead{{.ApiName}}{{.MethodName}} = make(chan struct{}, {{.Config.MaxInflight}})
+{{end}}
+// response{{.ApiName}}{{.MethodName}} - ответ {{.ApiName}}.{{.MethodName}} без промежуточного map
+type response{{.ApiName}}{{.MethodName}} struct {
+	Error    string ` + "`" + `json:"error"` + "`" + `
+	Response {{.ResultType}} ` + "`" + `json:"response"` + "`" + `
+}
+
+var route{{.ApiName}}{{.MethodName}} = RouteInfo{
+	Api:        "{{.ApiName}}",
+	URL:        "{{.Config.Url}}",
+	HTTPMethod: "{{.Config.Method}}",
+	MethodName: "{{.MethodName}}",
+	Auth:       {{.Config.Auth}},
+	Version:    "{{.Config.Version}}",
+	{{if .Config.Deprecated}}
+	Deprecated:  true,
+	Deprecation: "{{.Deprecation}}",
+	Sunset:      "{{.Sunset}}",
+	Successor:   "{{.Config.Successor}}",
+	{{end}}
+}
+{{end}}
+
+// {{.ApiName}}Handler - {{.ApiName}} с цепочкой перехватчиков вокруг методов API
+type {{.ApiName}}Handler struct {
+	api          *{{.ApiName}}
+	interceptors []Interceptor
+}
+
+// New{{.ApiName}}Handler оборачивает api, перехватчики вызываются в порядке передачи
+func New{{.ApiName}}Handler(api *{{.ApiName}}, interceptors ...Interceptor) *{{.ApiName}}Handler {
+	return &{{.ApiName}}Handler{api, interceptors}
+}
+
+func (h *{{.ApiName}}Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.api.serveHTTP(w, r, h.interceptors)
+}
+
+// Routes возвращает маршруты {{.ApiName}}, чтобы смонтировать его в Mux
+func (h *{{.ApiName}}Handler) Routes() []RouteInfo {
+	return h.api.Routes()
+}
+
+// Routes возвращает маршруты {{.ApiName}} в порядке объявления методов
+func (h *{{.ApiName}}) Routes() []RouteInfo {
+	return []RouteInfo{ {{range .Cases}}
+		route{{.ApiName}}{{.MethodName}},{{end}}
+	}
+}
+
+func (h *{{.ApiName}}) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.serveHTTP(w, r, nil)
+}
+
+var route{{.ApiName}}Unknown = RouteInfo{Api: "{{.ApiName}}", MethodName: "unknown"}
+
+func (h *{{.ApiName}}) serveHTTP(w http.ResponseWriter, r *http.Request, interceptors []Interceptor) {
+    rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+    w = rec
+    route := route{{.ApiName}}Unknown
+    start := time.Now()
+    r = withRequestID(w, r)
+    r, span := startSpan(r)
+    defer func() {
+      latency := time.Since(start)
+      finishSpan(span, route, rec)
+      if Metrics != nil {
+        Metrics.ObserveRequest(route, rec.status, latency)
+      }
+      logAccess(r, route, rec, latency)
+    }()
+    defer recoverPanic(w, r)
+
+    path := r.URL.Path
+    if !strings.HasPrefix(path, "/") {
+      // http.StripPrefix("/v2/", ...) оставляет путь без ведущего "/"
+      path = "/" + path
+    }
+    match := match{{.ApiName}}(path)
+    {{if ne .TrailingSlash "strict"}}
+    if match < 0 {
+      if alt := toggleTrailingSlash(path); alt != "" && match{{.ApiName}}(alt) >= 0 {
+        {{if eq .TrailingSlash "redirect"}}
+        // Location строится от исходного пути: http.StripPrefix в Mux отрезал префикс монтирования
+        u := *r.URL
+        u.Path, u.RawPath = toggleTrailingSlash(originalPath(r)), ""
+        http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+        return
+        {{else}}
+        path = alt
+        match = match{{.ApiName}}(alt)
+        {{end}}
+      }
+    }
+    {{end}}
+    {{if .Versions}}
+    match = version{{.ApiName}}(w, r, match)
+    {{end}}
+
+    switch match {
+{{range $i, $case := .Cases}}
+    case {{$i}}:
+		route = route{{.ApiName}}{{.MethodName}}
+		{{if .Config.Deprecated}}
+		markDeprecated(w, route)
+		{{end}}
+		{{range .PathParams}}
+		r.SetPathValue("{{.Name}}", {{if .Wildcard}}pathTail{{else}}pathSegment{{end}}(path, {{.Segment}}))
+		{{end}}
+		{{if .CORS}}
+		if handleCORS(w, r, route, cors{{.ApiName}}{{.MethodName}}) {
+			return
+		}
+		{{end}}
+		{{if .Config.Auth}}
+		token := r.Header.Get("X-Auth")
+		if token != "100500" {
+			writeError(w, r, http.StatusForbidden, errors.New("unauthorized"))
+			return
+		}
+		{{end}}
+		{{if ne .Config.Method ""}}
+		if r.Method != "{{.Config.Method}}" {
+			writeError(w, r, http.StatusNotAcceptable, errors.New("bad method"))
+			return
+		}
+		{{end}}
+		{{with .RateLimit}}
+		if !allowRequest(w, r, route, {{.Rate}}, {{.Burst}}, "{{.Key}}") {
+			return
+		}
+		{{end}}
+		{{if .Config.MaxInflight}}
+		if !acquireSlot(w, r, route, bulkhead{{.ApiName}}{{.MethodName}}, {{.QueueTimeout}}) {
+			return
+		}
+		{{if .Timeout}}
+		// по дедлайну метод продолжает работать в своей горутине, место освобождается, когда он завершится
+		var call *methodCall
+		r, call = trackMethodCall(r)
+		defer call.afterMethod(func(interface{}, error) { releaseSlot(route, bulkhead{{.ApiName}}{{.MethodName}}) })
+		{{else}}
+		defer releaseSlot(route, bulkhead{{.ApiName}}{{.MethodName}})
+		{{end}}
+		{{end}}
+        h.handler{{.MethodName}}(w, r, interceptors)
+{{end}}
+    default:
+        // 404
+		writeError(w, r, http.StatusNotFound, errors.New("unknown method"))
+    }
+}
+
+{{.Router}}
+{{if .Versions}}
+// version{{.ApiName}} выбирает среди методов с одним Url тот, чья версия запрошена клиентом
+func version{{.ApiName}}(w http.ResponseWriter, r *http.Request, match int) int {
+	switch match {
+{{range .Versions}}
+	case {{.Default}}:
+		w.Header().Add("Vary", "{{$.VersionVary}}")
+		switch requestVersion(r, "{{$.Versioning}}") {
+		case "":
+			return {{.Default}}
+{{range .Cases}}
+		case "{{.Version}}":
+			return {{.Index}}
+{{end}}
+		}
+		return {{if .Fallback}}{{.Default}}{{else}}-1{{end}}
+{{end}}
+	}
+	return match
+}
+{{end}}
+`))
+
+	handlerTpl = template.Must(template.New("handlerTpl").Parse(`
+func (h *{{.ApiName}}) handler{{.MethodName}}(w http.ResponseWriter, r *http.Request, interceptors []Interceptor) {
+	{{if and .Timeout .Config.Idempotent}}
+	var call *methodCall
+	r, call = trackMethodCall(r)
+	{{end}}
+	ctx := r.Context()
+
+	{{if .Compress}}
+	if compressed := newCompressWriter(w, r); compressed != nil {
+		w = compressed
+		defer compressed.Close()
+	}
+	{{end}}
+
+	encoder, ok := negotiate(r, {{if .Config.Produces}}{{printf "%#v" .Config.Produces}}{{else}}DefaultProduces{{end}})
+	if !ok {
+		writeError(w, r, http.StatusNotAcceptable, errors.New("not acceptable"))
+		return
+	}
+
+	{{if .Config.Consumes}}
+	if !checkContentType(w, r, {{printf "%#v" .Config.Consumes}}) {
+		return
+	}
+	{{end}}
+	{{if .MaxBody}}
+	if !limitBody(w, r, {{.MaxBody}}) {
+		return
+	}
+	{{end}}
+	
+	// заполнение структуры params
+	params := {{.ParamsName}}{}
+	{{if .Config.AggregateErrors}}
+	if err := bindAndValidateAll(&params, r); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	{{else}}
+	if err := params.BindRequest(r); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// валидирование параметров по тегам и пользовательским Validate,
+	// ApiError из Validate сохраняет свой статус
+	if err := params.Check(ctx); err != nil {
+		status := http.StatusBadRequest
+		var apiErr ApiError
+		if errors.As(err, &apiErr) {
+			status = apiErr.HTTPStatus
+		}
+		writeError(w, r, status, err)
+		return
+	}
+	{{end}}
+
+	{{if and .ValidateHook .Config.AggregateErrors}}
+	// пользовательская валидация, которую нельзя выразить тегами
+	if err := params.Validate({{if eq .ValidateHook "ctx"}}ctx{{end}}); err != nil {
+		status := http.StatusBadRequest
+		var apiErr ApiError
+		if errors.As(err, &apiErr) {
+			status = apiErr.HTTPStatus
+		}
+		writeError(w, r, status, err)
+		return
+	}
+	{{end}}
+
+	{{if .Config.Idempotent}}
+	var idempotent *idempotencyRecorder
+	if key := r.Header.Get(IdempotencyKeyHeader); key != "" {
+		var done bool
+		idempotent, done = beginIdempotent(w, r, route{{.ApiName}}{{.MethodName}}, key)
+		if done {
+			return
+		}
+		w = idempotent
+		defer idempotent.finish()
+	}
+	{{end}}
+
+	result, err := intercept(ctx, route{{.ApiName}}{{.MethodName}}, &params, interceptors, func(ctx context.Context) (interface{}, error) {
+		{{if .Timeout}}
+		return callWithTimeout(ctx, {{.Timeout}}, func(ctx context.Context) ({{.ResultType}}, error) {
+			return h.{{.MethodName}}(ctx, params)
+		})
+		{{else}}
+		return h.{{.MethodName}}(ctx, params)
+		{{end}}
+	})
+
+	// respond пишет ответ по результату метода
+	respond := func(w http.ResponseWriter, result interface{}, err error) {
+		status := http.StatusOK
+		if err != nil {
+			var apiErr ApiError
+			switch {
+			case errors.As(err, &apiErr):
+				status = apiErr.HTTPStatus
+			{{if .Timeout}}
+			case errors.Is(err, context.DeadlineExceeded):
+				status = {{.TimeoutStatus}}
+			{{end}}
+			case errors.Is(err, context.Canceled) && ctx.Err() != nil:
+				// клиент закрыл соединение, это не ошибка сервера
+				status = StatusClientClosedRequest
+			{{range .ErrorCases}}
+			case {{.Cond}}:
+				status = {{.Status}}
+			{{end}}
+			default:
+	            status = http.StatusInternalServerError
+			} 
+
+			writeError(w, r, status, err)
+			return 
+		}
+
+		// перехватчик мог подменить результат, тогда пишем его через Response
+		var response interface{} = Response{"error": "", "response": result}
+		if typed, ok := result.({{.ResultType}}); ok {
+			response = &response{{.ApiName}}{{.MethodName}}{Response: typed}
+		}
+		{{with .Config.Cache}}
+		if err := writeCachedResponse(w, r, encoder, response, result, status, "{{.Control}}", {{.Etag}}); err != nil {
+		{{else}}
+		if err := writeResponse(w, encoder, response, status); err != nil {
+		{{end}}
+			WriteErrorHook(fmt.Errorf("encode response: %w", err))
+			writeError(w, r, http.StatusInternalServerError, errors.New("internal server error"))
+		}
+	}
+
+	{{if and .Timeout .Config.Idempotent}}
+	if idempotent != nil && call.detached() {
+		// метод ещё работает после дедлайна или отключения клиента: ключ остаётся занятым,
+		// чтобы повтор не запустил метод второй раз, а когда метод завершится - по ключу сохранится его ответ
+		late := idempotent.detach()
+		call.afterMethod(func(result interface{}, err error) {
+			respond(late, result, err)
+			late.finish()
+		})
+	}
+	{{end}}
+	respond(w, result, err)
+}
+`))
+	paramsTpl = template.Must(template.New("paramsTpl").Parse(`
+// BindRequest заполняет {{.ParamsName}} из параметров запроса
+func (p *{{.ParamsName}}) BindRequest(r *http.Request) error {
+    return p.bind(r, false)
+}
+
+func (p *{{.ParamsName}}) bind(r *http.Request, all bool) error {
+    var errs ValidationErrors
+	{{range .Params}}
+    {{ if eq .ParamType "string" }}
+    p.{{.ParamName}} = requestValue(r, "{{.QueryName}}")
+    {{end}}
+    {{ if eq .ParamType "int" }}
+    if num, err := strconv.Atoi(requestValue(r, "{{.QueryName}}")); err != nil {
+      if !all {
+        return FieldError{"{{.QueryName}}", "must be int"}
+      }
+      errs = append(errs, FieldError{"{{.QueryName}}", "must be int"})
+    } else {
+      p.{{.ParamName}} = num
+    }
+    {{end}}
+	{{end}}
+    p.setDefaults()
+    if len(errs) > 0 {
+      return errs
+    }
+    return nil
+}
+
+// setDefaults подставляет значения по умолчанию из тегов в незаполненные поля
+func (p *{{.ParamsName}}) setDefaults() {
+	{{range .Params}}{{.Defaults}}{{end}}
+}
+
+// Check - единая точка проверки {{.ParamsName}} и вне HTTP: подставляет значения по умолчанию,
+// проверяет теги apivalidator{{if .ValidateHook}} и вызывает пользовательский Validate{{end}}
+func (p *{{.ParamsName}}) Check(ctx context.Context) error {
+    p.setDefaults()
+    if err := p.validate(false); err != nil {
+      return err
+    }
+    {{if eq .ValidateHook "ctx"}}return p.Validate(ctx){{else if .ValidateHook}}return p.Validate(){{else}}return nil{{end}}
+}
+
+// {{if .ValidateHook}}ValidateTags{{else}}Validate{{end}} проверяет {{.ParamsName}} по правилам из тегов apivalidator
+// и возвращает первую найденную ошибку
+func (p *{{.ParamsName}}) {{if .ValidateHook}}ValidateTags{{else}}Validate{{end}}() error {
+    return p.validate(false)
+}
+
+// ValidateAll проверяет {{.ParamsName}} по правилам из тегов apivalidator
+// и возвращает ValidationErrors со всеми невалидными параметрами
+func (p *{{.ParamsName}}) ValidateAll() error {
+    return p.validate(true)
+}
+
+// проверки сгенерированы как прямые сравнения полей, а тексты ошибок
+// посчитаны при генерации, поэтому валидный запрос проходит без аллокаций
+func (p *{{.ParamsName}}) validate(all bool) error {
+    var errs ValidationErrors
+	{{if .HasValidators}}
+	{{range .Params}}{{if .Validators}}
+	{{.Validators}}
+	{{end}}{{end}}
+	{{end}}
+    if len(errs) > 0 {
+      return errs
+    }
+    return nil
+}
+`))
+	// проверки одного поля связаны через else, чтобы в ValidationErrors
+	// попадала только первая ошибка по каждому параметру
+	fieldErrorTpl = template.Must(template.New("fieldErrorTpl").Parse(`
+      if !all {
+        return FieldError{ {{printf "%q" .QueryName}}, {{printf "%q" .Message}} }
+      }
+      errs = append(errs, FieldError{ {{printf "%q" .QueryName}}, {{printf "%q" .Message}} })`))
+)
+
+// fieldCheck - одна проверка поля: условие ошибки либо список допустимых значений enum
+type fieldCheck struct {
+	Cond    string
+	Enum    []string
+	Message string
+}
+
+// getQueryName возвращает имя параметра в запросе: paramname из тега или имя поля в нижнем регистре
+func getQueryName(fieldName, tag string) string {
+	for _, constraint := range strings.Split(tag, ",") {
+		if strings.Index(constraint, "paramname") == 0 {
+			return strings.SplitN(constraint, "=", 2)[1]
+		}
+	}
+	return strings.ToLower(fieldName)
+}
+
+func getDefaultsByTag(fieldName, fieldType, tag string) string {
+	defaults := ""
+	constraints := strings.Split(tag, ",")
+
+	for _, constraint := range constraints {
+		if strings.Index(constraint, "default") != 0 {
+			continue
+		}
+
+		value := strings.SplitN(constraint, "=", 2)[1]
+		switch fieldType {
+		case "string":
+			defaults += fmt.Sprintf(`
+    if p.%s == "" {
+      p.%s = %q
+    }`, fieldName, fieldName, value)
+		case "int":
+			defaults += fmt.Sprintf(`
+    if p.%s == 0 {
+      p.%s = %s
+    }`, fieldName, fieldName, value)
+		}
+	}
+
+	return defaults
+}
+
+func getValidatorsByTag(queryName, fieldName, fieldType, tag string) string {
+	checks := []fieldCheck{}
+	field := "p." + fieldName
+	zero := `""`
+	if fieldType == "int" {
+		zero = "0"
+	}
+
+	for _, constraint := range strings.Split(tag, ",") {
+		value := ""
+		if parts := strings.SplitN(constraint, "=", 2); len(parts) == 2 {
+			value = parts[1]
+		}
+
+		switch {
+		case strings.Index(constraint, "required") == 0:
+			checks = append(checks, fieldCheck{Cond: field + " == " + zero, Message: "must me not empty"})
+		case strings.Index(constraint, "min") == 0 && fieldType == "int":
+			checks = append(checks, fieldCheck{Cond: field + " < " + value, Message: "must be >= " + value})
+		case strings.Index(constraint, "max") == 0 && fieldType == "int":
+			checks = append(checks, fieldCheck{Cond: field + " > " + value, Message: "must be <= " + value})
+		case strings.Index(constraint, "min") == 0 && value != "0":
+			checks = append(checks, fieldCheck{Cond: "len(" + field + ") < " + value, Message: "len must be >= " + value})
+		case strings.Index(constraint, "max") == 0 && value != "0":
+			checks = append(checks, fieldCheck{Cond: "len(" + field + ") > " + value, Message: "must be <= " + value})
+		case strings.Index(constraint, "enum") == 0:
+			list := strings.Split(value, "|")
+			checks = append(checks, fieldCheck{Enum: list, Message: "must be one of [" + strings.Join(list, ", ") + "]"})
+		}
+	}
+
+	return renderChecks(queryName, field, checks)
+}
+
+// renderChecks собирает проверки поля в цепочку: следующая проверка выполняется,
+// только если предыдущая прошла; enum превращается в switch по строковым константам
+func renderChecks(queryName, field string, checks []fieldCheck) string {
+	if len(checks) == 0 {
+		return ""
+	}
+
+	check, rest := checks[0], renderChecks(queryName, field, checks[1:])
+	fail := new(bytes.Buffer)
+	fieldErrorTpl.Execute(fail, map[string]string{"QueryName": queryName, "Message": check.Message})
+
+	if check.Enum != nil {
+		values := make([]string, 0, len(check.Enum))
+		for _, v := range check.Enum {
+			values = append(values, strconv.Quote(v))
+		}
+		return fmt.Sprintf("switch %s {\n    case %s:%s\n    default:%s\n    }",
+			field, strings.Join(values, ", "), indentRest(rest), fail)
+	}
+
+	out := fmt.Sprintf("if %s {%s\n    }", check.Cond, fail)
+	switch {
+	case rest == "":
+	case strings.HasPrefix(rest, "if "):
+		out += " else " + rest
+	default:
+		out += " else {\n    " + rest + "\n    }"
+	}
+	return out
+}
+
+func indentRest(rest string) string {
+	if rest == "" {
+		return ""
+	}
+	return "\n    " + rest
+}
+
+// receiverName возвращает имя типа, к которому относится метод
+func receiverName(g *ast.FuncDecl) string {
+	switch t := g.Recv.List[0].Type.(type) {
+	case *ast.StarExpr:
+		return t.X.(*ast.Ident).Name
+	case *ast.Ident:
+		return t.Name
+	}
+	return ""
+}
+
+// structFields возвращает типы именованных полей структуры по их именам
+func structFields(st *ast.StructType) map[string]string {
+	fields := make(map[string]string, len(st.Fields.List))
+	for _, field := range st.Fields.List {
+		for _, name := range field.Names {
+			fields[name.Name] = types.ExprString(field.Type)
+		}
+	}
+	return fields
+}
+
+// writeApiErrorExtras генерирует apiErrorExtras под поля ApiError из исходника:
+// Code и Details необязательны, без них в ответе об ошибке нет code и details
+func writeApiErrorExtras(out io.Writer, fields map[string]string) {
+	fmt.Fprintln(out, `
+// apiErrorExtras достаёт из ApiError в цепочке err машиночитаемый код и подробности
+func apiErrorExtras(err error) (code string, details interface{}) {
+  var apiErr ApiError
+  if !errors.As(err, &apiErr) {
+    return "", nil
+  }`)
+	if fields["Code"] == "string" {
+		fmt.Fprintln(out, `  code = apiErr.Code`)
+	}
+	if _, ok := fields["Details"]; ok {
+		fmt.Fprintln(out, `  details = apiErr.Details`)
+	}
+	fmt.Fprintln(out, `  return code, details
+}`)
+}
+
+// validateHookKind возвращает вид хука Validate по сигнатуре: "plain", "ctx" или "" если сигнатура не подходит
+func validateHookKind(t *ast.FuncType) string {
+	if t.Results == nil || len(t.Results.List) != 1 || len(t.Results.List[0].Names) > 1 {
+		return ""
+	}
+	if result, ok := t.Results.List[0].Type.(*ast.Ident); !ok || result.Name != "error" {
+		return ""
+	}
+	switch params := t.Params.List; {
+	case len(params) == 0:
+		return "plain"
+	case len(params) == 1 && len(params[0].Names) <= 1:
+		sel, ok := params[0].Type.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "Context" {
+			return ""
+		}
+		if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == "context" {
+			return "ctx"
+		}
+	}
+	return ""
+}
+
+var (
+	aggregateErrors      = flag.Bool("aggregate-errors", false, "return all validation errors at once for every method")
+	errorEncoder         = flag.String("error-encoder", "legacy", "default error format: legacy or problem")
+	defaultTimeout       = flag.Duration("timeout", 0, "deadline for every method without own timeout, 0 - no deadline")
+	defaultTimeoutStatus = flag.Int("timeout-status", http.StatusGatewayTimeout, "response status when method deadline is exceeded")
+	corsOrigins          = flag.String("cors-origins", "", "CORS allowed origins for every API: https://a.example,https://b.example or *")
+	corsMethods          = flag.String("cors-methods", "", "CORS allowed methods, by default the method from annotation")
+	corsHeaders          = flag.String("cors-headers", "", "CORS allowed request headers")
+	corsCredentials      = flag.Bool("cors-credentials", false, "CORS allow credentials")
+	corsMaxAge           = flag.String("cors-max-age", "", "CORS preflight cache duration, e.g. 10m")
+	defaultMaxBody       = flag.String("max-body", "10MB", "request body limit for every method without own max_body, 0 - no limit")
+	errorsMap            = flag.String("errors", "", "statuses for errors of every method: ErrNotFound=404,*LimitError=429")
+	versioning           = flag.String("versioning", "path", "how clients select method version: path (/v2/url), header (Accept-Version) or media-type (Accept: ...; version=v2)")
+	defaultCompress      = flag.Bool("compress", false, "compress responses of every method without own compress by Accept-Encoding")
+	strict               = flag.Bool("strict", false, "fail on lint warnings such as a passed sunset date instead of printing them")
+	specDir              = flag.String("spec", "", "directory for route specs of every API version: <Api>.json and <Api>.<version>.json")
+	extraEncoders        = flag.String("encoders", "", "response media types the application adds to ResponseEncoders, allowed in produces: application/cbor,text/csv")
+	trailingSlash        = flag.String("trailing-slash", "strict", "path differing from route only by trailing slash: strict (404), redirect (308) or ignore")
+)
+
+// versionVary - заголовок запроса, от которого зависит выбор версии
+var versionVary = map[string]string{
+	"path":       "",
+	"header":     "Accept-Version",
+	"media-type": "Accept",
+}
+
+// builtinEncoders - форматы ответа, которые есть в ResponseEncoders без кода приложения
+var builtinEncoders = []string{"application/json", "application/xml", "application/msgpack"}
+
+var trailingSlashPolicies = map[string]bool{
+	"strict":   true,
+	"redirect": true,
+	"ignore":   true,
+}
+
+// parseDate разбирает дату из аннотации: "2027-01-01" или RFC 3339
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if date, err := time.Parse(time.DateOnly, value); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// lintWarning печатает предупреждение о методе, а с -strict останавливает генерацию
+func lintWarning(format string, args ...interface{}) {
+	warning := fmt.Sprintf(format, args...)
+	if *strict {
+		log.Fatal(warning)
+	}
+	fmt.Fprintln(os.Stderr, "WARNING "+warning)
+}
+
+// formatSunset переводит дату в HTTP-date для заголовка Sunset
+func formatSunset(sunset time.Time) string {
+	if sunset.IsZero() {
+		return ""
+	}
+	return sunset.UTC().Format(http.TimeFormat)
+}
+
+// getVersionSlots группирует методы API с одинаковым Url по версиям.
+// При версионировании через путь версия уже входит в Url, и групп не бывает
+func getVersionSlots(methods []handlerTplParams) map[string]*versionSlot {
+	slots := make(map[string]*versionSlot)
+	if *versioning == "path" {
+		return slots
+	}
+
+	byURL := make(map[string][]int)
+	urls := []string{}
+	for i, method := range methods {
+		if _, ok := byURL[method.Config.Url]; !ok {
+			urls = append(urls, method.Config.Url)
+		}
+		byURL[method.Config.Url] = append(byURL[method.Config.Url], i)
+	}
+
+	for _, url := range urls {
+		indexes := byURL[url]
+		if len(indexes) < 2 {
+			continue
+		}
+
+		slot := &versionSlot{Default: indexes[0]}
+		seen := make(map[string]bool)
+		for _, i := range indexes {
+			version := methods[i].Config.Version
+			if seen[version] {
+				log.Fatalf("%s.%s: url %s already has a method with version %q", methods[i].ApiName, methods[i].MethodName, url, version)
+			}
+			seen[version] = true
+			if version == "" {
+				slot.Default, slot.Fallback = i, true
+				continue
+			}
+			slot.Cases = append(slot.Cases, versionCase{version, i})
+		}
+		slots[url] = slot
+	}
+	return slots
+}
+
+// apiSpec - маршруты API, которые видит клиент одной версии, пишется флагом -spec
+type apiSpec struct {
+	Api        string      `json:"api"`
+	Version    string      `json:"version,omitempty"`
+	Versioning string      `json:"versioning"`
+	Routes     []routeSpec `json:"routes"`
+}
+
+type routeSpec struct {
+	Method       string      `json:"method"`
+	HTTPMethod   string      `json:"http_method,omitempty"`
+	URL          string      `json:"url"`
+	Version      string      `json:"version,omitempty"`
+	Auth         bool        `json:"auth"`
+	Params       []paramSpec `json:"params"`
+	Consumes     []string    `json:"consumes,omitempty"`
+	Produces     []string    `json:"produces,omitempty"`
+	Deprecated   bool        `json:"deprecated,omitempty"`
+	DeprecatedAt string      `json:"deprecated_at,omitempty"`
+	Sunset       string      `json:"sunset,omitempty"`
+	Successor    string      `json:"successor,omitempty"`
+}
+
+type paramSpec struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// path - сегмент Url, query - query string или форма
+	In    string `json:"in"`
+	Rules string `json:"rules,omitempty"`
+}
+
+// getVersionSpecs строит спецификацию для каждой версии API так же, как выбирает метод сгенерированный код:
+// при версионировании через путь клиент версии видит её методы и методы без версии, которые она не заменила,
+// иначе - метод слота с его версией, метод без версии или единственный метод Url
+func getVersionSpecs(apiName string, methods []handlerTplParams, slots map[string]*versionSlot) []apiSpec {
+	versions := []string{""}
+	seen := map[string]bool{"": true}
+	for _, method := range methods {
+		if !seen[method.Config.Version] {
+			seen[method.Config.Version] = true
+			versions = append(versions, method.Config.Version)
+		}
+	}
+
+	specs := make([]apiSpec, 0, len(versions))
+	for _, version := range versions {
+		spec := apiSpec{Api: apiName, Version: version, Versioning: *versioning, Routes: []routeSpec{}}
+		for i, method := range methods {
+			if *versioning == "path" {
+				if method.Config.Version != version && (method.Config.Version != "" || replacedInVersion(methods, method, version)) {
+					continue
+				}
+			} else if slot, ok := slots[method.Config.Url]; ok && slotMethod(slot, version) != i {
+				continue
+			}
+			spec.Routes = append(spec.Routes, getRouteSpec(method))
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// replacedInVersion сообщает, есть ли у метода без версии замена в version
+func replacedInVersion(methods []handlerTplParams, method handlerTplParams, version string) bool {
+	for _, other := range methods {
+		if other.Config.Version == version && other.Config.Url == "/"+version+method.Config.Url {
+			return true
+		}
+	}
+	return false
+}
+
+// slotMethod повторяет version{{.ApiName}}: индекс метода для запрошенной версии или -1
+func slotMethod(slot *versionSlot, version string) int {
+	if version == "" {
+		return slot.Default
+	}
+	for _, c := range slot.Cases {
+		if c.Version == version {
+			return c.Index
+		}
+	}
+	if slot.Fallback {
+		return slot.Default
+	}
+	return -1
+}
+
+func getRouteSpec(method handlerTplParams) routeSpec {
+	route := routeSpec{
+		Method:       method.MethodName,
+		HTTPMethod:   method.Config.Method,
+		URL:          method.Config.Url,
+		Version:      method.Config.Version,
+		Auth:         method.Config.Auth,
+		Params:       []paramSpec{},
+		Consumes:     method.Config.Consumes,
+		Produces:     method.Config.Produces,
+		Deprecated:   method.Config.Deprecated,
+		DeprecatedAt: method.Config.DeprecatedAt,
+		Sunset:       method.Config.Sunset,
+		Successor:    method.Config.Successor,
+	}
+	for _, param := range method.Params {
+		in := "query"
+		for _, pathParam := range method.PathParams {
+			if pathParam.Name == param.QueryName {
+				in = "path"
+			}
+		}
+		route.Params = append(route.Params, paramSpec{Name: param.QueryName, Type: param.ParamType, In: in, Rules: param.Rules})
+	}
+	return route
+}
+
+// writeSpecs пишет спецификации версий API в dir: <Api>.json для клиентов без версии и <Api>.<version>.json
+func writeSpecs(dir string, specs []apiSpec) error {
+	for _, spec := range specs {
+		name := spec.Api + ".json"
+		if spec.Version != "" {
+			name = spec.Api + "." + spec.Version + ".json"
+		}
+		data, err := json.MarshalIndent(spec, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), append(data, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// routeNode - узел дерева маршрутов одного API. Порядок проверки детей задаёт приоритет:
+// статический сегмент, затем {param}, затем {param...}; при неудаче в более точной ветке
+// сгенерированный код откатывается к следующей
+type routeNode struct {
+	static    map[string]*routeNode
+	param     *routeNode
+	paramName string
+	// индексы маршрутов в списке методов API, -1 - маршрута нет
+	route        int
+	wildcard     int
+	wildcardName string
+}
+
+func newRouteNode() *routeNode {
+	return &routeNode{static: make(map[string]*routeNode), route: -1, wildcard: -1}
+}
+
+// addRoute добавляет url в дерево и возвращает параметры пути
+func (n *routeNode) addRoute(url string, route int) ([]pathParam, error) {
+	if !strings.HasPrefix(url, "/") {
+		return nil, fmt.Errorf("url %q must start with /", url)
+	}
+
+	params := []pathParam{}
+	segments := strings.Split(url[1:], "/")
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+			child, ok := n.static[segment]
+			if !ok {
+				child = newRouteNode()
+				n.static[segment] = child
+			}
+			n = child
+			continue
+		}
+
+		name := segment[1 : len(segment)-1]
+		if strings.HasSuffix(name, "...") {
+			name = strings.TrimSuffix(name, "...")
+			if i != len(segments)-1 {
+				return nil, fmt.Errorf("url %q: wildcard {%s...} must be the last segment", url, name)
+			}
+			if n.wildcard >= 0 {
+				return nil, fmt.Errorf("url %q conflicts with another route", url)
+			}
+			n.wildcard, n.wildcardName = route, name
+			return append(params, pathParam{Name: name, Segment: i, Wildcard: true}), nil
+		}
+
+		if n.param == nil {
+			n.param, n.paramName = newRouteNode(), name
+		} else if n.paramName != name {
+			return nil, fmt.Errorf("url %q: {%s} conflicts with {%s} of another route", url, name, n.paramName)
+		}
+		params = append(params, pathParam{Name: name, Segment: i})
+		n = n.param
+	}
+
+	if n.route >= 0 {
+		return nil, fmt.Errorf("url %q conflicts with another route", url)
+	}
+	n.route = route
+	return params, nil
+}
+
+// renderRouter генерирует match{{.ApiName}} - вложенные switch по сегментам пути,
+// которые возвращают индекс маршрута или -1
+func renderRouter(apiName string, root *routeNode) string {
+	out := new(bytes.Buffer)
+	fmt.Fprintf(out, "// match%s находит индекс маршрута для пути запроса, -1 - маршрут не найден\n", apiName)
+	fmt.Fprintf(out, "func match%s(p0 string) int {\n", apiName)
+	root.render(out, 0, "\t")
+	fmt.Fprintf(out, "\treturn -1\n}\n")
+	return out.String()
+}
+
+// render пишет проверки для узла, p<depth> - ещё не разобранная часть пути
+func (n *routeNode) render(out *bytes.Buffer, depth int, indent string) {
+	if n.route >= 0 {
+		fmt.Fprintf(out, "%sif p%d == \"\" {\n%s\treturn %d\n%s}\n", indent, depth, indent, n.route, indent)
+	}
+	if len(n.static) == 0 && n.param == nil && n.wildcard < 0 {
+		return
+	}
+
+	fmt.Fprintf(out, "%sif p%d != \"\" {\n", indent, depth)
+	inner := indent + "\t"
+	if len(n.static) > 0 || n.param != nil {
+		fmt.Fprintf(out, "%ss%d, p%d := nextSegment(p%d)\n", inner, depth, depth+1, depth)
+	}
+	if len(n.static) > 0 {
+		segments := make([]string, 0, len(n.static))
+		for segment := range n.static {
+			segments = append(segments, segment)
+		}
+		sort.Strings(segments)
+
+		fmt.Fprintf(out, "%sswitch s%d {\n", inner, depth)
+		for _, segment := range segments {
+			fmt.Fprintf(out, "%scase %q:\n", inner, segment)
+			n.static[segment].render(out, depth+1, inner+"\t")
+		}
+		fmt.Fprintf(out, "%s}\n", inner)
+	}
+	if n.param != nil {
+		fmt.Fprintf(out, "%sif s%d != \"\" {\n", inner, depth)
+		n.param.render(out, depth+1, inner+"\t")
+		fmt.Fprintf(out, "%s}\n", inner)
+	}
+	if n.wildcard >= 0 {
+		fmt.Fprintf(out, "%sreturn %d\n", inner, n.wildcard)
+	}
+	fmt.Fprintf(out, "%s}\n", indent)
+}
+
+var errorEncoders = map[string]string{
+	"legacy":  "LegacyErrorEncoder",
+	"problem": "ProblemErrorEncoder",
+}
+
+// parseErrorsMap разбирает значение флага -errors
+func parseErrorsMap(value string) map[string]int {
+	errs := make(map[string]int)
+	if value == "" {
+		return errs
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("bad errors mapping %q", item)
+		}
+		status, err := strconv.Atoi(parts[1])
+		if err != nil {
+			log.Fatalf("bad status in errors mapping %q", item)
+		}
+		errs[strings.TrimSpace(parts[0])] = status
+	}
+
+	return errs
+}
+
+// getErrorCases строит условия для switch по ошибке метода:
+// типы из исходника проверяются через errors.As, всё остальное считается sentinel-ошибкой
+func getErrorCases(global, local map[string]int, types map[string]bool) []errorCase {
+	errs := make(map[string]int, len(global)+len(local))
+	for name, status := range global {
+		errs[name] = status
+	}
+	for name, status := range local {
+		errs[name] = status
+	}
+
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	cases := make([]errorCase, 0, len(names))
+	for _, name := range names {
+		cond := fmt.Sprintf("errors.Is(err, %s)", name)
+		if types[strings.TrimPrefix(name, "*")] {
+			cond = fmt.Sprintf("errorAs[%s](err)", name)
+		}
+		cases = append(cases, errorCase{cond, errs[name]})
+	}
+
+	return cases
+}
+
+func main() {
+	flag.Parse()
+	globalErrors := parseErrorsMap(*errorsMap)
+	globalMaxBody, err := parseSize(*defaultMaxBody)
+	if err != nil {
+		log.Fatalf("bad -max-body: %v", err)
+	}
+	var globalCORS *corsConfig
+	if *corsOrigins != "" {
+		globalCORS = &corsConfig{
+			Origins:     splitList(*corsOrigins),
+			Methods:     splitList(*corsMethods),
+			Headers:     splitList(*corsHeaders),
+			Credentials: *corsCredentials,
+			MaxAge:      *corsMaxAge,
+		}
+	}
+	if _, ok := errorEncoders[*errorEncoder]; !ok {
+		log.Fatalf("unknown error encoder %q", *errorEncoder)
+	}
+	if _, ok := versionVary[*versioning]; !ok {
+		log.Fatalf("unknown versioning strategy %q", *versioning)
+	}
+	if !trailingSlashPolicies[*trailingSlash] {
+		log.Fatalf("unknown trailing slash policy %q", *trailingSlash)
+	}
+	knownEncoders := make(map[string]bool, 10)
+	for _, mediaType := range append(builtinEncoders, splitList(*extraEncoders)...) {
+		knownEncoders[mediaType] = true
+	}
+
+	paramsMap := make(map[string][]requestParam, 10)
+	handlerMap := make(map[string][]handlerTplParams, 10)
+	validateHooks := make(map[string]string, 10)
+	typeNames := make(map[string]bool, 10)
+	apiCORS := make(map[string]*corsConfig, 10)
+	// порядок API в том же виде, в каком они встретились в исходнике,
+	// чтобы результат генерации не зависел от обхода map
+	apiNames := make([]string, 0, 10)
+	paramsNames := make([]string, 0, 10)
+	seenParams := make(map[string]bool, 10)
+	apiErrorFields := map[string]string{}
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, flag.Arg(0), nil, parser.ParseComments)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out, _ := os.Create(flag.Arg(1))
+
+	fmt.Fprintln(out, `package `+node.Name.Name)
+	fmt.Fprintln(out) // empty line
+	fmt.Fprintln(out, `import "net/http"`)
+	fmt.Fprintln(out, `import "encoding/json"`)
+	fmt.Fprintln(out, `import "strconv"`)
+	fmt.Fprintln(out, `import "strings"`)
+	fmt.Fprintln(out, `import "fmt"`)
+	fmt.Fprintln(out, `import "errors"`)
+	fmt.Fprintln(out, `import "context"`)
+	fmt.Fprintln(out, `import "time"`)
+	fmt.Fprintln(out, `import "sync"`)
+	fmt.Fprintln(out, `import "sort"`)
+	fmt.Fprintln(out, `import "io"`)
+	fmt.Fprintln(out, `import "bytes"`)
+	fmt.Fprintln(out, `import "log/slog"`)
+	fmt.Fprintln(out, `import "crypto/rand"`)
+	fmt.Fprintln(out, `import "crypto/sha256"`)
+	fmt.Fprintln(out, `import "compress/gzip"`)
+	fmt.Fprintln(out, `import "compress/zlib"`)
+	fmt.Fprintln(out, `import "encoding/hex"`)
+	fmt.Fprintln(out, `import "math"`)
+	fmt.Fprintln(out, `import "net"`)
+	fmt.Fprintln(out, `import "net/url"`)
+	fmt.Fprintln(out, `import "mime"`)
+	fmt.Fprintln(out, `import "encoding/xml"`)
+	fmt.Fprintln(out, `import "unicode"`)
+	fmt.Fprintln(out, `import "slices"`)
+	fmt.Fprintln(out, `import "encoding/binary"`)
+	fmt.Fprintln(out, `import "log"`)
+	fmt.Fprintln(out, `import "runtime/debug"`)
+	fmt.Fprintln(out) // empty line
+
+	out.WriteString(`
+type Response map[string]interface{}
+
+func writeJsonResponse(w http.ResponseWriter, response interface{}, status int) {
+  jsonResponse, err := json.Marshal(response)
+  if err != nil {
+    jsonResponse = []byte(` + "`" + `{"error":"internal server error"}` + "`" + `)
+    status = http.StatusInternalServerError
+  }
+  if w.Header().Get("Content-Type") == "" {
+    w.Header().Set("Content-Type", "application/json; charset=utf-8")
+  }
+  w.WriteHeader(status)
+  if _, err := w.Write(jsonResponse); err != nil {
+    WriteErrorHook(err)
+  }
+}
+
+// ResponseEncoder кодирует ответ в один из форматов, которые клиент может запросить в Accept
+type ResponseEncoder interface {
+  ContentType() string
+  Encode(w io.Writer, v interface{}) error
+}
+
+// ResponseEncoders - известные форматы ответа по media type,
+// сюда можно добавить свой формат и указать его в produces аннотации
+var ResponseEncoders = map[string]ResponseEncoder{
+  "application/json":    JSONEncoder{},
+  "application/xml":     XMLEncoder{},
+  "application/msgpack": MsgpackEncoder{},
+}
+
+// DefaultProduces - форматы ответа методов без produces в аннотации, первый используется без Accept
+var DefaultProduces = []string{"application/json", "application/xml", "application/msgpack"}
+
+// буферы больше этого размера не возвращаются в пул, чтобы он не держал память после редких больших ответов
+const maxPooledBuffer = 64 << 10
+
+var bufferPool = sync.Pool{
+  New: func() interface{} {
+    return new(bytes.Buffer)
+  },
+}
+
+// writeResponse кодирует ответ в буфер из пула и только потом пишет заголовки,
+// поэтому при ошибке кодирования ещё можно ответить ошибкой
+func writeResponse(w http.ResponseWriter, encoder ResponseEncoder, response interface{}, status int) error {
+  buf := bufferPool.Get().(*bytes.Buffer)
+  defer releaseBuffer(buf)
+
+  if err := encoder.Encode(buf, response); err != nil {
+    return err
+  }
+  writeBody(w, encoder, buf, status)
+  return nil
+}
+
+func releaseBuffer(buf *bytes.Buffer) {
+  if buf.Cap() <= maxPooledBuffer {
+    buf.Reset()
+    bufferPool.Put(buf)
+  }
+}
+
+func writeBody(w http.ResponseWriter, encoder ResponseEncoder, buf *bytes.Buffer, status int) {
+  w.Header().Set("Content-Type", encoder.ContentType())
+  w.WriteHeader(status)
+  if _, err := w.Write(buf.Bytes()); err != nil {
+    WriteErrorHook(err)
+  }
+}
+
+// ETagger - необязательный интерфейс результата метода: своя версия ресурса для ETag
+// вместо хеша закодированного ответа. Формат ответа к версии добавляется сам,
+// а в ней допустимы только видимые ASCII-символы без кавычек и обратного слеша
+type ETagger interface {
+  ETag() string
+}
+
+// writeCachedResponse пишет ответ на GET и HEAD с Cache-Control и, если нужно, со strong ETag,
+// а при совпавшем If-None-Match отвечает 304 без тела. Ответы на остальные методы не кешируются.
+// Заголовки кеширования ставятся только вместе с ответом, чтобы 500 из-за ошибки
+// кодирования или невалидной версии ETagger-а не стал кешируемым
+func writeCachedResponse(w http.ResponseWriter, r *http.Request, encoder ResponseEncoder, response, result interface{}, status int, cacheControl string, etag bool) error {
+  if r.Method != http.MethodGet && r.Method != http.MethodHead {
+    return writeResponse(w, encoder, response, status)
+  }
+
+  tag := ""
+  if tagger, ok := result.(ETagger); ok && etag {
+    version := tagger.ETag()
+    if !validETag(version) {
+      return fmt.Errorf("invalid ETag %q of %T", version, result)
+    }
+    // одна версия ресурса в JSON и XML - разные представления
+    format := sha256.Sum256([]byte(encoder.ContentType()))
+    tag = "\"" + version + "-" + hex.EncodeToString(format[:4]) + "\""
+    // для 304 ответ не кодируется
+    if notModified(r, tag) {
+      setCacheHeaders(w, cacheControl, tag)
+      w.WriteHeader(http.StatusNotModified)
+      return nil
+    }
+  }
+
+  buf := bufferPool.Get().(*bytes.Buffer)
+  defer releaseBuffer(buf)
+  if err := encoder.Encode(buf, response); err != nil {
+    return err
+  }
+  if etag && tag == "" {
+    sum := sha256.Sum256(buf.Bytes())
+    tag = "\"" + hex.EncodeToString(sum[:16]) + "\""
+  }
+  setCacheHeaders(w, cacheControl, tag)
+  if tag != "" && notModified(r, tag) {
+    w.WriteHeader(http.StatusNotModified)
+    return nil
+  }
+  writeBody(w, encoder, buf, status)
+  return nil
+}
+
+// setCacheHeaders ставит заголовки кеширования ответа, tag = "" - без ETag
+func setCacheHeaders(w http.ResponseWriter, cacheControl, tag string) {
+  header := w.Header()
+  header.Set("Cache-Control", cacheControl)
+  header.Add("Vary", "Accept")
+  if tag != "" {
+    header.Set("ETag", tag)
+  }
+}
+
+// validETag проверяет, что версию можно поставить в кавычки ETag как есть.
+// Обратный слеш etagc из RFC 9110 допускает, но клиенты и прокси принимают его за экранирование
+func validETag(version string) bool {
+  if version == "" {
+    return false
+  }
+  for i := 0; i < len(version); i++ {
+    if c := version[i]; c <= ' ' || c == '"' || c == '\\' || c >= 0x7f {
+      return false
+    }
+  }
+  return true
+}
+
+// notModified сообщает, есть ли ETag в If-None-Match запроса, 304 пишет вызывающий
+func notModified(r *http.Request, tag string) bool {
+  for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+    candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+    if candidate == tag || candidate == "*" {
+      return true
+    }
+  }
+  return false
+}
+
+// writeErrorResponse пишет ответ с ошибкой, а если его не удалось закодировать -
+// хотя бы текст ошибки в JSON
+func writeErrorResponse(w http.ResponseWriter, encoder ResponseEncoder, response Response, status int) {
+  if err := writeResponse(w, encoder, response, status); err != nil {
+    writeJsonResponse(w, Response{"error": response["error"]}, status)
+  }
+}
+
+// negotiate выбирает формат ответа из produces по заголовку Accept с учётом q,
+// при равном q побеждает формат, стоящий раньше в produces
+func negotiate(r *http.Request, produces []string) (ResponseEncoder, bool) {
+  accept := r.Header.Get("Accept")
+  var best ResponseEncoder
+  bestQ := 0.0
+  for _, mediaType := range produces {
+    encoder, ok := ResponseEncoders[mediaType]
+    if !ok {
+      // формат убрали из ResponseEncoders после генерации
+      continue
+    }
+    q := 1.0
+    if accept != "" {
+      q = acceptQuality(accept, mediaType)
+    }
+    if q > bestQ {
+      best, bestQ = encoder, q
+    }
+  }
+  return best, best != nil
+}
+
+// acceptQuality возвращает q самой точной записи Accept, подходящей под mediaType
+func acceptQuality(accept, mediaType string) float64 {
+  q, specificity := 0.0, -1
+  for _, item := range strings.Split(accept, ",") {
+    accepted, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+    if err != nil {
+      continue
+    }
+
+    current := -1
+    switch {
+    case accepted == mediaType:
+      current = 2
+    case strings.HasSuffix(accepted, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(accepted, "*")):
+      current = 1
+    case accepted == "*/*":
+      current = 0
+    }
+    if current <= specificity {
+      continue
+    }
+
+    specificity, q = current, 1.0
+    if value, ok := params["q"]; ok {
+      if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+        q = parsed
+      }
+    }
+  }
+  return q
+}
+
+// JSONEncoder - ответ в JSON
+type JSONEncoder struct{}
+
+func (JSONEncoder) ContentType() string {
+  return "application/json; charset=utf-8"
+}
+
+func (JSONEncoder) Encode(w io.Writer, v interface{}) error {
+  return json.NewEncoder(w).Encode(v)
+}
+
+// jsonTree переводит ответ в дерево из map, slice и скаляров так же, как его видит JSON,
+// чтобы XML и MessagePack учитывали json-теги структур
+func jsonTree(v interface{}) (interface{}, error) {
+  data, err := json.Marshal(v)
+  if err != nil {
+    return nil, err
+  }
+  decoder := json.NewDecoder(bytes.NewReader(data))
+  decoder.UseNumber()
+  var tree interface{}
+  err = decoder.Decode(&tree)
+  return tree, err
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+  keys := make([]string, 0, len(m))
+  for key := range m {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  return keys
+}
+
+// XMLEncoder - ответ в XML: объекты становятся элементами с именами ключей,
+// элементы массивов - элементами item
+type XMLEncoder struct{}
+
+func (XMLEncoder) ContentType() string {
+  return "application/xml; charset=utf-8"
+}
+
+func (XMLEncoder) Encode(w io.Writer, v interface{}) error {
+  tree, err := jsonTree(v)
+  if err != nil {
+    return err
+  }
+  buf := &bytes.Buffer{}
+  buf.WriteString(xml.Header)
+  writeXMLNode(buf, "response", tree)
+  _, err = w.Write(buf.Bytes())
+  return err
+}
+
+func writeXMLNode(buf *bytes.Buffer, name string, node interface{}) {
+  buf.WriteString("<" + name + ">")
+  writeXMLValue(buf, node)
+  buf.WriteString("</" + name + ">")
+}
+
+func writeXMLValue(buf *bytes.Buffer, node interface{}) {
+  switch value := node.(type) {
+  case map[string]interface{}:
+    for _, key := range sortedKeys(value) {
+      if xmlName(key) {
+        writeXMLNode(buf, key, value[key])
+        continue
+      }
+      // ключ, который не годится в имя элемента, уходит в атрибут
+      buf.WriteString("<entry key=\"")
+      xml.EscapeText(buf, []byte(key))
+      buf.WriteString("\">")
+      writeXMLValue(buf, value[key])
+      buf.WriteString("</entry>")
+    }
+  case []interface{}:
+    for _, item := range value {
+      writeXMLNode(buf, "item", item)
+    }
+  case string:
+    xml.EscapeText(buf, []byte(value))
+  case nil:
+  default:
+    fmt.Fprint(buf, value)
+  }
+}
+
+// xmlName проверяет, что ключ объекта можно записать именем элемента XML как есть
+func xmlName(key string) bool {
+  if key == "" || strings.HasPrefix(strings.ToLower(key), "xml") {
+    return false
+  }
+  for i, c := range key {
+    switch {
+    case c == '_' || unicode.IsLetter(c):
+    case i > 0 && (c == '-' || c == '.' || unicode.IsDigit(c)):
+    default:
+      return false
+    }
+  }
+  return true
+}
+
+// MsgpackEncoder - ответ в MessagePack, ключи объектов отсортированы
+type MsgpackEncoder struct{}
+
+func (MsgpackEncoder) ContentType() string {
+  return "application/msgpack"
+}
+
+func (MsgpackEncoder) Encode(w io.Writer, v interface{}) error {
+  tree, err := jsonTree(v)
+  if err != nil {
+    return err
+  }
+  buf := &bytes.Buffer{}
+  writeMsgpack(buf, tree)
+  _, err = w.Write(buf.Bytes())
+  return err
+}
+
+func writeMsgpackHeader(buf *bytes.Buffer, size int, fix byte, fixLimit int, codes [3]byte) {
+  switch {
+  case size < fixLimit:
+    buf.WriteByte(fix | byte(size))
+  case codes[0] != 0 && size <= math.MaxUint8:
+    buf.WriteByte(codes[0])
+    buf.WriteByte(byte(size))
+  case size <= math.MaxUint16:
+    buf.WriteByte(codes[1])
+    binary.Write(buf, binary.BigEndian, uint16(size))
+  default:
+    buf.WriteByte(codes[2])
+    binary.Write(buf, binary.BigEndian, uint32(size))
+  }
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, num int64) {
+  switch {
+  case num >= 0 && num < 128:
+    buf.WriteByte(byte(num))
+  case num >= -32 && num < 0:
+    buf.WriteByte(byte(int8(num)))
+  case num >= 0 && num <= math.MaxUint8:
+    buf.WriteByte(0xcc)
+    buf.WriteByte(byte(num))
+  case num >= 0 && num <= math.MaxUint16:
+    buf.WriteByte(0xcd)
+    binary.Write(buf, binary.BigEndian, uint16(num))
+  case num >= 0 && num <= math.MaxUint32:
+    buf.WriteByte(0xce)
+    binary.Write(buf, binary.BigEndian, uint32(num))
+  case num >= 0:
+    buf.WriteByte(0xcf)
+    binary.Write(buf, binary.BigEndian, uint64(num))
+  case num >= math.MinInt8:
+    buf.WriteByte(0xd0)
+    buf.WriteByte(byte(int8(num)))
+  case num >= math.MinInt16:
+    buf.WriteByte(0xd1)
+    binary.Write(buf, binary.BigEndian, int16(num))
+  case num >= math.MinInt32:
+    buf.WriteByte(0xd2)
+    binary.Write(buf, binary.BigEndian, int32(num))
+  default:
+    buf.WriteByte(0xd3)
+    binary.Write(buf, binary.BigEndian, num)
+  }
+}
+
+func writeMsgpack(buf *bytes.Buffer, node interface{}) {
+  switch value := node.(type) {
+  case nil:
+    buf.WriteByte(0xc0)
+  case bool:
+    if value {
+      buf.WriteByte(0xc3)
+    } else {
+      buf.WriteByte(0xc2)
+    }
+  case json.Number:
+    if num, err := value.Int64(); err == nil {
+      writeMsgpackInt(buf, num)
+      return
+    }
+    num, _ := value.Float64()
+    buf.WriteByte(0xcb)
+    binary.Write(buf, binary.BigEndian, num)
+  case string:
+    writeMsgpackHeader(buf, len(value), 0xa0, 32, [3]byte{0xd9, 0xda, 0xdb})
+    buf.WriteString(value)
+  case []interface{}:
+    writeMsgpackHeader(buf, len(value), 0x90, 16, [3]byte{0, 0xdc, 0xdd})
+    for _, item := range value {
+      writeMsgpack(buf, item)
+    }
+  case map[string]interface{}:
+    writeMsgpackHeader(buf, len(value), 0x80, 16, [3]byte{0, 0xde, 0xdf})
+    for _, key := range sortedKeys(value) {
+      writeMsgpack(buf, key)
+      writeMsgpack(buf, value[key])
+    }
+  }
+}
+
+// PanicHook получает панику из сгенерированного обработчика вместе со стеком
+var PanicHook = func(r *http.Request, recovered interface{}, stack []byte) {
+  log.Printf("panic serving %s: %v\n%s", r.URL.Path, recovered, stack)
+}
+
+// WriteErrorHook получает ошибки записи ответа клиенту, а также ошибки кодирования ответа,
+// о которых клиент узнаёт только как о 500
+var WriteErrorHook = func(err error) {
+  log.Printf("write response: %v", err)
+}
+
+// recoverPanic превращает панику в ответ 500 в стандартном формате ошибок
+func recoverPanic(w http.ResponseWriter, r *http.Request) {
+  recovered := recover()
+  if recovered == nil {
+    return
+  }
+  if recovered == http.ErrAbortHandler {
+    panic(recovered)
+  }
+  stack := debug.Stack()
+  if gp, ok := recovered.(goroutinePanic); ok {
+    recovered, stack = gp.value, gp.stack
+  }
+  PanicHook(r, recovered, stack)
+  writeError(w, r, http.StatusInternalServerError, errors.New("internal server error"))
+}
+
+// RouteInfo описывает метод API, для которого сгенерирован обработчик
+type RouteInfo struct {
+  Api        string
+  URL        string
+  // пустая строка - метод принимает любой HTTP-метод
+  HTTPMethod string
+  MethodName string
+  Auth       bool
+  // версия из аннотации, пустая строка - метод без версии
+  Version string
+  // метод устарел; Deprecation - значение одноимённого заголовка "@<unix-время>",
+  // Sunset - дата отключения в формате HTTP-date, Successor - Url замены
+  Deprecated  bool
+  Deprecation string
+  Sunset      string
+  Successor   string
+}
+
+// CallFunc вызывает следующий перехватчик в цепочке или сам метод API
+type CallFunc func(ctx context.Context) (interface{}, error)
+
+// Interceptor вызывается вокруг метода API после заполнения и валидации параметров,
+// params - указатель на структуру параметров метода, например *CreateParams.
+// Ошибка перехватчика обрабатывается так же, как ошибка метода
+type Interceptor func(ctx context.Context, route RouteInfo, params interface{}, next CallFunc) (interface{}, error)
+
+func intercept(ctx context.Context, route RouteInfo, params interface{}, interceptors []Interceptor, call CallFunc) (interface{}, error) {
+  if len(interceptors) == 0 {
+    return call(ctx)
+  }
+  return interceptors[0](ctx, route, params, func(ctx context.Context) (interface{}, error) {
+    return intercept(ctx, route, params, interceptors[1:], call)
+  })
+}
+
+// statusRecorder запоминает статус ответа для метрик и логов
+type statusRecorder struct {
+  http.ResponseWriter
+  status      int
+  wroteHeader bool
+  // ошибка, с которой завершился запрос
+  err error
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+  if !rec.wroteHeader {
+    rec.status = status
+    rec.wroteHeader = true
+  }
+  rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(data []byte) (int, error) {
+  rec.wroteHeader = true
+  return rec.ResponseWriter.Write(data)
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+  return rec.ResponseWriter
+}
+
+// AccessLog - логгер для access-логов сгенерированных обработчиков, nil отключает их
+var AccessLog *slog.Logger
+
+// PrincipalFunc возвращает пользователя запроса для access-лога, лимитов и ключей идемпотентности,
+// пустая строка - аноним. По умолчанию пользователь определяется токеном X-Auth,
+// в лог попадает только начало его хеша
+var PrincipalFunc = func(r *http.Request) string {
+  token := r.Header.Get("X-Auth")
+  if token == "" {
+    return ""
+  }
+  sum := sha256.Sum256([]byte(token))
+  return "x-auth:" + hex.EncodeToString(sum[:8])
+}
+
+func logAccess(r *http.Request, route RouteInfo, rec *statusRecorder, latency time.Duration) {
+  if AccessLog == nil {
+    return
+  }
+
+  attrs := []slog.Attr{
+    slog.String("request_id", RequestIDFromContext(r.Context())),
+    slog.String("api", route.Api),
+    slog.String("route", r.URL.Path),
+    slog.String("method", route.MethodName),
+    slog.String("http_method", r.Method),
+    slog.Int("status", rec.status),
+    slog.Duration("latency", latency),
+  }
+  if principal := PrincipalFunc(r); principal != "" {
+    attrs = append(attrs, slog.String("principal", principal))
+  }
+  if route.Deprecated {
+    attrs = append(attrs, slog.Bool("deprecated", true))
+  }
+  if rec.err != nil {
+    var fieldErr FieldError
+    var fieldErrs ValidationErrors
+    if errors.As(rec.err, &fieldErr) || errors.As(rec.err, &fieldErrs) {
+      attrs = append(attrs, slog.String("validation", rec.err.Error()))
+    } else {
+      attrs = append(attrs, slog.String("error", rec.err.Error()))
+    }
+  }
+
+  level := slog.LevelInfo
+  if rec.status >= 500 {
+    level = slog.LevelError
+  }
+  AccessLog.LogAttrs(r.Context(), level, "api request", attrs...)
+}
+
+// SpanContext - контекст трассировки в терминах W3C Trace Context
+type SpanContext struct {
+  TraceID string
+  SpanID  string
+  Sampled bool
+}
+
+// Traceparent возвращает значение заголовка traceparent для исходящих запросов
+func (sc SpanContext) Traceparent() string {
+  flags := "00"
+  if sc.Sampled {
+    flags = "01"
+  }
+  return "00-" + sc.TraceID + "-" + sc.SpanID + "-" + flags
+}
+
+// Span - вызов одного метода API
+type Span struct {
+  // имя span-а - url метода API
+  Name         string
+  Context      SpanContext
+  ParentSpanID string
+  Start        time.Time
+  End          time.Time
+  Attributes   map[string]string
+  Status       int
+  Err          string
+}
+
+// SpanExporter получает завершённые span-ы
+type SpanExporter interface {
+  ExportSpan(span Span)
+}
+
+// Tracer - куда отправлять span-ы, nil отключает трассировку
+var Tracer SpanExporter
+
+// InMemorySpanExporter хранит span-ы в памяти, например для тестов
+type InMemorySpanExporter struct {
+  mu    sync.Mutex
+  spans []Span
+}
+
+func (e *InMemorySpanExporter) ExportSpan(span Span) {
+  e.mu.Lock()
+  e.spans = append(e.spans, span)
+  e.mu.Unlock()
+}
+
+// Spans возвращает копию всех экспортированных span-ов
+func (e *InMemorySpanExporter) Spans() []Span {
+  e.mu.Lock()
+  defer e.mu.Unlock()
+  return append([]Span(nil), e.spans...)
+}
+
+type spanContextKey struct{}
+
+// SpanContextFromContext возвращает контекст трассировки из ctx, который передаётся в методы API
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+  sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+  return sc, ok
+}
+
+// parseTraceparent разбирает заголовок traceparent версии 00
+func parseTraceparent(value string) (SpanContext, bool) {
+  parts := strings.Split(value, "-")
+  if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+    return SpanContext{}, false
+  }
+  for _, part := range parts[1:] {
+    if _, err := hex.DecodeString(part); err != nil {
+      return SpanContext{}, false
+    }
+  }
+  // нулевые trace-id и span-id недопустимы
+  if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+    return SpanContext{}, false
+  }
+  flags, _ := hex.DecodeString(parts[3])
+  return SpanContext{TraceID: parts[1], SpanID: parts[2], Sampled: flags[0]&1 == 1}, true
+}
+
+func randomHex(size int) string {
+  buf := make([]byte, size)
+  rand.Read(buf)
+  return hex.EncodeToString(buf)
+}
+
+// startSpan продолжает трассу из заголовка traceparent или начинает новую
+// и кладёт контекст нового span-а в контекст запроса
+func startSpan(r *http.Request) (*http.Request, *Span) {
+  if Tracer == nil {
+    return r, nil
+  }
+
+  span := &Span{
+    Context: SpanContext{SpanID: randomHex(8), Sampled: true},
+    Start:   time.Now(),
+  }
+  if parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+    span.Context.TraceID = parent.TraceID
+    span.Context.Sampled = parent.Sampled
+    span.ParentSpanID = parent.SpanID
+  } else {
+    span.Context.TraceID = randomHex(16)
+  }
+
+  return r.WithContext(context.WithValue(r.Context(), spanContextKey{}, span.Context)), span
+}
+
+// finishSpan экспортирует span, если трасса сэмплирована: с родителем -00 контекст
+// передаётся в метод и дальше, но сам span не отправляется
+func finishSpan(span *Span, route RouteInfo, rec *statusRecorder) {
+  if span == nil || Tracer == nil || !span.Context.Sampled {
+    return
+  }
+
+  span.Name = route.URL
+  if span.Name == "" {
+    span.Name = route.MethodName
+  }
+  span.End = time.Now()
+  span.Status = rec.status
+  span.Attributes = map[string]string{
+    "api":    route.Api,
+    "method": route.MethodName,
+  }
+  if rec.err != nil {
+    span.Err = rec.err.Error()
+  }
+  Tracer.ExportSpan(*span)
+}
+
+// RateLimiter решает, можно ли выполнить ещё один запрос с ключом key при лимите
+// rate запросов в секунду и всплеске до burst; при отказе возвращает, через сколько повторить
+type RateLimiter interface {
+  Allow(key string, rate float64, burst int) (bool, time.Duration)
+}
+
+// RateLimitStore хранит состояние лимитов всех методов API,
+// его можно заменить распределённой реализацией RateLimiter.
+// Корзина определяется API, маршрутом из аннотации и клиентом, но не экземпляром:
+// экземпляры API и их монтирования в Mux расходуют один лимит, как и процессы
+// за общим распределённым хранилищем
+var RateLimitStore RateLimiter = NewTokenBucketLimiter()
+
+type tokenBucket struct {
+  tokens float64
+  last   time.Time
+  // за сколько пустая корзина заполняется до burst
+  refill time.Duration
+}
+
+// TokenBucketLimiter - RateLimiter в памяти процесса по алгоритму token bucket
+type TokenBucketLimiter struct {
+  // Now - текущее время, подменяется в тестах
+  Now func() time.Time
+
+  mu      sync.Mutex
+  buckets map[string]*tokenBucket
+  calls   int
+}
+
+func NewTokenBucketLimiter() *TokenBucketLimiter {
+  return &TokenBucketLimiter{
+    Now:     time.Now,
+    buckets: make(map[string]*tokenBucket),
+  }
+}
+
+func (l *TokenBucketLimiter) Allow(key string, rate float64, burst int) (bool, time.Duration) {
+  now := l.Now()
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  l.calls++
+  if l.calls%1024 == 0 {
+    l.sweep(now)
+  }
+
+  bucket, ok := l.buckets[key]
+  if !ok {
+    refill := time.Duration(float64(burst) / rate * float64(time.Second))
+    bucket = &tokenBucket{tokens: float64(burst), last: now, refill: refill}
+    l.buckets[key] = bucket
+  }
+
+  bucket.tokens = math.Min(float64(burst), bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+  bucket.last = now
+  if bucket.tokens >= 1 {
+    bucket.tokens--
+    return true, 0
+  }
+
+  return false, time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+}
+
+// sweep удаляет корзины, которые успели бы заполниться до конца,
+// чтобы map не рос от разовых клиентов
+func (l *TokenBucketLimiter) sweep(now time.Time) {
+  for key, bucket := range l.buckets {
+    if now.Sub(bucket.last) > bucket.refill {
+      delete(l.buckets, key)
+    }
+  }
+}
+
+// CompressMinSize - ответы меньше этого размера в байтах отдаются без сжатия
+var CompressMinSize = 1024
+
+// compressor - gzip.Writer или zlib.Writer, которые можно переиспользовать через Reset
+type compressor interface {
+  io.WriteCloser
+  Reset(w io.Writer)
+}
+
+// compressors - пулы writer-ов по content-coding; deflate в HTTP - это формат zlib
+var compressors = map[string]*sync.Pool{
+  "gzip": {New: func() interface{} {
+    return gzip.NewWriter(io.Discard)
+  }},
+  "deflate": {New: func() interface{} {
+    return zlib.NewWriter(io.Discard)
+  }},
+}
+
+// incompressibleTypes - уже сжатые форматы, которые не стоит сжимать ещё раз
+var incompressibleTypes = map[string]bool{
+  "application/gzip":             true,
+  "application/x-gzip":           true,
+  "application/zip":              true,
+  "application/zstd":             true,
+  "application/x-7z-compressed":  true,
+  "application/x-rar-compressed": true,
+  "font/woff":                    true,
+  "font/woff2":                   true,
+}
+
+func compressible(contentType string) bool {
+  mediaType, _, err := mime.ParseMediaType(contentType)
+  if err != nil {
+    return contentType == ""
+  }
+  if mediaType == "image/svg+xml" {
+    return true
+  }
+  for _, prefix := range []string{"image/", "video/", "audio/"} {
+    if strings.HasPrefix(mediaType, prefix) {
+      return false
+    }
+  }
+  return !incompressibleTypes[mediaType]
+}
+
+// negotiateEncoding выбирает gzip или deflate по Accept-Encoding с учётом q,
+// при равном q предпочитается gzip; пустая строка - ответ без сжатия
+func negotiateEncoding(acceptEncoding string) string {
+  qualities := make(map[string]float64, 3)
+  for _, item := range strings.Split(acceptEncoding, ",") {
+    coding, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+    coding = strings.ToLower(strings.TrimSpace(coding))
+    if coding == "" {
+      continue
+    }
+
+    q := 1.0
+    if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+      if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+        q = parsed
+      }
+    }
+    qualities[coding] = q
+  }
+
+  best, bestQ := "", 0.0
+  for _, coding := range []string{"gzip", "deflate"} {
+    // явно указанный coding важнее "*"
+    q, ok := qualities[coding]
+    if !ok {
+      q = qualities["*"]
+    }
+    if q > bestQ {
+      best, bestQ = coding, q
+    }
+  }
+  return best
+}
+
+// compressWriter копит начало ответа до CompressMinSize и только потом решает,
+// сжимать ли его: маленькие, уже сжатые и пустые ответы уходят как есть
+type compressWriter struct {
+  http.ResponseWriter
+  encoding string
+  status   int
+  buf      []byte
+  decided  bool
+  writer   compressor
+}
+
+// newCompressWriter добавляет Vary: Accept-Encoding и возвращает обёртку над w,
+// если клиент принимает gzip или deflate, иначе nil
+func newCompressWriter(w http.ResponseWriter, r *http.Request) *compressWriter {
+  w.Header().Add("Vary", "Accept-Encoding")
+  encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+  if encoding == "" {
+    return nil
+  }
+  return &compressWriter{ResponseWriter: w, encoding: encoding}
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+  if status < 200 {
+    cw.ResponseWriter.WriteHeader(status)
+    return
+  }
+  if cw.status == 0 {
+    cw.status = status
+  }
+}
+
+func (cw *compressWriter) Write(data []byte) (int, error) {
+  if cw.status == 0 {
+    cw.status = http.StatusOK
+  }
+  if !cw.decided {
+    if len(cw.buf)+len(data) < CompressMinSize {
+      cw.buf = append(cw.buf, data...)
+      return len(data), nil
+    }
+    if err := cw.decide(true); err != nil {
+      return 0, err
+    }
+  }
+  if cw.writer != nil {
+    return cw.writer.Write(data)
+  }
+  return cw.ResponseWriter.Write(data)
+}
+
+// decide пишет заголовки и накопленное начало ответа, сжимая его, если large
+// и формат ответа того стоит
+func (cw *compressWriter) decide(large bool) error {
+  cw.decided = true
+  header := cw.Header()
+  if large && header.Get("Content-Encoding") == "" && compressible(header.Get("Content-Type")) &&
+    cw.status != http.StatusNoContent && cw.status != http.StatusNotModified {
+    header.Set("Content-Encoding", cw.encoding)
+    header.Del("Content-Length")
+    // сжатое тело отличается от того, по которому считался strong ETag
+    if etag := header.Get("ETag"); strings.HasPrefix(etag, "\"") {
+      header.Set("ETag", "W/"+etag)
+    }
+    cw.writer = compressors[cw.encoding].Get().(compressor)
+    cw.writer.Reset(cw.ResponseWriter)
+  }
+  cw.ResponseWriter.WriteHeader(cw.status)
+
+  buf := cw.buf
+  cw.buf = nil
+  if len(buf) == 0 {
+    return nil
+  }
+  var err error
+  if cw.writer != nil {
+    _, err = cw.writer.Write(buf)
+  } else {
+    _, err = cw.ResponseWriter.Write(buf)
+  }
+  return err
+}
+
+// Close дописывает ответ и возвращает writer в пул
+func (cw *compressWriter) Close() {
+  if !cw.decided {
+    if cw.status == 0 {
+      // ответ не начат, например метод запаниковал - пусть отвечает recoverPanic
+      return
+    }
+    if err := cw.decide(false); err != nil {
+      WriteErrorHook(err)
+    }
+  }
+  if cw.writer == nil {
+    return
+  }
+  if err := cw.writer.Close(); err != nil {
+    WriteErrorHook(err)
+  }
+  cw.writer.Reset(io.Discard)
+  compressors[cw.encoding].Put(cw.writer)
+  cw.writer = nil
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+  return cw.ResponseWriter
+}
+
+// IdempotencyKeyHeader - заголовок с ключом идемпотентности запроса
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+var (
+  // ErrIdempotencyKeyInUse - запрос с этим ключом ещё выполняется
+  ErrIdempotencyKeyInUse = errors.New("request with this idempotency key is in progress")
+  // ErrIdempotencyKeyMismatch - ключ уже использован с другими параметрами
+  ErrIdempotencyKeyMismatch = errors.New("idempotency key was used with different params")
+)
+
+// StoredResponse - сохранённый ответ на первый запрос с ключом идемпотентности
+type StoredResponse struct {
+  Status int
+  Header http.Header
+  Body   []byte
+}
+
+// IdempotencyStore хранит ответы методов с "idempotent": true по ключам идемпотентности.
+// Begin занимает свободный ключ и возвращает nil, nil; для ключа с сохранённым ответом
+// возвращает этот ответ, а для занятого ключа - ErrIdempotencyKeyInUse или,
+// если отпечаток параметров другой, ErrIdempotencyKeyMismatch.
+// Save сохраняет ответ занятого ключа, Release освобождает ключ без ответа
+type IdempotencyStore interface {
+  Begin(key, fingerprint string) (*StoredResponse, error)
+  Save(key string, response StoredResponse)
+  Release(key string)
+}
+
+// IdempotencyResponses хранит ответы всех методов API,
+// его можно заменить распределённой реализацией IdempotencyStore
+var IdempotencyResponses IdempotencyStore = NewMemoryIdempotencyStore(24 * time.Hour)
+
+type idempotencyEntry struct {
+  fingerprint string
+  // nil - запрос ещё выполняется
+  response *StoredResponse
+  expires  time.Time
+}
+
+// MemoryIdempotencyStore - IdempotencyStore в памяти процесса, ключи живут TTL
+type MemoryIdempotencyStore struct {
+  TTL time.Duration
+  // Now - текущее время, подменяется в тестах
+  Now func() time.Time
+
+  mu      sync.Mutex
+  entries map[string]*idempotencyEntry
+  calls   int
+}
+
+func NewMemoryIdempotencyStore(ttl time.Duration) *MemoryIdempotencyStore {
+  return &MemoryIdempotencyStore{
+    TTL:     ttl,
+    Now:     time.Now,
+    entries: make(map[string]*idempotencyEntry),
+  }
+}
+
+func (s *MemoryIdempotencyStore) Begin(key, fingerprint string) (*StoredResponse, error) {
+  now := s.Now()
+
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.calls++
+  if s.calls%1024 == 0 {
+    s.sweep(now)
+  }
+
+  entry, ok := s.entries[key]
+  if !ok || now.After(entry.expires) {
+    s.entries[key] = &idempotencyEntry{fingerprint: fingerprint, expires: now.Add(s.TTL)}
+    return nil, nil
+  }
+  if entry.fingerprint != fingerprint {
+    return nil, ErrIdempotencyKeyMismatch
+  }
+  if entry.response == nil {
+    return nil, ErrIdempotencyKeyInUse
+  }
+  return entry.response, nil
+}
+
+func (s *MemoryIdempotencyStore) Save(key string, response StoredResponse) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if entry, ok := s.entries[key]; ok {
+    entry.response = &response
+    entry.expires = s.Now().Add(s.TTL)
+  }
+}
+
+func (s *MemoryIdempotencyStore) Release(key string) {
+  s.mu.Lock()
+  delete(s.entries, key)
+  s.mu.Unlock()
+}
+
+// sweep удаляет ключи с истёкшим TTL, чтобы map не рос от разовых клиентов
+func (s *MemoryIdempotencyStore) sweep(now time.Time) {
+  for key, entry := range s.entries {
+    if now.After(entry.expires) {
+      delete(s.entries, key)
+    }
+  }
+}
+
+// idempotencyRecorder запоминает ответ метода, чтобы сохранить его по ключу идемпотентности
+type idempotencyRecorder struct {
+  http.ResponseWriter
+  key    string
+  status int
+  body   bytes.Buffer
+  // ответ сохранит recorder из detach
+  detached bool
+}
+
+// beginIdempotent занимает ключ идемпотентности запроса. Если ответ уже готов -
+// повторяет его, если ключ занят или использован с другими параметрами - отвечает
+// 409 или 422; в этих случаях done = true и метод вызывать не нужно
+func beginIdempotent(w http.ResponseWriter, r *http.Request, route RouteInfo, key string) (*idempotencyRecorder, bool) {
+  // у анонимов одно пространство ключей, и чужой ключ отдал бы чужой ответ
+  principal := PrincipalFunc(r)
+  if principal == "" {
+    writeError(w, r, http.StatusBadRequest, errors.New(IdempotencyKeyHeader+" requires an authenticated client"))
+    return nil, true
+  }
+  // ключи разных методов и пользователей не пересекаются
+  key = route.Api + "." + route.MethodName + " " + principal + " " + key
+  sum := sha256.Sum256([]byte(r.Method + " " + r.URL.Path + "?" + r.Form.Encode()))
+
+  stored, err := IdempotencyResponses.Begin(key, hex.EncodeToString(sum[:]))
+  switch {
+  case errors.Is(err, ErrIdempotencyKeyMismatch):
+    writeError(w, r, http.StatusUnprocessableEntity, err)
+    return nil, true
+  case err != nil:
+    writeError(w, r, http.StatusConflict, err)
+    return nil, true
+  case stored != nil:
+    // заголовки, которые уже выставил этот запрос (CORS, Deprecation), остаются его, Vary объединяется
+    header := w.Header()
+    for name, values := range stored.Header {
+      current, ok := header[name]
+      switch {
+      case !ok:
+        header[name] = values
+      case name == "Vary":
+        for _, value := range values {
+          if !slices.Contains(current, value) {
+            header.Add("Vary", value)
+          }
+        }
+      }
+    }
+    w.Header().Set("Idempotent-Replayed", "true")
+    w.WriteHeader(stored.Status)
+    if _, err := w.Write(stored.Body); err != nil {
+      WriteErrorHook(err)
+    }
+    return nil, true
+  }
+  return &idempotencyRecorder{ResponseWriter: w, key: key}, false
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+  rec.status = status
+  rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(data []byte) (int, error) {
+  if rec.status == 0 {
+    rec.status = http.StatusOK
+  }
+  rec.body.Write(data)
+  return rec.ResponseWriter.Write(data)
+}
+
+func (rec *idempotencyRecorder) Unwrap() http.ResponseWriter {
+  return rec.ResponseWriter
+}
+
+// detach оставляет ключ занятым после ответа клиенту и возвращает recorder,
+// в который запишется и по ключу сохранится ответ метода, когда тот завершится
+func (rec *idempotencyRecorder) detach() *idempotencyRecorder {
+  rec.detached = true
+  return &idempotencyRecorder{
+    ResponseWriter: &detachedResponse{header: rec.Header().Clone()},
+    key:            rec.key,
+  }
+}
+
+// finish сохраняет ответ метода. Ответы 5xx, 499 и паника не сохраняются,
+// чтобы повтор с тем же ключом мог выполнить метод ещё раз
+func (rec *idempotencyRecorder) finish() {
+  if rec.detached {
+    return
+  }
+  if rec.status == 0 || rec.status >= 500 || rec.status == StatusClientClosedRequest {
+    IdempotencyResponses.Release(rec.key)
+    return
+  }
+
+  header := rec.Header().Clone()
+  header.Del(RequestIDHeader)
+  // CORS зависит от Origin повтора, его заголовки повтор ставит сам
+  for name := range header {
+    if strings.HasPrefix(name, "Access-Control-") {
+      delete(header, name)
+    }
+  }
+  // сохраняется несжатое тело, повтор сожмётся по Accept-Encoding нового запроса
+  header.Del("Content-Encoding")
+  IdempotencyResponses.Save(rec.key, StoredResponse{
+    Status: rec.status,
+    Header: header,
+    Body:   bytes.Clone(rec.body.Bytes()),
+  })
+}
+
+// detachedResponse принимает ответ метода, который завершился уже после ответа клиенту
+type detachedResponse struct {
+  header http.Header
+}
+
+func (d *detachedResponse) Header() http.Header {
+  return d.header
+}
+
+func (d *detachedResponse) Write(data []byte) (int, error) {
+  return len(data), nil
+}
+
+func (d *detachedResponse) WriteHeader(int) {}
+
+// rateLimitKey возвращает клиента запроса для лимита: ip, principal или header:<имя>
+func rateLimitKey(r *http.Request, key string) string {
+  client := ""
+  switch {
+  case key == "principal":
+    client = PrincipalFunc(r)
+  case strings.HasPrefix(key, "header:"):
+    client = r.Header.Get(strings.TrimPrefix(key, "header:"))
+  }
+  if client != "" {
+    return key + "=" + client
+  }
+
+  // без principal-а или заголовка ограничиваем по ip
+  host, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil {
+    host = r.RemoteAddr
+  }
+  return "ip=" + host
+}
+
+// allowRequest проверяет лимит метода API и отвечает 429, если он исчерпан
+func allowRequest(w http.ResponseWriter, r *http.Request, route RouteInfo, rate float64, burst int, key string) bool {
+  ok, retryAfter := RateLimitStore.Allow(route.Api+" "+route.URL+" "+rateLimitKey(r, key), rate, burst)
+  if ok {
+    return true
+  }
+  w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+  writeError(w, r, http.StatusTooManyRequests, errors.New("rate limit exceeded"))
+  return false
+}
+
+// CORSConfig - настройки CORS метода API
+type CORSConfig struct {
+  // "*" - любой источник
+  Origins []string
+  // пустой список - HTTP-метод из аннотации, для методов без него GET и POST
+  Methods     []string
+  Headers     []string
+  Credentials bool
+  // в секундах, 0 - не отправлять Access-Control-Max-Age
+  MaxAge int
+}
+
+func (c *CORSConfig) allowedOrigin(origin string) string {
+  for _, allowed := range c.Origins {
+    if allowed == origin {
+      return origin
+    }
+    if allowed == "*" {
+      return "*"
+    }
+  }
+  return ""
+}
+
+func (c *CORSConfig) allowedMethods(route RouteInfo) []string {
+  if len(c.Methods) > 0 {
+    return c.Methods
+  }
+  if route.HTTPMethod != "" {
+    return []string{route.HTTPMethod}
+  }
+  return []string{http.MethodGet, http.MethodPost}
+}
+
+// handleCORS добавляет CORS-заголовки к ответу и сам отвечает на preflight-запрос,
+// возвращает true, если запрос уже обработан
+func handleCORS(w http.ResponseWriter, r *http.Request, route RouteInfo, cors *CORSConfig) bool {
+  origin := r.Header.Get("Origin")
+  if origin == "" {
+    return false
+  }
+
+  w.Header().Add("Vary", "Origin")
+  allowedOrigin := cors.allowedOrigin(origin)
+  preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+  if allowedOrigin == "" {
+    if preflight {
+      writeError(w, r, http.StatusForbidden, errors.New("cors origin not allowed"))
+    }
+    return preflight
+  }
+
+  w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
+  // кодогенератор не пропускает "*" вместе с credentials
+  if cors.Credentials && allowedOrigin != "*" {
+    w.Header().Set("Access-Control-Allow-Credentials", "true")
+  }
+  if !preflight {
+    return false
+  }
+
+  methods := cors.allowedMethods(route)
+  requested := r.Header.Get("Access-Control-Request-Method")
+  allowed := false
+  for _, method := range methods {
+    allowed = allowed || method == requested
+  }
+  if !allowed {
+    writeError(w, r, http.StatusForbidden, errors.New("cors method not allowed"))
+    return true
+  }
+
+  w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+  if len(cors.Headers) > 0 {
+    w.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.Headers, ", "))
+  }
+  if cors.MaxAge > 0 {
+    w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+  }
+  w.WriteHeader(http.StatusNoContent)
+  return true
+}
+
+// limitBody ограничивает тело запроса и сразу разбирает форму,
+// чтобы ответить 413, а не ошибкой валидации пустых параметров
+func limitBody(w http.ResponseWriter, r *http.Request, maxBody int64) bool {
+  r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+  err := r.ParseForm()
+  if err == nil {
+    return true
+  }
+
+  var tooLarge *http.MaxBytesError
+  if errors.As(err, &tooLarge) {
+    writeError(w, r, http.StatusRequestEntityTooLarge, errors.New("request body too large"))
+  } else {
+    writeError(w, r, http.StatusBadRequest, err)
+  }
+  return false
+}
+
+// checkContentType отвечает 415, если у запроса есть тело с Content-Type не из списка
+func checkContentType(w http.ResponseWriter, r *http.Request, consumes []string) bool {
+  if r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+    return true
+  }
+
+  mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+  if err == nil {
+    for _, allowed := range consumes {
+      if mediaType == allowed {
+        return true
+      }
+    }
+  }
+
+  writeError(w, r, http.StatusUnsupportedMediaType, errors.New("unsupported content type, expected one of ["+strings.Join(consumes, ", ")+"]"))
+  return false
+}
+
+// requestValue возвращает параметр пути, а если такого нет - параметр из формы или query
+func requestValue(r *http.Request, name string) string {
+  if value := r.PathValue(name); value != "" {
+    return value
+  }
+  return r.FormValue(name)
+}
+
+// nextSegment отрезает от пути "/a/b" первый сегмент и возвращает "a" и "/b"
+func nextSegment(path string) (string, string) {
+  path = path[1:]
+  if i := strings.IndexByte(path, '/'); i >= 0 {
+    return path[:i], path[i:]
+  }
+  return path, ""
+}
+
+// pathSegment возвращает n-й сегмент пути, считая с нуля
+func pathSegment(path string, n int) string {
+  segment := ""
+  for i := 0; i <= n && path != ""; i++ {
+    segment, path = nextSegment(path)
+  }
+  return segment
+}
+
+// pathTail возвращает остаток пути начиная с n-го сегмента, без ведущего "/"
+func pathTail(path string, n int) string {
+  for i := 0; i < n && path != ""; i++ {
+    _, path = nextSegment(path)
+  }
+  return strings.TrimPrefix(path, "/")
+}
+
+// toggleTrailingSlash добавляет или убирает "/" в конце пути, для корня возвращает ""
+// originalPath возвращает путь запроса до http.StripPrefix
+func originalPath(r *http.Request) string {
+  if u, err := url.ParseRequestURI(r.RequestURI); err == nil && u.Path != "" {
+    return u.Path
+  }
+  return r.URL.Path
+}
+
+func toggleTrailingSlash(path string) string {
+  switch {
+  case path == "/" || path == "":
+    return ""
+  case strings.HasSuffix(path, "/"):
+    return path[:len(path)-1]
+  }
+  return path + "/"
+}
+
+// VersionHeader - заголовок с версией API для стратегии версионирования header
+const VersionHeader = "Accept-Version"
+
+// requestVersion возвращает запрошенную клиентом версию API: из заголовка Accept-Version
+// или из параметра version в Accept, например "application/json; version=v2"
+func requestVersion(r *http.Request, strategy string) string {
+  if strategy == "header" {
+    return r.Header.Get(VersionHeader)
+  }
+  for _, item := range strings.Split(r.Header.Get("Accept"), ",") {
+    if _, params, err := mime.ParseMediaType(strings.TrimSpace(item)); err == nil && params["version"] != "" {
+      return params["version"]
+    }
+  }
+  return ""
+}
+
+// routesOverlap сообщает, может ли один путь подойти под оба шаблона маршрутов;
+// обычный путь запроса - шаблон без параметров, так что функция годится и для сопоставления
+func routesOverlap(a, b string) bool {
+  for a != "" && b != "" {
+    segmentA, restA := nextSegment(a)
+    segmentB, restB := nextSegment(b)
+    paramA, paramB := strings.HasPrefix(segmentA, "{"), strings.HasPrefix(segmentB, "{")
+    switch {
+    case strings.HasSuffix(segmentA, "...}") || strings.HasSuffix(segmentB, "...}"):
+      return true
+    case paramA && paramB:
+    case paramA && segmentB == "", paramB && segmentA == "":
+      return false
+    case !paramA && !paramB && segmentA != segmentB:
+      return false
+    }
+    a, b = restA, restB
+  }
+  return a == b
+}
+
+// Mountable - API, которое можно смонтировать в Mux: сгенерированный API, его Handler или другой Mux
+type Mountable interface {
+  http.Handler
+  Routes() []RouteInfo
+}
+
+// Mount - API и префикс пути, под которым оно обслуживается, "" - корень
+type Mount struct {
+  Prefix string
+  API    Mountable
+}
+
+type mountedAPI struct {
+  prefix  string
+  routes  []RouteInfo
+  handler http.Handler
+  // под тем же префиксом смонтированы другие API, нужно сверять маршруты
+  shared bool
+}
+
+// Mux объединяет несколько API под своими префиксами
+type Mux struct {
+  mounts []mountedAPI
+  routes []RouteInfo
+}
+
+// NewMux собирает Mux и возвращает ошибку, если маршруты разных API
+// с учётом префиксов могут подойти под один и тот же путь
+func NewMux(mounts ...Mount) (*Mux, error) {
+  mux := &Mux{}
+  prefixes := make(map[string]int, len(mounts))
+  for _, m := range mounts {
+    prefix := strings.TrimSuffix(m.Prefix, "/")
+    if prefix != "" && !strings.HasPrefix(prefix, "/") {
+      return nil, fmt.Errorf("mount prefix %q must start with /", m.Prefix)
+    }
+
+    // свои маршруты API различает сам: статический сегмент важнее параметра,
+    // а маршруты с одним Url разных версий выбирает по версии
+    mounted := mux.routes
+    routes := m.API.Routes()
+    for _, route := range routes {
+      route.URL = prefix + route.URL
+      for _, other := range mounted {
+        if routesOverlap(route.URL, other.URL) {
+          return nil, fmt.Errorf("route %s %s.%s overlaps %s %s.%s", route.URL, route.Api, route.MethodName, other.URL, other.Api, other.MethodName)
+        }
+      }
+      mux.routes = append(mux.routes, route)
+    }
+
+    var handler http.Handler = m.API
+    if prefix != "" {
+      handler = http.StripPrefix(prefix, m.API)
+    }
+    mux.mounts = append(mux.mounts, mountedAPI{prefix: prefix, routes: routes, handler: handler})
+    prefixes[prefix]++
+  }
+
+  for i := range mux.mounts {
+    mux.mounts[i].shared = prefixes[mux.mounts[i].prefix] > 1
+  }
+  // более длинный префикс проверяется раньше
+  sort.SliceStable(mux.mounts, func(i, j int) bool {
+    return len(mux.mounts[i].prefix) > len(mux.mounts[j].prefix)
+  })
+  return mux, nil
 }
 
-type apiTplParams struct {
-	ApiName string
-	Cases   []handlerTplParams
+// Routes возвращает маршруты всех API с префиксами, поэтому Mux можно смонтировать в другой Mux
+func (mux *Mux) Routes() []RouteInfo {
+  return append([]RouteInfo(nil), mux.routes...)
 }
 
-type handlerTplParams struct {
-	ApiName    string
-	MethodName string
-	ParamsName string
-	Params     []requestParam
-	Config     ApiConfig
+func (mux *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  path := r.URL.Path
+  for _, m := range mux.mounts {
+    if m.prefix != "" && path != m.prefix && !strings.HasPrefix(path, m.prefix+"/") {
+      continue
+    }
+    if m.shared && !m.serves(strings.TrimPrefix(path, m.prefix)) {
+      continue
+    }
+    m.handler.ServeHTTP(w, r)
+    return
+  }
+  writeError(w, r, http.StatusNotFound, errors.New("unknown method"))
 }
 
-var (
-	apiTpl = template.Must(template.New("apiTpl").Parse(`
-func (h *{{.ApiName}}) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-    switch r.URL.Path {
-{{range .Cases}}
-    case "{{.Config.Url}}":
-		{{if .Config.Auth}}
-		token := r.Header.Get("X-Auth")
-		if token != "100500" {
-			writeJsonResponse(w, Response{"error": "unauthorized"}, http.StatusForbidden)
-			return
-		}
-		{{end}}
-		{{if ne .Config.Method ""}}
-		if r.Method != "{{.Config.Method}}" {
-			writeJsonResponse(w, Response{"error": "bad method"}, http.StatusNotAcceptable)
-			return
-		}
-		{{end}}
-        h.handler{{.MethodName}}(w, r)
-{{end}}
-    default:
-        // 404
-		writeJsonResponse(w, Response{"error": "unknown method"}, http.StatusNotFound)
+func (m mountedAPI) serves(path string) bool {
+  for _, route := range m.routes {
+    if routesOverlap(route.URL, path) {
+      return true
     }
+  }
+  return false
 }
-`))
 
-	handlerTpl = template.Must(template.New("handlerTpl").Parse(`
-func (h *{{.ApiName}}) handler{{.MethodName}}(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	status := http.StatusOK
-    errorMessage := ""
-	
-    // валидирование параметров
-	// заполнение структуры params
-	params := {{.ParamsName}}{}
-    paramName := ""
+// RequestIDHeader - заголовок, из которого берётся и в который возвращается id запроса
+const RequestIDHeader = "X-Request-Id"
 
-	{{range .Params}}
+type requestIDKey struct{}
 
-    paramName = strings.ToLower("{{.ParamName}}")
-    {{.Parsers}}
+// RequestIDFromContext возвращает id запроса из ctx, который передаётся в методы API
+func RequestIDFromContext(ctx context.Context) string {
+  id, _ := ctx.Value(requestIDKey{}).(string)
+  return id
+}
 
-    {{ if eq .ParamType "string" }}
-    params.{{.ParamName}} = r.FormValue(paramName)
-    {{end}}
-    {{ if eq .ParamType "int" }}
-    value, err := strconv.Atoi(r.FormValue(paramName))
-    if err != nil {
-      writeJsonResponse(w, Response{"error": paramName + " must be int"}, http.StatusBadRequest)
-      return
-	}
-	params.{{.ParamName}} = value
-    {{end}}
-	{{.Validators}}
-    {{end}}
+// withRequestID берёт id запроса из заголовка или генерирует новый,
+// возвращает его в ответе и кладёт в контекст запроса
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+  id := r.Header.Get(RequestIDHeader)
+  if id == "" {
+    buf := make([]byte, 16)
+    rand.Read(buf)
+    id = hex.EncodeToString(buf)
+  }
+  w.Header().Set(RequestIDHeader, id)
+  return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
 
-	result, err := h.{{.MethodName}}(ctx, params)
+// MetricsHook получает результат каждого запроса к сгенерированным обработчикам
+type MetricsHook interface {
+  ObserveRequest(route RouteInfo, status int, latency time.Duration)
+}
 
-	// прочие обработки
-	if err != nil {
-		switch err.(type) {
-		case ApiError:
-			err := err.(ApiError)
-			status = err.HTTPStatus
-			errorMessage = err.Error()
-		default:
-            status = http.StatusInternalServerError
-			errorMessage = err.Error()
-		} 
-
-		writeJsonResponse(w, Response{
-			"error": errorMessage,
-    	}, status)
-		return 
-	}
-
-	writeJsonResponse(w, Response{
-        "error": "",
-		"response": result,
-    }, status)
+// InFlightHook - необязательное расширение MetricsHook,
+// получает число выполняющихся вызовов методов с max_inflight
+type InFlightHook interface {
+  ObserveInFlight(route RouteInfo, inFlight int)
 }
-`))
-	requiredValidatorTpl = template.Must(template.New("requiredValidatorTpl").Parse(`
-    if ok, err := ({{.Validator}}{"{{.Constraint}}", paramName}).Validate(params.{{.FieldName}}); !ok && err != nil {
-      writeJsonResponse(w, Response{
-        "error": err.Error(),
-      }, http.StatusBadRequest)
-      return
-    }
-`))
-	limitValidatorTpl = template.Must(template.New("limitValidatorTpl").Parse(`
-    if ok, err := ({{.Validator}}{"{{.Constraint}}", paramName, {{.Limit}} }).Validate(params.{{.FieldName}}); !ok && err != nil {
-      writeJsonResponse(w, Response{
-        "error": err.Error(),
-      }, http.StatusBadRequest)
-      return
-    }
-`))
-	enumValidatorTpl = template.Must(template.New("enumValidatorTpl").Parse(`
-    if ok, err := ({{.Validator}}{"{{.Constraint}}", paramName, map[string]int{ {{.List}} }}).Validate(params.{{.FieldName}}); !ok && err != nil {
-      writeJsonResponse(w, Response{
-        "error": err.Error(),
-      }, http.StatusBadRequest)
-      return
+
+// DeprecationHook - необязательное расширение MetricsHook,
+// получает каждый вызов устаревшего метода
+type DeprecationHook interface {
+  ObserveDeprecated(route RouteInfo)
+}
+
+// markDeprecated добавляет к ответу заголовки Deprecation, Sunset и Link
+// и сообщает о вызове устаревшего метода в DeprecationHook
+func markDeprecated(w http.ResponseWriter, route RouteInfo) {
+  w.Header().Set("Deprecation", route.Deprecation)
+  if route.Sunset != "" {
+    w.Header().Set("Sunset", route.Sunset)
+  }
+  if route.Successor != "" {
+    w.Header().Add("Link", "<"+route.Successor+">; rel=\"successor-version\"")
+  }
+  if hook, ok := Metrics.(DeprecationHook); ok {
+    hook.ObserveDeprecated(route)
+  }
+}
+
+func observeInFlight(route RouteInfo, inFlight int) {
+  if hook, ok := Metrics.(InFlightHook); ok {
+    hook.ObserveInFlight(route, inFlight)
+  }
+}
+
+// acquireSlot ждёт места в bulkhead не дольше queueTimeout и отвечает 503, если не дождался
+func acquireSlot(w http.ResponseWriter, r *http.Request, route RouteInfo, bulkhead chan struct{}, queueTimeout time.Duration) bool {
+  select {
+  case bulkhead <- struct{}{}:
+    observeInFlight(route, len(bulkhead))
+    return true
+  default:
+  }
+
+  if queueTimeout > 0 {
+    timer := time.NewTimer(queueTimeout)
+    defer timer.Stop()
+    select {
+    case bulkhead <- struct{}{}:
+      observeInFlight(route, len(bulkhead))
+      return true
+    case <-timer.C:
+    case <-r.Context().Done():
     }
-`))
-)
+  }
 
-func getParsersByTag(fieldName, fieldType, tag string) string {
-	parsers := ""
-	constraints := strings.Split(tag, ",")
+  writeError(w, r, http.StatusServiceUnavailable, errors.New("too many concurrent requests"))
+  return false
+}
 
-	for _, constraint := range constraints {
-		out := new(bytes.Buffer)
+func releaseSlot(route RouteInfo, bulkhead chan struct{}) {
+  <-bulkhead
+  observeInFlight(route, len(bulkhead))
+}
 
-		if strings.Index(constraint, "paramname") == 0 {
-			value := strings.Split(constraint, "=")[1]
-			out.Write([]byte(fmt.Sprintf("paramName = \"%s\"", value)))
-		}
+// Metrics - куда отправлять метрики, nil отключает их сбор
+var Metrics MetricsHook = DefaultMetrics
 
-		parsers += out.String()
-	}
+// DefaultMetrics собирает метрики всех API, отдаёт их в формате Prometheus через ServeHTTP
+var DefaultMetrics = NewPrometheusMetrics()
+
+// границы корзин гистограммы длительности запросов в секундах
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
 
-	return parsers
+type metricsRoute struct {
+  api    string
+  method string
 }
 
-func getValidatorsByTag(fieldName, fieldType, tag string) string {
-	validators := ""
-	constraints := strings.Split(tag, ",")
+type metricsStatus struct {
+  metricsRoute
+  status int
+}
 
-	for _, constraint := range constraints {
-		out := new(bytes.Buffer)
-
-		if strings.Index(constraint, "required") == 0 {
-			requiredValidatorTpl.Execute(out, map[string]interface{}{
-				"Validator":  "RequiredValidator",
-				"FieldName":  fieldName,
-				"FieldType":  fieldType,
-				"Constraint": constraint,
-			})
-		}
+type latencyHistogram struct {
+  buckets []uint64
+  sum     float64
+  count   uint64
+}
 
-		if strings.Index(constraint, "min") == 0 {
-			limitValidatorTpl.Execute(out, map[string]interface{}{
-				"Validator":  strings.Title(fieldType) + "MinValidator",
-				"FieldName":  fieldName,
-				"FieldType":  fieldType,
-				"Constraint": constraint,
-				"Limit":      strings.Split(constraint, "=")[1],
-			})
-		}
+// PrometheusMetrics считает запросы, ошибки по статусам и длительность запросов
+// по каждому методу API и отдаёт их в текстовом формате Prometheus
+type PrometheusMetrics struct {
+  mu         sync.Mutex
+  requests   map[metricsStatus]uint64
+  latency    map[metricsRoute]*latencyHistogram
+  inFlight   map[metricsRoute]int
+  deprecated map[metricsRoute]uint64
+}
 
-		if strings.Index(constraint, "max") == 0 {
-			limitValidatorTpl.Execute(out, map[string]interface{}{
-				"Validator":  strings.Title(fieldType) + "MaxValidator",
-				"FieldName":  fieldName,
-				"FieldType":  fieldType,
-				"Constraint": constraint,
-				"Limit":      strings.Split(constraint, "=")[1],
-			})
-		}
+func NewPrometheusMetrics() *PrometheusMetrics {
+  return &PrometheusMetrics{
+    requests:   make(map[metricsStatus]uint64),
+    latency:    make(map[metricsRoute]*latencyHistogram),
+    inFlight:   make(map[metricsRoute]int),
+    deprecated: make(map[metricsRoute]uint64),
+  }
+}
 
-		if strings.Index(constraint, "enum") == 0 {
-			if strings.Contains(tag, "default") {
-				value := strings.Split(tag, "=")[2]
-				out.Write([]byte(fmt.Sprintf(`
-	if params.%s == "" {
-	 params.%s = "%s"
-	}`, fieldName, fieldName, value)))
-			}
+func (m *PrometheusMetrics) ObserveDeprecated(route RouteInfo) {
+  m.mu.Lock()
+  m.deprecated[metricsRoute{route.Api, route.MethodName}]++
+  m.mu.Unlock()
+}
 
-			enumValidatorTpl.Execute(out, map[string]interface{}{
-				"Validator":  "EnumValidator",
-				"FieldName":  fieldName,
-				"FieldType":  fieldType,
-				"Constraint": constraint,
-				"List":       "\"" + strings.Join(strings.Split(strings.Split(constraint, "=")[1], "|"), "\":1, \"") + "\": 1",
-			})
-		}
+func (m *PrometheusMetrics) ObserveInFlight(route RouteInfo, inFlight int) {
+  m.mu.Lock()
+  m.inFlight[metricsRoute{route.Api, route.MethodName}] = inFlight
+  m.mu.Unlock()
+}
 
-		validators += out.String()
-	}
+func (m *PrometheusMetrics) ObserveRequest(route RouteInfo, status int, latency time.Duration) {
+  key := metricsRoute{route.Api, route.MethodName}
+  seconds := latency.Seconds()
+
+  m.mu.Lock()
+  defer m.mu.Unlock()
 
-	return validators
+  m.requests[metricsStatus{key, status}]++
+
+  hist, ok := m.latency[key]
+  if !ok {
+    hist = &latencyHistogram{buckets: make([]uint64, len(latencyBuckets))}
+    m.latency[key] = hist
+  }
+  for i, le := range latencyBuckets {
+    if seconds <= le {
+      hist.buckets[i]++
+    }
+  }
+  hist.sum += seconds
+  hist.count++
 }
 
-func main() {
-	paramsMap := make(map[string][]requestParam, 10)
-	handlerMap := make(map[string][]handlerTplParams, 10)
-	fset := token.NewFileSet()
-	node, err := parser.ParseFile(fset, os.Args[1], nil, parser.ParseComments)
-	if err != nil {
-		log.Fatal(err)
-	}
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+  m.WriteTo(w)
+}
 
-	out, _ := os.Create(os.Args[2])
+// WriteTo пишет метрики в текстовом формате Prometheus, строки отсортированы по меткам
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
 
-	fmt.Fprintln(out, `package `+node.Name.Name)
-	fmt.Fprintln(out) // empty line
-	fmt.Fprintln(out, `import "net/http"`)
-	fmt.Fprintln(out, `import "encoding/json"`)
-	fmt.Fprintln(out, `import "strconv"`)
-	fmt.Fprintln(out, `import "strings"`)
-	fmt.Fprintln(out, `import "fmt"`)
-	fmt.Fprintln(out) // empty line
+  out := &bytes.Buffer{}
 
-	fmt.Fprintln(out, `
-type Response map[string]interface{}
+  statuses := make([]metricsStatus, 0, len(m.requests))
+  for key := range m.requests {
+    statuses = append(statuses, key)
+  }
+  sort.Slice(statuses, func(i, j int) bool {
+    if statuses[i].metricsRoute != statuses[j].metricsRoute {
+      return routeLess(statuses[i].metricsRoute, statuses[j].metricsRoute)
+    }
+    return statuses[i].status < statuses[j].status
+  })
 
-func writeJsonResponse(w http.ResponseWriter, response interface{}, status int) {
-  jsonResponse, _ := json.Marshal(response)
-  w.WriteHeader(status)
-  _, err := w.Write(jsonResponse)
-  if err != nil {
-    panic("Unexpected error")
+  out.WriteString("# HELP apigen_requests_total Total number of API requests.\n")
+  out.WriteString("# TYPE apigen_requests_total counter\n")
+  for _, key := range statuses {
+    fmt.Fprintf(out, "apigen_requests_total{api=%q,method=%q,status=\"%d\"} %d\n", key.api, key.method, key.status, m.requests[key])
+  }
+
+  out.WriteString("# HELP apigen_request_errors_total Total number of API requests answered with an error status.\n")
+  out.WriteString("# TYPE apigen_request_errors_total counter\n")
+  for _, key := range statuses {
+    if key.status >= 400 {
+      fmt.Fprintf(out, "apigen_request_errors_total{api=%q,method=%q,status=\"%d\"} %d\n", key.api, key.method, key.status, m.requests[key])
+    }
+  }
+
+  routes := make([]metricsRoute, 0, len(m.latency))
+  for key := range m.latency {
+    routes = append(routes, key)
+  }
+  sort.Slice(routes, func(i, j int) bool {
+    return routeLess(routes[i], routes[j])
+  })
+
+  out.WriteString("# HELP apigen_request_duration_seconds API request latency.\n")
+  out.WriteString("# TYPE apigen_request_duration_seconds histogram\n")
+  for _, key := range routes {
+    hist := m.latency[key]
+    for i, le := range latencyBuckets {
+      fmt.Fprintf(out, "apigen_request_duration_seconds_bucket{api=%q,method=%q,le=\"%s\"} %d\n", key.api, key.method, strconv.FormatFloat(le, 'g', -1, 64), hist.buckets[i])
+    }
+    fmt.Fprintf(out, "apigen_request_duration_seconds_bucket{api=%q,method=%q,le=\"+Inf\"} %d\n", key.api, key.method, hist.count)
+    fmt.Fprintf(out, "apigen_request_duration_seconds_sum{api=%q,method=%q} %s\n", key.api, key.method, strconv.FormatFloat(hist.sum, 'g', -1, 64))
+    fmt.Fprintf(out, "apigen_request_duration_seconds_count{api=%q,method=%q} %d\n", key.api, key.method, hist.count)
+  }
+
+  inFlight := make([]metricsRoute, 0, len(m.inFlight))
+  for key := range m.inFlight {
+    inFlight = append(inFlight, key)
   }
+  sort.Slice(inFlight, func(i, j int) bool {
+    return routeLess(inFlight[i], inFlight[j])
+  })
+
+  out.WriteString("# HELP apigen_requests_in_flight Number of API calls being served by methods with max_inflight.\n")
+  out.WriteString("# TYPE apigen_requests_in_flight gauge\n")
+  for _, key := range inFlight {
+    fmt.Fprintf(out, "apigen_requests_in_flight{api=%q,method=%q} %d\n", key.api, key.method, m.inFlight[key])
+  }
+
+  deprecated := make([]metricsRoute, 0, len(m.deprecated))
+  for key := range m.deprecated {
+    deprecated = append(deprecated, key)
+  }
+  sort.Slice(deprecated, func(i, j int) bool {
+    return routeLess(deprecated[i], deprecated[j])
+  })
+
+  out.WriteString("# HELP apigen_deprecated_requests_total Total number of calls to deprecated API methods.\n")
+  out.WriteString("# TYPE apigen_deprecated_requests_total counter\n")
+  for _, key := range deprecated {
+    fmt.Fprintf(out, "apigen_deprecated_requests_total{api=%q,method=%q} %d\n", key.api, key.method, m.deprecated[key])
+  }
+
+  return out.WriteTo(w)
+}
+
+func routeLess(a, b metricsRoute) bool {
+  if a.api != b.api {
+    return a.api < b.api
+  }
+  return a.method < b.method
 }
 
-type IntMaxValidator struct {
-  rule string
-  paramName string
-  Max int
+// goroutinePanic переносит панику метода API из горутины callWithTimeout
+// в горутину обработчика вместе с исходным стеком
+type goroutinePanic struct {
+  value interface{}
+  stack []byte
 }
 
-type IntMinValidator struct {
-  rule string
-  paramName string
-  Min int
+type callResult[T any] struct {
+  result T
+  err    error
+  panic  *goroutinePanic
 }
 
-type StringMaxValidator struct {
-  rule string
-  paramName string
-  Max int
+// methodCall следит за горутинами метода из callWithTimeout одного запроса:
+// по дедлайну или отключению клиента обработчик отвечает сразу, а метод продолжает работать
+type methodCall struct {
+  mu      sync.Mutex
+  running int
+  // callWithTimeout вернулась раньше, чем метод завершился
+  early  bool
+  result interface{}
+  err    error
+  after  []func(result interface{}, err error)
 }
 
-type StringMinValidator struct {
-  rule string
-  paramName string
-  Min int
+type methodCallKey struct{}
+
+// trackMethodCall кладёт methodCall в контекст запроса, если его там ещё нет
+func trackMethodCall(r *http.Request) (*http.Request, *methodCall) {
+  if call, ok := r.Context().Value(methodCallKey{}).(*methodCall); ok {
+    return r, call
+  }
+  call := &methodCall{}
+  return r.WithContext(context.WithValue(r.Context(), methodCallKey{}, call)), call
 }
 
-type EnumValidator struct {
-  rule string
-  paramName string
-  list map[string]int
+// afterMethod вызывает f с результатом метода, когда завершатся все его горутины:
+// сразу, если их нет, иначе - из последней завершившейся горутины
+func (c *methodCall) afterMethod(f func(result interface{}, err error)) {
+  c.mu.Lock()
+  if c.running > 0 {
+    c.after = append(c.after, f)
+    c.mu.Unlock()
+    return
+  }
+  result, err := c.result, c.err
+  c.mu.Unlock()
+  f(result, err)
 }
 
-type RequiredValidator struct {
-  rule string
-  paramName string
+// detached сообщает, что обработчик получил ошибку дедлайна или отмены раньше результата метода,
+// и afterMethod получит настоящий результат
+func (c *methodCall) detached() bool {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.early
 }
 
-func (v IntMaxValidator) Validate(val interface{}) (bool, error) {
-  num := val.(int)
+// start, detach и finish отмечают горутину метода, nil - запрос без methodCall
+func (c *methodCall) start() {
+  if c == nil {
+    return
+  }
+  c.mu.Lock()
+  c.running++
+  c.mu.Unlock()
+}
 
-  if num > v.Max {
-    return false, fmt.Errorf(v.paramName + " must be <= %v", v.Max)
+func (c *methodCall) detach() {
+  if c == nil {
+    return
   }
-  
-  return true, nil
+  c.mu.Lock()
+  c.early = true
+  c.mu.Unlock()
 }
 
-func (v IntMinValidator) Validate(val interface{}) (bool, error) {
-  num := val.(int)
+func (c *methodCall) finish(result interface{}, err error) {
+  if c == nil {
+    return
+  }
+  c.mu.Lock()
+  c.running--
+  c.result, c.err = result, err
+  var after []func(interface{}, error)
+  if c.running == 0 {
+    after, c.after = c.after, nil
+  }
+  c.mu.Unlock()
+  for _, f := range after {
+    f(result, err)
+  }
+}
 
-  if num < v.Min {
-    return false, fmt.Errorf(v.paramName + " must be >= %v", v.Min)
+// callWithTimeout вызывает метод API с дедлайном в отдельной горутине,
+// чтобы ответить по его истечении, даже если метод не следит за ctx.
+// О горутине, которая переживёт обработчик, узнаёт methodCall из ctx
+func callWithTimeout[T any](ctx context.Context, timeout time.Duration, call func(context.Context) (T, error)) (T, error) {
+  ctx, cancel := context.WithTimeout(ctx, timeout)
+  defer cancel()
+
+  tracked, _ := ctx.Value(methodCallKey{}).(*methodCall)
+  tracked.start()
+  done := make(chan callResult[T], 1)
+  go func() {
+    res := callResult[T]{}
+    defer func() {
+      if recovered := recover(); recovered != nil {
+        res.panic = &goroutinePanic{recovered, debug.Stack()}
+        res.err = fmt.Errorf("panic: %v", recovered)
+      }
+      tracked.finish(res.result, res.err)
+      done <- res
+    }()
+    res.result, res.err = call(ctx)
+  }()
+
+  select {
+  case res := <-done:
+    if res.panic != nil {
+      panic(*res.panic)
+    }
+    return res.result, res.err
+  case <-ctx.Done():
+    tracked.detach()
+    var zero T
+    return zero, ctx.Err()
   }
-  
-  return true, nil
 }
 
-func (v StringMaxValidator) Validate(val interface{}) (bool, error) {
-  l := len(val.(string))
+// ErrorEncoder пишет в ответ ошибку routing-а, авторизации, валидации или метода API
+type ErrorEncoder func(w http.ResponseWriter, r *http.Request, status int, err error)
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+  if rec := findStatusRecorder(w); rec != nil {
+    rec.err = err
+  }
+  EncodeError(w, r, status, err)
+}
 
-  if v.Max > 0 && l > v.Max {
-    return false, fmt.Errorf(v.paramName + " must be <= %v", v.Max)
+// findStatusRecorder находит statusRecorder под обёртками ResponseWriter-а с методом Unwrap
+func findStatusRecorder(w http.ResponseWriter) *statusRecorder {
+  for {
+    switch current := w.(type) {
+    case *statusRecorder:
+      return current
+    case interface{ Unwrap() http.ResponseWriter }:
+      w = current.Unwrap()
+    default:
+      return nil
+    }
   }
-  
-  return true, nil
 }
 
-func (v StringMinValidator) Validate(val interface{}) (bool, error) {
-  l := len(val.(string))
+// StatusClientClosedRequest - статус запроса, клиент которого отключился,
+// не дождавшись ответа метода (как в nginx)
+const StatusClientClosedRequest = 499
+
+// errorAs сообщает, есть ли в цепочке err ошибка типа T
+func errorAs[T error](err error) bool {
+  var target T
+  return errors.As(err, &target)
+}
+
+// LegacyErrorEncoder пишет ошибку в виде {"error": "..."},
+// ошибки валидации всех параметров - в виде {"error": "validation failed", "fields": [...]}
+func LegacyErrorEncoder(w http.ResponseWriter, r *http.Request, status int, err error) {
+  // ошибка пишется в формате из Accept, если он известен, иначе в JSON
+  encoder, ok := negotiate(r, DefaultProduces)
+  if !ok {
+    encoder = JSONEncoder{}
+  }
+  var errs ValidationErrors
+  if errors.As(err, &errs) {
+    writeErrorResponse(w, encoder, Response{"error": "validation failed", "fields": errs}, status)
+    return
+  }
+  response := Response{"error": err.Error()}
+  code, details := apiErrorExtras(err)
+  if code != "" {
+    response["code"] = code
+  }
+  if details != nil {
+    response["details"] = details
+  }
+  writeErrorResponse(w, encoder, response, status)
+}
 
-  if v.Min > 0 && l < v.Min {
-    return false, fmt.Errorf(v.paramName + " len must be >= %v", v.Min)
+// ProblemErrorEncoder пишет ошибку в формате application/problem+json (RFC 7807)
+func ProblemErrorEncoder(w http.ResponseWriter, r *http.Request, status int, err error) {
+  problem := Response{
+    "type":     "about:blank",
+    "title":    http.StatusText(status),
+    "status":   status,
+    "detail":   err.Error(),
+    "instance": r.URL.Path,
+  }
+  var errs ValidationErrors
+  if errors.As(err, &errs) {
+    problem["detail"] = "validation failed"
+    problem["fields"] = errs
   }
-  
-  return true, nil
+  code, details := apiErrorExtras(err)
+  if code != "" {
+    problem["code"] = code
+  }
+  if details != nil {
+    problem["details"] = details
+  }
+  w.Header().Set("Content-Type", "application/problem+json")
+  writeJsonResponse(w, problem, status)
+}
+
+// FieldError - ошибка валидации одного параметра запроса
+type FieldError struct {
+  Param   string ` + "`" + `json:"param"` + "`" + `
+  Message string ` + "`" + `json:"message"` + "`" + `
 }
 
-func (v EnumValidator) Validate(val interface{}) (bool, error) {
-  item := val.(string)
+func (e FieldError) Error() string {
+  return e.Param + " " + e.Message
+}
+
+// ValidationErrors - ошибки валидации по всем невалидным параметрам
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+  msgs := make([]string, 0, len(e))
+  for _, fe := range e {
+    msgs = append(msgs, fe.Error())
+  }
+  return strings.Join(msgs, "; ")
+}
 
-  if _,ok := v.list[item]; !ok {
-	return false, fmt.Errorf(v.paramName + " must be one of [" + strings.Join(strings.Split(strings.Split(v.rule, "=")[1], "|"), ", ") + "]")
+func (e ValidationErrors) has(param string) bool {
+  for _, fe := range e {
+    if fe.Param == param {
+      return true
+    }
   }
-  
-  return true, nil
+  return false
 }
 
-func (v RequiredValidator) Validate(val interface{}) (bool, error) {
-  l := len(val.(string))
+type requestParams interface {
+  bind(r *http.Request, all bool) error
+  validate(all bool) error
+}
 
-  if l == 0 {
-	return false, fmt.Errorf(v.paramName + " must me not empty")
+// bindAndValidateAll собирает ошибки заполнения и валидации по всем параметрам,
+// параметр, который не удалось разобрать, повторно не валидируется
+func bindAndValidateAll(p requestParams, r *http.Request) error {
+  errs := ValidationErrors{}
+  if err := p.bind(r, true); err != nil {
+    errs = append(errs, err.(ValidationErrors)...)
   }
-  
-  return true, nil
-}`)
+  if err := p.validate(true); err != nil {
+    for _, fe := range err.(ValidationErrors) {
+      if !errs.has(fe.Param) {
+        errs = append(errs, fe)
+      }
+    }
+  }
+  if len(errs) > 0 {
+    return errs
+  }
+  return nil
+}
+`)
+
+	fmt.Fprintf(out, `
+// EncodeError используется всеми сгенерированными обработчиками,
+// по умолчанию задаётся флагом кодогенератора -error-encoder
+var EncodeError ErrorEncoder = %s
+`, errorEncoders[*errorEncoder])
 
 	// разбираем все структуры с параметрами API handler-ов
 	for _, f := range node.Decls {
@@ -375,12 +3497,34 @@ func (v RequiredValidator) Validate(val interface{}) (bool, error) {
 				fmt.Printf("SKIP %T is not ast.TypeSpec\n", spec)
 				continue
 			}
+			typeNames[currType.Name.Name] = true
+
+			// настройки CORS для всех методов API
+			doc := currType.Doc
+			if doc == nil {
+				doc = g.Doc
+			}
+			if doc != nil {
+				for _, comment := range doc.List {
+					if !strings.HasPrefix(comment.Text, API_CORS_PREFIX) {
+						continue
+					}
+					cors := &corsConfig{}
+					if err := json.Unmarshal([]byte(strings.TrimPrefix(comment.Text, API_CORS_PREFIX)), cors); err != nil {
+						log.Fatalf("bad cors config for %s: %v", currType.Name.Name, err)
+					}
+					apiCORS[currType.Name.Name] = cors
+				}
+			}
 
 			currStruct, ok := currType.Type.(*ast.StructType)
 			if !ok {
 				fmt.Printf("SKIP %T is not ast.StructType\n", currStruct)
 				continue
 			}
+			if currType.Name.Name == "ApiError" {
+				apiErrorFields = structFields(currStruct)
+			}
 
 		FIELDS_LOOP:
 			for _, field := range currStruct.Fields.List {
@@ -400,13 +3544,37 @@ func (v RequiredValidator) Validate(val interface{}) (bool, error) {
 
 				switch fieldType {
 				case "int", "string":
-					paramsMap[currType.Name.Name] = append(paramsMap[currType.Name.Name], requestParam{fieldName, fieldType, getValidatorsByTag(fieldName, fieldType, tag.Get(API_VALIDATOR_PREFIX)), getParsersByTag(fieldName, fieldType, tag.Get(API_VALIDATOR_PREFIX))})
+					rules := tag.Get(API_VALIDATOR_PREFIX)
+					paramsMap[currType.Name.Name] = append(paramsMap[currType.Name.Name], requestParam{
+						ParamName:  fieldName,
+						ParamType:  fieldType,
+						QueryName:  getQueryName(fieldName, rules),
+						Validators: getValidatorsByTag(getQueryName(fieldName, rules), fieldName, fieldType, rules),
+						Defaults:   getDefaultsByTag(fieldName, fieldType, rules),
+						Rules:      rules,
+					})
 				default:
 					continue FIELDS_LOOP
 				}
 			}
 		}
 	}
+	writeApiErrorExtras(out, apiErrorFields)
+
+	// ищем методы Validate у структур с параметрами
+	for _, f := range node.Decls {
+		g, ok := f.(*ast.FuncDecl)
+		if !ok || g.Recv == nil || g.Name.Name != "Validate" {
+			continue
+		}
+
+		if hook := validateHookKind(g.Type); hook != "" {
+			validateHooks[receiverName(g)] = hook
+		} else {
+			fmt.Printf("SKIP method %s.Validate: want Validate() error or Validate(context.Context) error\n", receiverName(g))
+		}
+	}
+
 	// делаем обертки для API с обертками в виде http обработчиков
 	for _, f := range node.Decls {
 		g, ok := f.(*ast.FuncDecl)
@@ -439,25 +3607,192 @@ func (v RequiredValidator) Validate(val interface{}) (bool, error) {
 			fmt.Printf("SKIP func %#v doesnt have api mark\n", g.Name.Name)
 			continue
 		}
+		apiConfig.AggregateErrors = apiConfig.AggregateErrors || *aggregateErrors
+		sunset, err := parseDate(apiConfig.Sunset)
+		if err != nil {
+			log.Fatalf("bad sunset for %s: %v", g.Name.Name, err)
+		}
+		deprecatedAt, err := parseDate(apiConfig.DeprecatedAt)
+		if err != nil {
+			log.Fatalf("bad deprecated_at for %s: %v", g.Name.Name, err)
+		}
+		apiConfig.Deprecated = apiConfig.Deprecated || apiConfig.DeprecatedAt != "" || apiConfig.Sunset != "" || apiConfig.Successor != ""
+		deprecation := ""
+		if apiConfig.Deprecated {
+			// RFC 9745: Deprecation - дата, а не флаг; без deprecated_at это дата генерации
+			if deprecatedAt.IsZero() {
+				deprecatedAt = time.Now().UTC().Truncate(24 * time.Hour)
+				apiConfig.DeprecatedAt = deprecatedAt.Format(time.DateOnly)
+				lintWarning("%s.%s: deprecated without deprecated_at, Deprecation is set to the generation date %s", receiverName(g), g.Name.Name, apiConfig.DeprecatedAt)
+			} else if !sunset.IsZero() && sunset.Before(deprecatedAt) {
+				log.Fatalf("%s.%s: sunset %s is before deprecated_at %s", receiverName(g), g.Name.Name, apiConfig.Sunset, apiConfig.DeprecatedAt)
+			}
+			deprecation = "@" + strconv.FormatInt(deprecatedAt.Unix(), 10)
+		}
+		if !sunset.IsZero() && time.Now().After(sunset) {
+			lintWarning("%s.%s: sunset date %s has passed, the method should be removed", receiverName(g), g.Name.Name, apiConfig.Sunset)
+		}
+		if apiConfig.Version != "" && *versioning == "path" {
+			apiConfig.Url = "/" + apiConfig.Version + apiConfig.Url
+		}
+
+		cors := apiCORS[receiverName(g)]
+		if cors == nil {
+			cors = globalCORS
+		}
+		if apiConfig.Cors != nil {
+			cors = apiConfig.Cors
+		}
+		if cors != nil {
+			if err := cors.prepare(); err != nil {
+				log.Fatalf("bad cors config for %s: %v", g.Name.Name, err)
+			}
+		}
+
+		if apiConfig.Cache != nil {
+			if apiConfig.Method != "" && apiConfig.Method != http.MethodGet {
+				log.Fatalf("cache for %s: only GET responses are cached, method is %s", g.Name.Name, apiConfig.Method)
+			}
+			if err := apiConfig.Cache.prepare(); err != nil {
+				log.Fatalf("bad cache max_age for %s: %v", g.Name.Name, err)
+			}
+		}
+
+		compress := *defaultCompress
+		if apiConfig.Compress != nil {
+			compress = *apiConfig.Compress
+		}
 
-		apiName := g.Recv.List[0].Type.(*ast.StarExpr).X.(*ast.Ident).Name
+		timeout := *defaultTimeout
+		if apiConfig.Timeout != "" {
+			timeout, err = time.ParseDuration(apiConfig.Timeout)
+			if err != nil {
+				log.Fatalf("bad timeout for %s: %v", g.Name.Name, err)
+			}
+		}
+		queueTimeout := time.Duration(0)
+		if apiConfig.QueueTimeout != "" {
+			queueTimeout, err = time.ParseDuration(apiConfig.QueueTimeout)
+			if err != nil {
+				log.Fatalf("bad queue_timeout for %s: %v", g.Name.Name, err)
+			}
+		}
+
+		maxBody := globalMaxBody
+		if apiConfig.MaxBody != "" {
+			maxBody, err = parseSize(apiConfig.MaxBody)
+			if err != nil {
+				log.Fatalf("bad max_body for %s: %v", g.Name.Name, err)
+			}
+		}
+
+		for _, mediaType := range apiConfig.Produces {
+			if !knownEncoders[mediaType] {
+				log.Fatalf("unknown produces %q for %s, register it in ResponseEncoders and pass to -encoders", mediaType, g.Name.Name)
+			}
+		}
+
+		limit, err := parseRateLimit(apiConfig.Ratelimit)
+		if err != nil {
+			log.Fatalf("bad ratelimit for %s: %v", g.Name.Name, err)
+		}
+
+		timeoutStatus := *defaultTimeoutStatus
+		if apiConfig.TimeoutStatus != 0 {
+			timeoutStatus = apiConfig.TimeoutStatus
+		}
+
+		apiName := receiverName(g)
 		paramsName := g.Type.Params.List[1].Type.(*ast.Ident).Name
+		if _, ok := handlerMap[apiName]; !ok {
+			apiNames = append(apiNames, apiName)
+		}
+		if !seenParams[paramsName] {
+			seenParams[paramsName] = true
+			paramsNames = append(paramsNames, paramsName)
+		}
 		handlerMap[apiName] = append(
 			handlerMap[apiName],
 			handlerTplParams{
-				apiName,
-				g.Name.Name,
-				paramsName,
-				paramsMap[paramsName],
-				*apiConfig,
+				ApiName:       apiName,
+				MethodName:    g.Name.Name,
+				ParamsName:    paramsName,
+				Params:        paramsMap[paramsName],
+				Config:        *apiConfig,
+				ValidateHook:  validateHooks[paramsName],
+				ErrorCases:    getErrorCases(globalErrors, apiConfig.Errors, typeNames),
+				ResultType:    types.ExprString(g.Type.Results.List[0].Type),
+				Timeout:       int64(timeout),
+				TimeoutStatus: timeoutStatus,
+				RateLimit:     limit,
+				QueueTimeout:  int64(queueTimeout),
+				CORS:          cors,
+				MaxBody:       maxBody,
+				Deprecation:   deprecation,
+				Sunset:        formatSunset(sunset),
+				Compress:      compress,
 			})
 		// парсим конфигурацию метода из комментария
 		fmt.Printf("type: %T api: %s method: %s config:%#v\n", g, apiName, g.Name.Name, apiConfig)
 	}
 
 	// записыва
-	for apiName, methodList := range handlerMap {
-		apiTpl.Execute(out, apiTplParams{apiName, methodList})
+	// Validate и BindRequest генерируются по одному разу на структуру параметров,
+	// даже если её используют несколько методов
+	for _, paramsName := range paramsNames {
+		tplParams := paramsTplParams{
+			ParamsName:   paramsName,
+			Params:       paramsMap[paramsName],
+			ValidateHook: validateHooks[paramsName],
+		}
+		for _, param := range tplParams.Params {
+			tplParams.HasValidators = tplParams.HasValidators || param.Validators != ""
+		}
+		if tplParams.ValidateHook != "" {
+			fmt.Printf("struct %s has own Validate, tag checks go to ValidateTags, Check runs both\n", paramsName)
+		}
+		paramsTpl.Execute(out, tplParams)
+	}
+
+	for _, apiName := range apiNames {
+		methodList := handlerMap[apiName]
+		root := newRouteNode()
+		versions := getVersionSlots(methodList)
+		for i := range methodList {
+			var (
+				params []pathParam
+				err    error
+			)
+			if slot, ok := versions[methodList[i].Config.Url]; ok && slot.Default != i {
+				// версии одного Url делят ветку дерева с методом по умолчанию
+				params, err = newRouteNode().addRoute(methodList[i].Config.Url, i)
+			} else {
+				params, err = root.addRoute(methodList[i].Config.Url, i)
+			}
+			if err != nil {
+				log.Fatalf("bad url for %s.%s: %v", apiName, methodList[i].MethodName, err)
+			}
+			methodList[i].PathParams = params
+		}
+		if *specDir != "" {
+			if err := writeSpecs(*specDir, getVersionSpecs(apiName, methodList, versions)); err != nil {
+				log.Fatalf("write spec for %s: %v", apiName, err)
+			}
+		}
+		slots := make([]versionSlot, 0, len(versions))
+		for _, slot := range versions {
+			slots = append(slots, *slot)
+		}
+		sort.Slice(slots, func(i, j int) bool { return slots[i].Default < slots[j].Default })
+		apiTpl.Execute(out, apiTplParams{
+			ApiName:       apiName,
+			Cases:         methodList,
+			Versions:      slots,
+			Versioning:    *versioning,
+			VersionVary:   versionVary[*versioning],
+			Router:        renderRouter(apiName, root),
+			TrailingSlash: *trailingSlash,
+		})
 
 		for _, tplParams := range methodList {
 			handlerTpl.Execute(out, tplParams)
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// generator - собранный кодогенератор, его запускают все тесты пакета
+var generator string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "codegen")
+	if err != nil {
+		panic(err)
+	}
+	generator = filepath.Join(dir, "codegen")
+	if out, err := exec.Command("go", "build", "-o", generator, ".").CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		panic("build codegen: " + err.Error() + "\n" + string(out))
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// fixtureModule копирует testdata/<fixture> в отдельный модуль и возвращает его каталог
+func fixtureModule(t *testing.T, fixture string) string {
+	t.Helper()
+	dir := t.TempDir()
+	files, err := filepath.Glob(filepath.Join("testdata", fixture, "*.go"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no fixture %s: %v", fixture, err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, filepath.Base(file)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module "+fixture+"\n\ngo 1.22\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// runGenerator генерирует api_handlers.go модуля dir и возвращает вывод генератора
+func runGenerator(dir string, flags ...string) (string, error) {
+	args := append(flags, filepath.Join(dir, "api.go"), filepath.Join(dir, "api_handlers.go"))
+	out, err := exec.Command(generator, args...).CombinedOutput()
+	return string(out), err
+}
+
+// generate собирает модуль из фикстуры и генерирует для него код, ошибка генератора валит тест
+func generate(t *testing.T, fixture string, flags ...string) (string, string) {
+	t.Helper()
+	dir := fixtureModule(t, fixture)
+	out, err := runGenerator(dir, flags...)
+	if err != nil {
+		t.Fatalf("codegen %s: %v\n%s", strings.Join(flags, " "), err, out)
+	}
+	return dir, out
+}
+
+// goTest запускает тесты сгенерированного модуля, env передаёт им флаги генерации
+func goTest(t *testing.T, dir string, env ...string) {
+	t.Helper()
+	cmd := exec.Command("go", "test", "-count=1", "./...")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), append(env, "GOWORK=off")...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go test: %v\n%s", err, out)
+	}
+}
+
+func TestGeneratedRouter(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds generated code")
+	}
+	for _, policy := range []string{"strict", "redirect", "ignore"} {
+		policy := policy
+		t.Run(policy, func(t *testing.T) {
+			t.Parallel()
+			dir, _ := generate(t, "routes", "-trailing-slash", policy)
+			goTest(t, dir, "TRAILING_SLASH="+policy)
+		})
+	}
+}
+
+func TestGeneratedVersioning(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds generated code")
+	}
+	for _, strategy := range []string{"path", "header", "media-type"} {
+		strategy := strategy
+		t.Run(strategy, func(t *testing.T) {
+			t.Parallel()
+			dir, _ := generate(t, "routes", "-versioning", strategy)
+			goTest(t, dir, "VERSIONING="+strategy)
+		})
+	}
+}
+
+func TestVersionSpecs(t *testing.T) {
+	// у каждой версии свой набор маршрутов: Method:URL
+	expected := map[string]map[string][]string{
+		"path": {
+			"RouteApi.json":    {"Profile:/user/profile", "Me:/users/me/profile", "Posts:/users/{login}/posts", "Readme:/files/readme", "Files:/files/{path...}", "Create:/user/create"},
+			"RouteApi.v2.json": {"Profile:/user/profile", "Me:/users/me/profile", "Posts:/users/{login}/posts", "Readme:/files/readme", "Files:/files/{path...}", "CreateV2:/v2/user/create"},
+		},
+		"header": {
+			"RouteApi.json":    {"Profile:/user/profile", "Me:/users/me/profile", "Posts:/users/{login}/posts", "Readme:/files/readme", "Files:/files/{path...}", "Create:/user/create"},
+			"RouteApi.v2.json": {"Profile:/user/profile", "Me:/users/me/profile", "Posts:/users/{login}/posts", "Readme:/files/readme", "Files:/files/{path...}", "CreateV2:/user/create"},
+		},
+	}
+	for strategy, files := range expected {
+		specDir := t.TempDir()
+		generate(t, "routes", "-versioning", strategy, "-spec", specDir)
+		for name, routes := range files {
+			data, err := os.ReadFile(filepath.Join(specDir, name))
+			if err != nil {
+				t.Fatalf("%s: %v", strategy, err)
+			}
+			spec := apiSpec{}
+			if err := json.Unmarshal(data, &spec); err != nil {
+				t.Fatalf("%s %s: %v", strategy, name, err)
+			}
+			got := []string{}
+			for _, route := range spec.Routes {
+				got = append(got, route.Method+":"+route.URL)
+			}
+			if !reflect.DeepEqual(got, routes) || spec.Versioning != strategy {
+				t.Errorf("%s %s: expected %v, got %v", strategy, name, routes, got)
+			}
+		}
+	}
+
+	specDir := t.TempDir()
+	generate(t, "routes", "-spec", specDir)
+	data, _ := os.ReadFile(filepath.Join(specDir, "RouteApi.json"))
+	spec := apiSpec{}
+	json.Unmarshal(data, &spec)
+	if params := spec.Routes[2].Params; len(params) != 1 || params[0] != (paramSpec{Name: "login", Type: "string", In: "path", Rules: "required"}) {
+		t.Errorf("unexpected params of Posts: %+v", params)
+	}
+}
+
+func TestSunsetLint(t *testing.T) {
+	warning := "LegacyApi.Legacy: sunset date 2021-01-01 has passed"
+	dir, out := generate(t, "sunset")
+	if !strings.Contains(out, "WARNING "+warning) {
+		t.Errorf("expected warning, got:\n%s", out)
+	}
+	code, err := os.ReadFile(filepath.Join(dir, "api_handlers.go"))
+	if err != nil {
+		t.Errorf("code must be generated despite the warning: %v", err)
+	}
+
+	// deprecated без deprecated_at получает дату генерации
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	if !strings.Contains(out, "WARNING LegacyApi.Documented: deprecated without deprecated_at") {
+		t.Errorf("expected deprecated_at warning, got:\n%s", out)
+	}
+	if deprecation := `Deprecation: "@` + strconv.FormatInt(today.Unix(), 10) + `"`; !strings.Contains(string(code), deprecation) {
+		t.Errorf("generated code has no %s", deprecation)
+	}
+
+	out, err = runGenerator(fixtureModule(t, "sunset"), "-strict")
+	if err == nil || !strings.Contains(out, warning) {
+		t.Errorf("expected failure with -strict, got %v:\n%s", err, out)
+	}
+}
+
+func TestRouteConflicts(t *testing.T) {
+	cases := []struct {
+		url, other string
+		err        string
+	}{
+		{"/files/{path...}/raw", "", "wildcard {path...} must be the last segment"},
+		{"/users/{id}/posts", "/users/{login}", "{id} conflicts with {login}"},
+		{"/user/profile", "/user/profile", "conflicts with another route"},
+	}
+	for _, c := range cases {
+		root := newRouteNode()
+		if c.other != "" {
+			if _, err := root.addRoute(c.other, 0); err != nil {
+				t.Fatalf("%s: unexpected error: %v", c.other, err)
+			}
+		}
+		if _, err := root.addRoute(c.url, 1); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s after %q: expected %q, got %v", c.url, c.other, c.err, err)
+		}
+	}
+}
+
+func TestValidateHookKind(t *testing.T) {
+	cases := map[string]string{
+		"func (p P) Validate() error":                      "plain",
+		"func (p P) Validate(ctx context.Context) error":   "ctx",
+		"func (p *P) Validate(context.Context) error":      "ctx",
+		"func (p P) Validate(x int) error":                 "",
+		"func (p P) Validate() bool":                       "",
+		"func (p P) Validate()":                            "",
+		"func (p P) Validate(ctx context.Context) (error)": "ctx",
+		"func (p P) Validate(a, b context.Context) error":  "",
+		"func (p P) Validate() (a, b error)":               "",
+	}
+	for src, expected := range cases {
+		file, err := parser.ParseFile(token.NewFileSet(), "", "package p\n"+src+" { return nil }", 0)
+		if err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+		if kind := validateHookKind(file.Decls[0].(*ast.FuncDecl).Type); kind != expected {
+			t.Errorf("%s: expected %q, got %q", src, expected, kind)
+		}
+	}
+}
+
+func TestRequiredValidator(t *testing.T) {
+	cases := []struct {
+		fieldType, cond string
+	}{
+		{"string", `if p.Login == "" {`},
+		{"int", `if p.Login == 0 {`},
+	}
+	for _, c := range cases {
+		if code := getValidatorsByTag("login", "Login", c.fieldType, "required"); !strings.HasPrefix(code, c.cond) {
+			t.Errorf("%s: expected %q, got:\n%s", c.fieldType, c.cond, code)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package routes
+
+import (
+	"context"
+)
+
+// ApiError в минимальном виде из задания, без Code и Details
+type ApiError struct {
+	HTTPStatus int
+	Err        error
+}
+
+func (ae ApiError) Error() string {
+	return ae.Err.Error()
+}
+
+func (ae ApiError) Unwrap() error {
+	return ae.Err
+}
+
+// RouteApi отвечает именем вызванного метода и значением параметра пути,
+// чтобы тест видел, какой маршрут выбран
+type RouteApi struct{}
+
+type QueryParams struct {
+	Query string `apivalidator:"paramname=q"`
+}
+
+type LoginParams struct {
+	Login string `apivalidator:"required"`
+}
+
+type FileParams struct {
+	Path string `apivalidator:"required"`
+}
+
+type CreateParams struct {
+	Login string `apivalidator:"required"`
+}
+
+type Result struct {
+	Method string `json:"method"`
+	Value  string `json:"value"`
+}
+
+// apigen:api {"url": "/user/profile", "method": "GET"}
+func (api *RouteApi) Profile(ctx context.Context, in QueryParams) (*Result, error) {
+	return &Result{"Profile", in.Query}, nil
+}
+
+// apigen:api {"url": "/users/me/profile", "method": "GET"}
+func (api *RouteApi) Me(ctx context.Context, in QueryParams) (*Result, error) {
+	return &Result{"Me", in.Query}, nil
+}
+
+// apigen:api {"url": "/users/{login}/posts", "method": "GET"}
+func (api *RouteApi) Posts(ctx context.Context, in LoginParams) (*Result, error) {
+	return &Result{"Posts", in.Login}, nil
+}
+
+// apigen:api {"url": "/files/readme", "method": "GET"}
+func (api *RouteApi) Readme(ctx context.Context, in QueryParams) (*Result, error) {
+	return &Result{"Readme", in.Query}, nil
+}
+
+// apigen:api {"url": "/files/{path...}", "method": "GET"}
+func (api *RouteApi) Files(ctx context.Context, in FileParams) (*Result, error) {
+	return &Result{"Files", in.Path}, nil
+}
+
+// apigen:api {"url": "/user/create", "method": "POST"}
+func (api *RouteApi) Create(ctx context.Context, in CreateParams) (*Result, error) {
+	return &Result{"Create", in.Login}, nil
+}
+
+// apigen:api {"url": "/user/create", "method": "POST", "version": "v2"}
+func (api *RouteApi) CreateV2(ctx context.Context, in CreateParams) (*Result, error) {
+	return &Result{"CreateV2", in.Login}, nil
+}
@@ -0,0 +1,194 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// флаги, с которыми сгенерирован api_handlers.go, передаёт codegen_test.go
+var (
+	trailingSlash = os.Getenv("TRAILING_SLASH")
+	versioning    = os.Getenv("VERSIONING")
+)
+
+// call возвращает статус и результат метода, заголовки передаются парами имя-значение
+func call(t *testing.T, method, target string, header ...string) (*httptest.ResponseRecorder, Result) {
+	t.Helper()
+	var body *strings.Reader
+	if method == http.MethodPost {
+		body = strings.NewReader("login=rvasily")
+	} else {
+		body = strings.NewReader("")
+	}
+	req := httptest.NewRequest(method, target, body)
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	(&RouteApi{}).ServeHTTP(rec, req)
+
+	response := struct {
+		Response Result `json:"response"`
+	}{}
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s %s: bad body %q: %v", method, target, rec.Body.String(), err)
+		}
+	}
+	return rec, response.Response
+}
+
+func TestRoutes(t *testing.T) {
+	cases := []struct {
+		path   string
+		status int
+		result Result
+	}{
+		{"/user/profile?q=1", http.StatusOK, Result{"Profile", "1"}},
+		{"/users/me/profile", http.StatusOK, Result{"Me", ""}},
+		// статическая ветка "me" не подошла - откат к {login}
+		{"/users/me/posts", http.StatusOK, Result{"Posts", "me"}},
+		{"/users/rvasily/posts", http.StatusOK, Result{"Posts", "rvasily"}},
+		{"/users/rvasily", http.StatusNotFound, Result{}},
+		{"/users/rvasily/posts/1", http.StatusNotFound, Result{}},
+		{"/files/readme", http.StatusOK, Result{"Readme", ""}},
+		// статический сегмент важнее {path...}, но не перекрывает более длинные пути
+		{"/files/readme/old", http.StatusOK, Result{"Files", "readme/old"}},
+		{"/files/docs/a/b.txt", http.StatusOK, Result{"Files", "docs/a/b.txt"}},
+	}
+	for _, c := range cases {
+		rec, result := call(t, http.MethodGet, c.path)
+		if rec.Code != c.status || result != c.result {
+			t.Errorf("%s: expected %d %+v, got %d %+v", c.path, c.status, c.result, rec.Code, result)
+		}
+	}
+}
+
+func TestTrailingSlash(t *testing.T) {
+	cases := []struct {
+		path     string
+		location string
+		// статус с политикой ignore
+		status int
+	}{
+		{"/user/profile/?q=1", "/user/profile?q=1", http.StatusOK},
+		{"/users/me/posts/", "/users/me/posts", http.StatusOK},
+		// "/files/" подходит под {path...} с пустым path, а он обязателен
+		{"/files", "/files/", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		rec, _ := call(t, http.MethodGet, c.path)
+		switch trailingSlash {
+		case "redirect":
+			if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != c.location {
+				t.Errorf("%s: expected 308 to %s, got %d %q", c.path, c.location, rec.Code, rec.Header().Get("Location"))
+			}
+		case "ignore":
+			if rec.Code != c.status {
+				t.Errorf("%s: expected %d, got %d %s", c.path, c.status, rec.Code, rec.Body.String())
+			}
+		default:
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("%s: expected 404, got %d", c.path, rec.Code)
+			}
+		}
+	}
+}
+
+func TestTrailingSlashMounted(t *testing.T) {
+	mux, err := NewMux(Mount{"/other", &RouteApi{}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/other/user/profile/?q=1", nil))
+
+	switch trailingSlash {
+	case "redirect":
+		// префикс монтирования остаётся в Location, иначе редирект уведёт мимо API
+		if location := rec.Header().Get("Location"); rec.Code != http.StatusPermanentRedirect || location != "/other/user/profile?q=1" {
+			t.Errorf("expected 308 to /other/user/profile?q=1, got %d %q", rec.Code, location)
+		}
+	case "ignore":
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d %s", rec.Code, rec.Body.String())
+		}
+	default:
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", rec.Code)
+		}
+	}
+}
+
+func TestMount(t *testing.T) {
+	// {path...} рядом с /files/readme и версии одного Url - не пересечения внутри одного API
+	mux, err := NewMux(Mount{"/api", &RouteApi{}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/files/readme", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"Readme"`) {
+		t.Errorf("expected Readme, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	if _, err := NewMux(Mount{"/api", &RouteApi{}}, Mount{"/api/files", &RouteApi{}}); err == nil {
+		t.Errorf("expected overlap of /api/files/{path...} with the second mount")
+	}
+}
+
+func TestVersioning(t *testing.T) {
+	type versionCase struct {
+		path   string
+		header []string
+		// "" - маршрута нет
+		method string
+	}
+	cases := map[string][]versionCase{
+		"header": {
+			{"/user/create", nil, "Create"},
+			{"/user/create", []string{"Accept-Version", "v2"}, "CreateV2"},
+			// неизвестная версия достаётся методу без версии
+			{"/user/create", []string{"Accept-Version", "v3"}, "Create"},
+			{"/user/create", []string{"Accept", "application/json; version=v2"}, "Create"},
+			{"/v2/user/create", nil, ""},
+		},
+		"media-type": {
+			{"/user/create", []string{"Accept", "application/json"}, "Create"},
+			{"/user/create", []string{"Accept", "application/xml;q=0.5, application/json; version=v2"}, "CreateV2"},
+			{"/user/create", []string{"Accept-Version", "v2"}, "Create"},
+			{"/v2/user/create", nil, ""},
+		},
+	}[versioning]
+	if cases == nil {
+		cases = []versionCase{
+			{"/user/create", nil, "Create"},
+			{"/v2/user/create", nil, "CreateV2"},
+			{"/user/create", []string{"Accept-Version", "v2"}, "Create"},
+		}
+	}
+
+	vary := map[string]string{"header": "Accept-Version", "media-type": "Accept"}[versioning]
+	for _, c := range cases {
+		rec, result := call(t, http.MethodPost, c.path, c.header...)
+		if c.method == "" {
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("%s %v: expected 404, got %d", c.path, c.header, rec.Code)
+			}
+			continue
+		}
+		if rec.Code != http.StatusOK || result.Method != c.method || result.Value != "rvasily" {
+			t.Errorf("%s %v: expected %s, got %d %+v", c.path, c.header, c.method, rec.Code, result)
+		}
+		if vary != "" && c.path == "/user/create" && !strings.Contains(strings.Join(rec.Header().Values("Vary"), ","), vary) {
+			t.Errorf("%s %v: expected Vary %s, got %q", c.path, c.header, vary, rec.Header().Values("Vary"))
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package sunset
+
+import (
+	"context"
+)
+
+type ApiError struct {
+	HTTPStatus int
+	Err        error
+}
+
+func (ae ApiError) Error() string {
+	return ae.Err.Error()
+}
+
+func (ae ApiError) Unwrap() error {
+	return ae.Err
+}
+
+// LegacyApi - метод, чей sunset уже прошёл
+type LegacyApi struct{}
+
+type LegacyParams struct {
+	Login string `apivalidator:"required"`
+}
+
+type LegacyResult struct {
+	Login string `json:"login"`
+}
+
+// apigen:api {"url": "/legacy", "deprecated_at": "2020-01-01", "sunset": "2021-01-01", "successor": "/current"}
+func (api *LegacyApi) Legacy(ctx context.Context, in LegacyParams) (*LegacyResult, error) {
+	return &LegacyResult{in.Login}, nil
+}
+
+// apigen:api {"url": "/documented", "deprecated": true, "sunset": "2099-01-01", "successor": "/current"}
+func (api *LegacyApi) Documented(ctx context.Context, in LegacyParams) (*LegacyResult, error) {
+	return &LegacyResult{in.Login}, nil
+}
@@ -0,0 +1,1433 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// swap подменяет глобальную настройку на время теста, прежнее значение возвращается в t.Cleanup
+func swap[T any](t *testing.T, global *T, value T) {
+	old := *global
+	*global = value
+	t.Cleanup(func() { *global = old })
+}
+
+// useMetrics подменяет Metrics чистым реестром на время теста
+func useMetrics(t *testing.T) *PrometheusMetrics {
+	metrics := NewPrometheusMetrics()
+	swap[MetricsHook](t, &Metrics, metrics)
+	return metrics
+}
+
+// scrape возвращает метрики в текстовом формате, как их видит Prometheus
+func scrape(metrics *PrometheusMetrics) string {
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return rec.Body.String()
+}
+
+// postForm - POST с формой в теле и авторизацией, как у методов с "auth": true
+func postForm(path, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Auth", "100500")
+	return req
+}
+
+// waitFor ждёт, пока cond не станет true, но не дольше секунды
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition was not met in 1s")
+		}
+	}
+}
+
+// serve прогоняет запрос через handler без сети
+func serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestValidateHook(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	runTests(t, ts, []Case{
+		Case{ // Validate() error - обычная ошибка превращается в 400
+			Path:   ApiUserProfile,
+			Query:  "login=rva+sily",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "login must not contain spaces",
+			},
+		},
+	})
+
+	other := httptest.NewServer(NewOtherApi())
+	defer other.Close()
+
+	runTests(t, other, []Case{
+		Case{ // Validate(ctx) error - ApiError сохраняет свой статус
+			Path:   ApiUserCreate,
+			Method: http.MethodPost,
+			Query:  "username=root&level=1&class=warrior&account_name=Vasily",
+			Status: http.StatusConflict,
+			Auth:   true,
+			Result: CR{
+				"error": "username root is reserved",
+			},
+		},
+		Case{ // теги проверяются раньше пользовательской валидации
+			Path:   ApiUserCreate,
+			Method: http.MethodPost,
+			Query:  "username=root&level=100&class=warrior&account_name=Vasily",
+			Status: http.StatusBadRequest,
+			Auth:   true,
+			Result: CR{
+				"error": "level must be <= 50",
+			},
+		},
+	})
+}
+
+func TestParamsValidate(t *testing.T) {
+	cases := []struct {
+		params CreateParams
+		err    string
+	}{
+		{CreateParams{Login: "mr.moderator", Status: "user", Age: 32}, ""},
+		{CreateParams{Status: "user"}, "login must me not empty"},
+		{CreateParams{Login: "short", Status: "user"}, "login len must be >= 10"},
+		{CreateParams{Login: "mr.moderator", Status: "root"}, "status must be one of [user, moderator, admin]"},
+		{CreateParams{Login: "mr.moderator", Status: "user", Age: 256}, "age must be <= 128"},
+	}
+
+	for idx, item := range cases {
+		err := item.params.Validate()
+		if item.err == "" && err != nil {
+			t.Errorf("[%d] unexpected error: %v", idx, err)
+			continue
+		}
+		if item.err != "" && (err == nil || err.Error() != item.err) {
+			t.Errorf("[%d] expected error %q, got %v", idx, item.err, err)
+		}
+	}
+
+	// у ProfileParams есть свой Validate, проверки тегов доступны через ValidateTags
+	if err := (&ProfileParams{}).ValidateTags(); err == nil {
+		t.Errorf("expected required error for empty login")
+	}
+}
+
+func TestParamsCheck(t *testing.T) {
+	ctx := context.Background()
+
+	// Check проверяет теги и у структур со своим Validate
+	if err := (&ProfileParams{}).Check(ctx); err == nil || err.Error() != "login must me not empty" {
+		t.Errorf("expected required error, got %v", err)
+	}
+	if err := (&ProfileParams{Login: "rva sily"}).Check(ctx); err == nil || err.Error() != "login must not contain spaces" {
+		t.Errorf("expected hook error, got %v", err)
+	}
+	var apiErr ApiError
+	if err := (&OtherCreateParams{Username: "admin", Level: 1}).Check(ctx); !errors.As(err, &apiErr) || apiErr.HTTPStatus != http.StatusConflict {
+		t.Errorf("expected ApiError 409 from hook, got %v", err)
+	}
+
+	// значения по умолчанию подставляются без BindRequest
+	params := CreateParams{Login: "mr.moderator", Age: 32}
+	if err := params.Check(ctx); err != nil || params.Status != "user" {
+		t.Errorf("expected default status, got %q %v", params.Status, err)
+	}
+}
+
+func TestParamsBindRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/user/create?login=mr.moderator&age=32&full_name=Ivan_Ivanov", nil)
+
+	params := CreateParams{}
+	if err := params.BindRequest(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := CreateParams{Login: "mr.moderator", Name: "Ivan_Ivanov", Status: "user", Age: 32}
+	if params != expected {
+		t.Errorf("results not match\nGot: %#v\nExpected: %#v", params, expected)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/user/create?login=mr.moderator&age=ten", nil)
+	if err := (&CreateParams{}).BindRequest(req); err == nil || err.Error() != "age must be int" {
+		t.Errorf("expected int error, got %v", err)
+	}
+}
+
+func TestAggregateErrors(t *testing.T) {
+	ts := httptest.NewServer(NewOtherApi())
+	defer ts.Close()
+
+	runTests(t, ts, []Case{
+		Case{ // все невалидные параметры одним ответом, по одной ошибке на параметр
+			Path:   "/user/check",
+			Method: http.MethodPost,
+			Query:  "level=ten&class=barbarian",
+			Status: http.StatusBadRequest,
+			Auth:   true,
+			Result: CR{
+				"error": "validation failed",
+				"fields": []CR{
+					CR{"param": "level", "message": "must be int"},
+					CR{"param": "username", "message": "must me not empty"},
+					CR{"param": "class", "message": "must be one of [warrior, sorcerer, rouge]"},
+				},
+			},
+		},
+		Case{
+			Path:   "/user/check",
+			Method: http.MethodPost,
+			Query:  "username=I3apBap&level=1&account_name=Vasily",
+			Status: http.StatusOK,
+			Auth:   true,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id":        0,
+					"login":     "I3apBap",
+					"full_name": "Vasily",
+					"level":     1,
+				},
+			},
+		},
+	})
+
+	err := (&CreateParams{Login: "short", Status: "root", Age: -1}).ValidateAll()
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("expected 3 validation errors, got %#v", err)
+	}
+	if errs[0] != (FieldError{"login", "len must be >= 10"}) {
+		t.Errorf("unexpected first error: %#v", errs[0])
+	}
+}
+
+func TestProblemErrorEncoder(t *testing.T) {
+	swap(t, &EncodeError, ProblemErrorEncoder)
+
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	cases := []Case{
+		Case{ // routing
+			Path:   "/user/unknown",
+			Status: http.StatusNotFound,
+			Result: CR{"type": "about:blank", "title": "Not Found", "status": 404, "detail": "unknown method", "instance": "/user/unknown"},
+		},
+		Case{ // авторизация
+			Path:   ApiUserCreate,
+			Method: http.MethodPost,
+			Status: http.StatusForbidden,
+			Result: CR{"type": "about:blank", "title": "Forbidden", "status": 403, "detail": "unauthorized", "instance": ApiUserCreate},
+		},
+		Case{ // валидация
+			Path:   ApiUserProfile,
+			Status: http.StatusBadRequest,
+			Result: CR{"type": "about:blank", "title": "Bad Request", "status": 400, "detail": "login must me not empty", "instance": ApiUserProfile},
+		},
+		Case{ // ошибка метода
+			Path:   ApiUserProfile,
+			Query:  "login=not_exist_user",
+			Status: http.StatusNotFound,
+			Result: CR{"type": "about:blank", "title": "Not Found", "status": 404, "detail": "user not exist", "instance": ApiUserProfile},
+		},
+	}
+	runTests(t, ts, cases)
+
+	resp, err := client.Get(ts.URL + "/user/unknown")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("expected problem+json content type, got %q", ct)
+	}
+}
+
+func TestErrorMapping(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	runTests(t, ts, []Case{
+		Case{ // sentinel-ошибка из аннотации, обёрнутая через %w
+			Path:   ApiUserProfile,
+			Query:  "login=banned_user",
+			Status: http.StatusForbidden,
+			Result: CR{
+				"error": "profile banned_user: user banned",
+			},
+		},
+		Case{ // обёрнутая ApiError сохраняет статус, код и подробности
+			Path:   ApiUserProfile,
+			Query:  "login=deleted_user",
+			Status: http.StatusGone,
+			Result: CR{
+				"error":   "profile deleted_user: user deleted",
+				"code":    "user_deleted",
+				"details": CR{"login": "deleted_user"},
+			},
+		},
+	})
+}
+
+func TestPanicRecovery(t *testing.T) {
+	var recovered interface{}
+	swap(t, &PanicHook, func(r *http.Request, rec interface{}, stack []byte) {
+		recovered = rec
+	})
+
+	// у пустой MyApi нет мьютекса - Profile паникует
+	ts := httptest.NewServer(&MyApi{})
+	defer ts.Close()
+
+	runTests(t, ts, []Case{
+		Case{
+			Path:   ApiUserProfile,
+			Query:  "login=rvasily",
+			Status: http.StatusInternalServerError,
+			Result: CR{
+				"error": "internal server error",
+			},
+		},
+	})
+
+	if recovered == nil {
+		t.Errorf("panic hook was not called")
+	}
+}
+
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingWriter) Write([]byte) (int, error) {
+	return 0, fmt.Errorf("connection reset")
+}
+
+func TestWriteErrorHook(t *testing.T) {
+	var writeErr error
+	swap(t, &WriteErrorHook, func(err error) {
+		writeErr = err
+	})
+
+	req := httptest.NewRequest(http.MethodGet, ApiUserProfile+"?login=rvasily", nil)
+	NewMyApi().ServeHTTP(failingWriter{httptest.NewRecorder()}, req)
+
+	if writeErr == nil || writeErr.Error() != "connection reset" {
+		t.Errorf("expected write error in hook, got %v", writeErr)
+	}
+}
+
+func TestCallWithTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	start := time.Now()
+	// метод не следит за ctx, но ответ всё равно приходит по дедлайну
+	_, err := callWithTimeout(context.Background(), 10*time.Millisecond, func(ctx context.Context) (*User, error) {
+		<-release
+		return &User{}, nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timeout took too long: %v", elapsed)
+	}
+
+	user, err := callWithTimeout(context.Background(), time.Second, func(ctx context.Context) (*User, error) {
+		return &User{ID: 42}, nil
+	})
+	if err != nil || user.ID != 42 {
+		t.Errorf("unexpected result: %v, %v", user, err)
+	}
+
+	defer func() {
+		recovered, ok := recover().(goroutinePanic)
+		if !ok || recovered.value != "boom" || len(recovered.stack) == 0 {
+			t.Errorf("expected panic to be passed with stack, got %#v", recovered)
+		}
+	}()
+	callWithTimeout(context.Background(), time.Second, func(ctx context.Context) (*User, error) {
+		panic("boom")
+	})
+}
+
+func TestRouteTimeout(t *testing.T) {
+	// без timeout_status отвечает 504, метод при этом не следит за ctx
+	start := time.Now()
+	rec := serve(NewMyApi(), postForm(ApiUserCreate, "login=slow_timeout_user&age=20"))
+	if rec.Code != http.StatusGatewayTimeout || !strings.Contains(rec.Body.String(), "context deadline exceeded") {
+		t.Errorf("expected 504, got %d %s", rec.Code, rec.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed >= slowDelay {
+		t.Errorf("response must not wait for the method, took %v", elapsed)
+	}
+
+	// timeout_status из аннотации
+	if rec := serve(NewOtherApi(), postForm("/user/check", "username=slow_checker&level=1")); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 from timeout_status, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(NewOtherApi(), postForm("/user/check", "username=fast_checker&level=1")); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 before deadline, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// отключение клиента - не ошибка сервера
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if rec := serve(NewMyApi(), postForm(ApiUserCreate, "login=slow_canceled_user&age=20").WithContext(ctx)); rec.Code != StatusClientClosedRequest {
+		t.Errorf("expected 499 for canceled request, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	calls := []string{}
+	logging := func(ctx context.Context, route RouteInfo, params interface{}, next CallFunc) (interface{}, error) {
+		calls = append(calls, route.MethodName)
+		if p, ok := params.(*CreateParams); ok {
+			calls = append(calls, p.Login)
+		}
+		return next(ctx)
+	}
+	// перехватчик может прервать вызов метода своей ошибкой
+	authOnly := func(ctx context.Context, route RouteInfo, params interface{}, next CallFunc) (interface{}, error) {
+		if route.Auth && route.URL == ApiUserCreate && params.(*CreateParams).Status == "admin" {
+			return nil, ApiError{HTTPStatus: http.StatusForbidden, Err: fmt.Errorf("admins are created manually")}
+		}
+		return next(ctx)
+	}
+
+	ts := httptest.NewServer(NewMyApiHandler(NewMyApi(), logging, authOnly))
+	defer ts.Close()
+
+	runTests(t, ts, []Case{
+		Case{
+			Path:   ApiUserCreate,
+			Method: http.MethodPost,
+			Query:  "login=new_admin_user&age=32&status=admin",
+			Status: http.StatusForbidden,
+			Auth:   true,
+			Result: CR{
+				"error": "admins are created manually",
+			},
+		},
+		Case{
+			Path:   ApiUserProfile,
+			Query:  "login=rvasily",
+			Status: http.StatusOK,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id":        42,
+					"login":     "rvasily",
+					"full_name": "Vasily Romanov",
+					"status":    20,
+				},
+			},
+		},
+	})
+
+	expected := []string{"Create", "new_admin_user", "Profile"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("unexpected interceptor calls: %v", calls)
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	metrics := useMetrics(t)
+
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	for _, path := range []string{"/user/profile?login=rvasily", "/user/profile?login=rvasily", "/user/profile", "/user/unknown"} {
+		resp, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	body := scrape(metrics)
+
+	expected := []string{
+		`apigen_requests_total{api="MyApi",method="Profile",status="200"} 2`,
+		`apigen_requests_total{api="MyApi",method="Profile",status="400"} 1`,
+		`apigen_requests_total{api="MyApi",method="unknown",status="404"} 1`,
+		`apigen_request_errors_total{api="MyApi",method="Profile",status="400"} 1`,
+		`apigen_request_duration_seconds_bucket{api="MyApi",method="Profile",le="+Inf"} 3`,
+		`apigen_request_duration_seconds_count{api="MyApi",method="Profile"} 3`,
+		"# TYPE apigen_request_duration_seconds histogram",
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics has no line %q\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, `apigen_request_errors_total{api="MyApi",method="Profile",status="200"}`) {
+		t.Errorf("successful requests must not be counted as errors")
+	}
+}
+
+func TestAccessLogAndRequestID(t *testing.T) {
+	logs := &bytes.Buffer{}
+	swap(t, &AccessLog, slog.New(slog.NewJSONHandler(logs, nil)))
+	swap(t, &PrincipalFunc, func(r *http.Request) string {
+		if r.Header.Get("X-Auth") != "" {
+			return "token-user"
+		}
+		return ""
+	})
+
+	ctxRequestID := ""
+	saveID := func(ctx context.Context, route RouteInfo, params interface{}, next CallFunc) (interface{}, error) {
+		ctxRequestID = RequestIDFromContext(ctx)
+		return next(ctx)
+	}
+	ts := httptest.NewServer(NewMyApiHandler(NewMyApi(), saveID))
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+ApiUserProfile+"?login=rvasily", nil)
+	req.Header.Set("X-Request-Id", "req-1")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+
+	if id := resp.Header.Get("X-Request-Id"); id != "req-1" {
+		t.Errorf("expected request id to be echoed, got %q", id)
+	}
+	if ctxRequestID != "req-1" {
+		t.Errorf("expected request id in method context, got %q", ctxRequestID)
+	}
+
+	// без заголовка id генерируется
+	generatedID := serve(ts.Config.Handler, postForm(ApiUserCreate, "login=short&age=20")).Header().Get("X-Request-Id")
+	if len(generatedID) != 32 {
+		t.Errorf("expected generated request id, got %q", generatedID)
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 access log lines, got %d:\n%s", len(lines), logs.String())
+	}
+
+	entry := map[string]interface{}{}
+	json.Unmarshal([]byte(lines[0]), &entry)
+	if entry["request_id"] != "req-1" || entry["method"] != "Profile" || entry["route"] != ApiUserProfile || entry["status"] != float64(200) {
+		t.Errorf("unexpected access log entry: %s", lines[0])
+	}
+
+	entry = map[string]interface{}{}
+	json.Unmarshal([]byte(lines[1]), &entry)
+	if entry["request_id"] != generatedID || entry["status"] != float64(400) ||
+		entry["principal"] != "token-user" || entry["validation"] != "login len must be >= 10" {
+		t.Errorf("unexpected access log entry: %s", lines[1])
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := &InMemorySpanExporter{}
+	swap[SpanExporter](t, &Tracer, exporter)
+
+	var methodSpan SpanContext
+	saveSpan := func(ctx context.Context, route RouteInfo, params interface{}, next CallFunc) (interface{}, error) {
+		methodSpan, _ = SpanContextFromContext(ctx)
+		return next(ctx)
+	}
+	ts := httptest.NewServer(NewMyApiHandler(NewMyApi(), saveSpan))
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+ApiUserProfile+"?login=not_exist_user", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+
+	spans := exporter.Spans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name != ApiUserProfile || span.Status != http.StatusNotFound || span.Err != "user not exist" {
+		t.Errorf("unexpected span: %#v", span)
+	}
+	if span.Context.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("span does not continue incoming trace: %#v", span)
+	}
+	if methodSpan != span.Context {
+		t.Errorf("method context has %#v, expected %#v", methodSpan, span.Context)
+	}
+	if tp := span.Context.Traceparent(); tp != "00-4bf92f3577b34da6a3ce929d0e0e4736-"+span.Context.SpanID+"-01" {
+		t.Errorf("unexpected traceparent %q", tp)
+	}
+
+	// битый traceparent - начинается новая трасса
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+ApiUserProfile+"?login=rvasily", nil)
+	req.Header.Set("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+
+	spans = exporter.Spans()
+	if len(spans) != 2 || spans[1].ParentSpanID != "" || len(spans[1].Context.TraceID) != 32 {
+		t.Errorf("expected new root span, got %#v", spans)
+	}
+
+	// несэмплированный родитель: контекст доходит до метода, span не экспортируется
+	req = httptest.NewRequest(http.MethodGet, ApiUserProfile+"?login=rvasily", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	serve(ts.Config.Handler, req)
+	if methodSpan.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || methodSpan.Sampled {
+		t.Errorf("method must get unsampled trace context, got %#v", methodSpan)
+	}
+	if spans = exporter.Spans(); len(spans) != 2 {
+		t.Errorf("unsampled span must not be exported, got %#v", spans)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	now := time.Now()
+	limiter := NewTokenBucketLimiter()
+	limiter.Now = func() time.Time { return now }
+	swap[RateLimiter](t, &RateLimitStore, limiter)
+
+	api := NewOtherApi()
+	create := func(client string) *httptest.ResponseRecorder {
+		req := postForm(ApiUserCreate, "username=I3apBap&level=1")
+		req.Header.Set("X-Client", client)
+		return serve(api, req)
+	}
+
+	// burst 20 проходит сразу
+	for i := 0; i < 20; i++ {
+		if rec := create("mobile"); rec.Code != http.StatusOK {
+			t.Fatalf("[%d] expected 200, got %d", i, rec.Code)
+		}
+	}
+
+	rec := create("mobile")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rec.Code)
+	}
+	if retry := rec.Header().Get("Retry-After"); retry != "1" {
+		t.Errorf("expected Retry-After 1, got %q", retry)
+	}
+
+	// у другого клиента своя корзина
+	if rec := create("web"); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 for other client, got %d", rec.Code)
+	}
+
+	// при 10/s через 100ms появляется один токен
+	now = now.Add(100 * time.Millisecond)
+	if rec := create("mobile"); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 after refill, got %d", rec.Code)
+	}
+	if rec := create("mobile"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 after single token, got %d", rec.Code)
+	}
+}
+
+func TestBulkhead(t *testing.T) {
+	metrics := useMetrics(t)
+
+	api := NewOtherApi()
+	check := func() *httptest.ResponseRecorder {
+		return serve(api, postForm("/user/check", "username=I3apBap&level=1"))
+	}
+
+	// все 4 места заняты - запрос ждёт queue_timeout и получает 503
+	for i := 0; i < 4; i++ {
+		bulkheadOtherApiCheck <- struct{}{}
+	}
+	start := time.Now()
+	if rec := check(); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("request was not queued: %v", elapsed)
+	}
+
+	// место освободилось, пока запрос стоял в очереди
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-bulkheadOtherApiCheck
+	}()
+	if rec := check(); rec.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rec.Code)
+	}
+
+	if line := `apigen_requests_in_flight{api="OtherApi",method="Check"} 3`; !strings.Contains(scrape(metrics), line) {
+		t.Errorf("metrics has no line %q\n%s", line, scrape(metrics))
+	}
+
+	for i := 0; i < 3; i++ {
+		<-bulkheadOtherApiCheck
+	}
+}
+
+func TestBulkheadHoldsSlotUntilMethodEnds(t *testing.T) {
+	// медленные методы прошлых тестов могут ещё работать после их дедлайнов
+	waitFor(t, func() bool { return slowRunning.Load() == 0 })
+	slowMaxRunning.Store(0)
+	api := NewOtherApi()
+
+	// Check отвечает 503 по timeout через 100ms, а метод работает ещё 300ms
+	statuses := make(chan int, 16)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses <- serve(api, postForm("/user/check", "username=slow_bulkhead&level=1")).Code
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	if max := slowMaxRunning.Load(); max > 4 {
+		t.Errorf("max_inflight 4, but %d methods ran at once", max)
+	}
+	timedOut := 0
+	for status := range statuses {
+		if status == http.StatusServiceUnavailable {
+			timedOut++
+		}
+	}
+	if timedOut != 16 {
+		t.Errorf("expected 16 answers 503, got %d", timedOut)
+	}
+
+	// места освобождаются, когда методы завершаются
+	waitFor(t, func() bool { return len(bulkheadOtherApiCheck) == 0 })
+}
+
+func TestLimitsSharedAcrossInstances(t *testing.T) {
+	now := time.Now()
+	limiter := NewTokenBucketLimiter()
+	limiter.Now = func() time.Time { return now }
+	swap[RateLimiter](t, &RateLimitStore, limiter)
+
+	mux, err := NewMux(Mount{"/a", NewOtherApi()}, Mount{"/b", NewOtherApi()})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// burst 20 на маршрут и клиента, какой бы экземпляр ни отвечал
+	for i := 0; i < 20; i++ {
+		prefix := []string{"/a", "/b"}[i%2]
+		if rec := serve(mux, postForm(prefix+ApiUserCreate, "username=I3apBap&level=1")); rec.Code != http.StatusOK {
+			t.Fatalf("[%d] expected 200, got %d", i, rec.Code)
+		}
+	}
+	if rec := serve(NewOtherApi(), postForm(ApiUserCreate, "username=I3apBap&level=1")); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 from new instance, got %d", rec.Code)
+	}
+
+	// места bulkhead тоже общие
+	for i := 0; i < 4; i++ {
+		bulkheadOtherApiCheck <- struct{}{}
+	}
+	defer func() {
+		for i := 0; i < 4; i++ {
+			<-bulkheadOtherApiCheck
+		}
+	}()
+	if rec := serve(mux, postForm("/b/user/check", "username=I3apBap&level=1")); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 from other mount, got %d", rec.Code)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	do := func(method, path, origin, requestMethod string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		req.Header.Set("Origin", origin)
+		if requestMethod != "" {
+			req.Header.Set("Access-Control-Request-Method", requestMethod)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// preflight по настройкам всего API
+	resp := do(http.MethodOptions, ApiUserCreate, "https://app.example.com", http.MethodPost)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 for preflight, got %d", resp.StatusCode)
+	}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "POST",
+		"Access-Control-Allow-Headers":     "X-Auth, Content-Type",
+		"Access-Control-Max-Age":           "600",
+		"Vary":                             "Origin",
+	}
+	for header, value := range expected {
+		if got := resp.Header.Get(header); got != value {
+			t.Errorf("preflight %s: expected %q, got %q", header, value, got)
+		}
+	}
+
+	if resp := do(http.MethodOptions, ApiUserCreate, "https://evil.example.com", http.MethodPost); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for unknown origin, got %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodOptions, ApiUserCreate, "https://app.example.com", http.MethodDelete); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for not allowed method, got %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodOptions, "/user/unknown", "https://app.example.com", http.MethodPost); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown route, got %d", resp.StatusCode)
+	}
+
+	// настройки метода заменяют настройки API
+	resp = do(http.MethodGet, ApiUserProfile+"?login=rvasily", "https://other.example.com", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("expected wildcard origin for profile, got %d %q", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+
+	// CORS-заголовки есть и у ответов с ошибкой
+	resp = do(http.MethodPost, ApiUserCreate, "https://app.example.com", "")
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("expected CORS headers on error, got %d %q", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestBodyLimits(t *testing.T) {
+	api := NewMyApi()
+	create := func(contentType, body string) *httptest.ResponseRecorder {
+		req := postForm(ApiUserCreate, body)
+		req.Header.Set("Content-Type", contentType)
+		return serve(api, req)
+	}
+
+	body := "login=new_moderator&age=32&full_name=" + strings.Repeat("a", 5000)
+	if rec := create("application/x-www-form-urlencoded", body); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d", rec.Code)
+	}
+	if rec := create("application/json", `{"login": "new_moderator"}`); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415, got %d", rec.Code)
+	}
+	if rec := create("application/x-www-form-urlencoded; charset=utf-8", "login=body_limits_user&age=32"); rec.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rec.Code)
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	get := func(path, accept string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		req.Header.Set("Accept", accept)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, _ := get(ApiUserProfile+"?login=rvasily", "")
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("expected json by default, got %q", ct)
+	}
+
+	resp, body := get(ApiUserProfile+"?login=rvasily", "text/html, application/xml;q=0.9, */*;q=0.1")
+	if ct := resp.Header.Get("Content-Type"); ct != "application/xml; charset=utf-8" {
+		t.Errorf("expected xml, got %q", ct)
+	}
+	if !strings.Contains(body, "<response><error></error><response><full_name>Vasily Romanov</full_name><id>42</id><login>rvasily</login><status>20</status></response></response>") {
+		t.Errorf("unexpected xml body: %s", body)
+	}
+
+	// ошибки тоже пишутся в запрошенном формате
+	resp, body = get(ApiUserProfile+"?login=not_exist_user", "application/msgpack")
+	expected := "\x81\xa5error\xaeuser not exist"
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Content-Type") != "application/msgpack" || body != expected {
+		t.Errorf("unexpected msgpack error: %d %q %q", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+
+	resp, _ = get(ApiUserProfile+"?login=rvasily", "text/html")
+	if resp.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("expected 406, got %d", resp.StatusCode)
+	}
+
+	// produces из аннотации ограничивает форматы
+	req := postForm(ApiUserCreate, "username=I3apBap&level=1")
+	req.Header.Set("Accept", "application/msgpack")
+	if rec := serve(NewOtherApi(), req); rec.Code != http.StatusNotAcceptable {
+		t.Errorf("expected 406 for msgpack, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestNegotiateUnregistered(t *testing.T) {
+	xmlEncoder := ResponseEncoders["application/xml"]
+	delete(ResponseEncoders, "application/xml")
+	defer func() { ResponseEncoders["application/xml"] = xmlEncoder }()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if _, ok := negotiate(req, []string{"application/xml"}); ok {
+		t.Errorf("expected no encoder without Accept")
+	}
+	req.Header.Set("Accept", "application/xml, application/json;q=0.5")
+	if encoder, ok := negotiate(req, []string{"application/xml", "application/json"}); !ok || encoder.ContentType() != "application/json; charset=utf-8" {
+		t.Errorf("expected fallback to json, got %v", encoder)
+	}
+}
+
+func TestXMLEncoderKeys(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := XMLEncoder{}.Encode(buf, Response{"ok": 1, "has space": 2, "1st": 3, "<b>": 4, "xmlns": 5})
+	if err != nil {
+		t.Fatalf("encode error: %v", err)
+	}
+
+	expected := `<response><entry key="1st">3</entry><entry key="&lt;b&gt;">4</entry><entry key="has space">2</entry><ok>1</ok><entry key="xmlns">5</entry></response>`
+	if !strings.HasSuffix(buf.String(), expected) {
+		t.Errorf("unexpected xml\nGot: %s\nExpected: %s", buf.String(), expected)
+	}
+	var tree struct{}
+	if err := xml.Unmarshal(buf.Bytes(), &tree); err != nil {
+		t.Errorf("invalid xml: %v", err)
+	}
+}
+
+func TestMsgpackEncoder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := MsgpackEncoder{}.Encode(buf, Response{
+		"a": []interface{}{1, -1, -100, 300, 70000, 1.5, true, nil},
+		"b": strings.Repeat("x", 40),
+	})
+	if err != nil {
+		t.Fatalf("encode error: %v", err)
+	}
+
+	expected := "\x82" +
+		"\xa1a\x98\x01\xff\xd0\x9c\xcd\x01\x2c\xce\x00\x01\x11\x70\xcb\x3f\xf8\x00\x00\x00\x00\x00\x00\xc3\xc0" +
+		"\xa1b\xd9\x28" + strings.Repeat("x", 40)
+	if buf.String() != expected {
+		t.Errorf("unexpected msgpack\nGot: %x\nExpected: %x", buf.String(), expected)
+	}
+}
+
+func TestTypedResponseMatchesMap(t *testing.T) {
+	rec := httptest.NewRecorder()
+	if err := writeResponse(rec, JSONEncoder{}, &responseMyApiProfile{Response: benchUser}, http.StatusOK); err != nil {
+		t.Fatalf("encode error: %v", err)
+	}
+	expected, _ := json.Marshal(Response{"error": "", "response": benchUser})
+	if rec.Body.String() != string(expected)+"\n" {
+		t.Errorf("typed response differs\nGot: %s\nExpected: %s", rec.Body.String(), expected)
+	}
+}
+
+func TestResponseEncodingError(t *testing.T) {
+	// перехватчик подменяет результат на значение, которое нельзя закодировать
+	broken := func(ctx context.Context, route RouteInfo, params interface{}, next CallFunc) (interface{}, error) {
+		return make(chan int), nil
+	}
+	var hookErr error
+	swap(t, &WriteErrorHook, func(err error) {
+		hookErr = err
+	})
+	ts := httptest.NewServer(NewMyApiHandler(NewMyApi(), broken))
+	defer ts.Close()
+
+	// подробности ошибки кодирования не уходят клиенту
+	runTests(t, ts, []Case{
+		Case{
+			Path:   ApiUserProfile,
+			Query:  "login=rvasily",
+			Status: http.StatusInternalServerError,
+			Result: CR{
+				"error": "internal server error",
+			},
+		},
+	})
+	if hookErr == nil || hookErr.Error() != "encode response: json: unsupported type: chan int" {
+		t.Errorf("expected encode error in hook, got %v", hookErr)
+	}
+}
+
+func TestPathParams(t *testing.T) {
+	api := NewMyApi()
+	cases := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/users/rvasily", http.StatusOK, `"login":"rvasily"`},
+		{"/users/nobody", http.StatusNotFound, "user not exist"},
+		{"/users/", http.StatusNotFound, "unknown method"},
+		{"/users/rvasily/extra", http.StatusNotFound, "unknown method"},
+		// статический маршрут не перекрывается параметризованным
+		{"/user/profile?login=rvasily", http.StatusOK, `"login":"rvasily"`},
+	}
+	for _, c := range cases {
+		rec := serve(api, httptest.NewRequest(http.MethodGet, c.path, nil))
+		if rec.Code != c.status || !strings.Contains(rec.Body.String(), c.body) {
+			t.Errorf("%s: expected %d with %s, got %d %s", c.path, c.status, c.body, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestPathHelpers(t *testing.T) {
+	if got := pathSegment("/users/rvasily/posts", 1); got != "rvasily" {
+		t.Errorf("pathSegment: got %q", got)
+	}
+	if got := pathTail("/files/a/b.txt", 1); got != "a/b.txt" {
+		t.Errorf("pathTail: got %q", got)
+	}
+	for path, expected := range map[string]string{"/user/profile": "/user/profile/", "/user/profile/": "/user/profile", "/": ""} {
+		if got := toggleTrailingSlash(path); got != expected {
+			t.Errorf("toggleTrailingSlash(%q): expected %q, got %q", path, expected, got)
+		}
+	}
+}
+
+func TestMux(t *testing.T) {
+	if _, err := NewMux(Mount{"", NewMyApi()}, Mount{"", NewOtherApi()}); err == nil {
+		t.Errorf("expected conflict for /user/create of both APIs")
+	}
+	if _, err := NewMux(Mount{"/api", NewMyApi()}, Mount{"/api/users", NewOtherApi()}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := NewMux(Mount{"", NewMyApi()}, Mount{"/v2", NewOtherApi()}); err == nil {
+		t.Errorf("expected conflict for /v2/user/create of MyApi.CreateV2")
+	}
+
+	mux, err := NewMux(Mount{"", NewMyApi()}, Mount{"/other/", NewOtherApi()})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if routes := mux.Routes(); len(routes) != 6 || routes[4].URL != "/other/user/create" {
+		t.Errorf("unexpected routes: %+v", routes)
+	}
+
+	cases := []struct {
+		method string
+		path   string
+		status int
+		body   string
+	}{
+		{http.MethodGet, "/user/profile?login=rvasily", http.StatusOK, `"login":"rvasily"`},
+		{http.MethodPost, "/other/user/create?username=new_warrior&level=10", http.StatusOK, `"login":"new_warrior"`},
+		{http.MethodGet, "/other/user/profile", http.StatusNotFound, "unknown method"},
+		{http.MethodGet, "/missing/user/profile", http.StatusNotFound, "unknown method"},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(c.method, c.path, nil)
+		req.Header.Set("X-Auth", "100500")
+		mux.ServeHTTP(rec, req)
+		if rec.Code != c.status || !strings.Contains(rec.Body.String(), c.body) {
+			t.Errorf("%s %s: expected %d with %s, got %d %s", c.method, c.path, c.status, c.body, rec.Code, rec.Body.String())
+		}
+	}
+
+	// API работает и под http.StripPrefix с "/" на конце
+	rec := httptest.NewRecorder()
+	http.StripPrefix("/v1/", NewMyApi()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/user/profile?login=rvasily", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 under StripPrefix, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRoutesOverlap(t *testing.T) {
+	cases := []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"/user/create", "/user/create", true},
+		{"/user/create", "/user/profile", false},
+		{"/users/{login}", "/users/rvasily", true},
+		{"/users/{login}", "/users/{id}", true},
+		{"/users/{login}", "/users/", false},
+		{"/users/{login}", "/users/rvasily/posts", false},
+		{"/files/{path...}", "/files/a/b", true},
+		{"/files/{path...}", "/files", false},
+	}
+	for _, c := range cases {
+		if got := routesOverlap(c.a, c.b); got != c.overlap {
+			t.Errorf("routesOverlap(%q, %q): expected %v, got %v", c.a, c.b, c.overlap, got)
+		}
+	}
+}
+
+func TestVersioning(t *testing.T) {
+	api := NewMyApi()
+	if rec := serve(api, postForm("/v2/user/create", "login=versioned_user&role=bad&age=20")); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "role must be one of") {
+		t.Errorf("v2 must validate role, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(api, postForm("/v2/user/create", "login=versioned_user&role=moderator&age=20")); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 for v2, got %d %s", rec.Code, rec.Body.String())
+	}
+	if routeMyApiCreateV2.Version != "v2" || routeMyApiCreateV2.URL != "/v2/user/create" {
+		t.Errorf("unexpected route: %+v", routeMyApiCreateV2)
+	}
+
+	cases := []struct {
+		header, value, expected string
+	}{
+		{"Accept-Version", "v2", "v2"},
+		{"Accept", "application/xml, application/json; version=v3", "v3"},
+		{"Accept", "application/json", ""},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/user/create", nil)
+		req.Header.Set(c.header, c.value)
+		strategy := "media-type"
+		if c.header == VersionHeader {
+			strategy = "header"
+		}
+		if got := requestVersion(req, strategy); got != c.expected {
+			t.Errorf("%s: %s: expected %q, got %q", c.header, c.value, c.expected, got)
+		}
+	}
+}
+
+func TestDeprecation(t *testing.T) {
+	metrics := useMetrics(t)
+
+	api := NewMyApi()
+	rec := serve(api, postForm(ApiUserCreate, "login=deprecated_user&age=20"))
+
+	expected := map[string]string{
+		"Deprecation": "@1767225600",
+		"Sunset":      "Fri, 01 Jan 2027 00:00:00 GMT",
+		"Link":        `</v2/user/create>; rel="successor-version"`,
+	}
+	for header, value := range expected {
+		if got := rec.Header().Get(header); got != value {
+			t.Errorf("%s: expected %q, got %q", header, value, got)
+		}
+	}
+
+	if rec := serve(api, httptest.NewRequest(http.MethodGet, "/user/profile?login=rvasily", nil)); rec.Header().Get("Deprecation") != "" {
+		t.Errorf("profile is not deprecated")
+	}
+
+	if line := `apigen_deprecated_requests_total{api="MyApi",method="Create"} 1` + "\n"; !strings.Contains(scrape(metrics), line) {
+		t.Errorf("metrics has no line %q\n%s", line, scrape(metrics))
+	}
+}
+
+type versionedUser struct {
+	User
+	Version int
+}
+
+func (u versionedUser) ETag() string {
+	return fmt.Sprintf("user-%d-v%d", u.ID, u.Version)
+}
+
+func TestCache(t *testing.T) {
+	api := NewMyApi()
+	get := func(accept, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/user/profile?login=rvasily", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		return serve(api, req)
+	}
+
+	rec := get("", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(etag, `"`) || len(etag) != 34 {
+		t.Fatalf("expected 200 with strong ETag, got %d %q", rec.Code, etag)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "max-age=60" {
+		t.Errorf("unexpected Cache-Control %q", got)
+	}
+	if got := rec.Header().Values("Vary"); !reflect.DeepEqual(got, []string{"Accept-Encoding", "Accept"}) {
+		t.Errorf("unexpected Vary %q", got)
+	}
+
+	rec = get("", `"other", `+etag)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 || rec.Header().Get("ETag") != etag {
+		t.Errorf("expected 304 without body, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec = get("application/xml", etag); rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("xml representation must have own ETag, got %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+	if rec = get("", ""); rec.Header().Get("ETag") != etag {
+		t.Errorf("ETag must be stable, got %q and %q", etag, rec.Header().Get("ETag"))
+	}
+
+	// POST на маршрут без ограничения метода не кешируется
+	rec = serve(api, httptest.NewRequest(http.MethodPost, "/user/profile?login=rvasily", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "" || rec.Header().Get("ETag") != "" {
+		t.Errorf("expected POST without cache headers, got %d %v", rec.Code, rec.Header())
+	}
+
+	// результат со своей версией не кодируется ради хеша, но ETag различает форматы
+	user := versionedUser{User: *benchUser, Version: 3}
+	write := func(encoder ResponseEncoder, result interface{}, ifNoneMatch string) (*httptest.ResponseRecorder, error) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/user/profile", nil)
+		req.Header.Set("If-None-Match", ifNoneMatch)
+		err := writeCachedResponse(rec, req, encoder, Response{"error": "", "response": result}, result, http.StatusOK, "no-cache", true)
+		return rec, err
+	}
+	rec, err := write(JSONEncoder{}, user, "")
+	tag := rec.Header().Get("ETag")
+	if err != nil || rec.Code != http.StatusOK || !strings.HasPrefix(tag, `"user-42-v3-`) {
+		t.Fatalf("unexpected ETag %q: %v", tag, err)
+	}
+	if rec, _ := write(XMLEncoder{}, user, ""); rec.Header().Get("ETag") == tag {
+		t.Errorf("xml must have own ETag, got %q", tag)
+	}
+	if rec, _ := write(JSONEncoder{}, user, "W/"+tag); rec.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for %s, got %d", tag, rec.Code)
+	}
+
+	// после ошибки обработчик ответит 500, кешировать его нельзя
+	for _, version := range []string{"", `a"b`, `a\b`, "a b", "версия"} {
+		if rec, err := write(JSONEncoder{}, taggedResult(version), ""); err == nil || rec.Header().Get("Cache-Control") != "" {
+			t.Errorf("ETag %q must be rejected without cache headers, got %v %v", version, err, rec.Header())
+		}
+	}
+	if rec, err := write(JSONEncoder{}, make(chan int), ""); err == nil || rec.Header().Get("Cache-Control") != "" || rec.Header().Get("ETag") != "" {
+		t.Errorf("failed encoding must leave no cache headers, got %v %v", err, rec.Header())
+	}
+}
+
+type taggedResult string
+
+func (r taggedResult) ETag() string {
+	return string(r)
+}
+
+func TestIdempotency(t *testing.T) {
+	swap[IdempotencyStore](t, &IdempotencyResponses, NewMemoryIdempotencyStore(time.Hour))
+
+	api := NewMyApi()
+	create := func(key, body string) *httptest.ResponseRecorder {
+		req := postForm(ApiUserCreate, body)
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		return serve(api, req)
+	}
+
+	first := create("key-1", "login=idempotent_user&age=20")
+	if first.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", first.Code, first.Body.String())
+	}
+	repeat := create("key-1", "login=idempotent_user&age=20")
+	if repeat.Code != http.StatusOK || repeat.Body.String() != first.Body.String() || repeat.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected replay of %s, got %d %s", first.Body.String(), repeat.Code, repeat.Body.String())
+	}
+	if repeat.Header().Get(RequestIDHeader) == first.Header().Get(RequestIDHeader) {
+		t.Errorf("replay must keep own request id")
+	}
+	if rec := create("key-1", "login=other_idempotent_user&age=20"); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for key reused with other params, got %d %s", rec.Code, rec.Body.String())
+	}
+	// без ключа повтор снова вызывает метод
+	if rec := create("", "login=idempotent_user&age=20"); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 from method, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// CORS-заголовки первого ответа не повторяются для запроса с другим Origin
+	req := postForm(ApiUserCreate, "login=cors_idempotent_user&age=20")
+	req.Header.Set(IdempotencyKeyHeader, "key-3")
+	req.Header.Set("Origin", "https://app.example.com")
+	if rec := serve(api, req); rec.Header().Get("Access-Control-Allow-Origin") == "" {
+		t.Fatalf("expected CORS headers, got %v", rec.Header())
+	}
+	req = postForm(ApiUserCreate, "login=cors_idempotent_user&age=20")
+	req.Header.Set(IdempotencyKeyHeader, "key-3")
+	req.Header.Set("Origin", "https://evil.example.com")
+	if rec := serve(api, req); rec.Header().Get("Idempotent-Replayed") != "true" || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("replay must not carry CORS headers of first request, got %v", rec.Header())
+	}
+
+	// после таймаута или отключения клиента метод продолжает работать: пока он не завершится,
+	// повтор получает 409, а потом - настоящий ответ метода, и второй раз метод не вызывается
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	req = postForm(ApiUserCreate, "login=slow_canceled_idempotent_user&age=20")
+	req.Header.Set(IdempotencyKeyHeader, "key-4")
+	if rec := serve(api, req.WithContext(ctx)); rec.Code != StatusClientClosedRequest {
+		t.Fatalf("expected 499, got %d %s", rec.Code, rec.Body.String())
+	}
+	cases := []struct {
+		key, body string
+	}{
+		{"key-2", "login=slow_idempotent_user&age=20"},
+		{"key-4", "login=slow_canceled_idempotent_user&age=20"},
+	}
+	if rec := create(cases[0].key, cases[0].body); rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d %s", rec.Code, rec.Body.String())
+	}
+	for _, c := range cases {
+		if rec := create(c.key, c.body); rec.Code != http.StatusConflict {
+			t.Errorf("%s: expected 409 while method runs, got %d %s", c.key, rec.Code, rec.Body.String())
+		}
+	}
+	waitFor(t, func() bool { return slowRunning.Load() == 0 })
+	for _, c := range cases {
+		rec := create(c.key, c.body)
+		if rec.Code != http.StatusOK || rec.Header().Get("Idempotent-Replayed") != "true" || !strings.Contains(rec.Body.String(), `"id":`) {
+			t.Errorf("%s: expected replayed result of the method, got %d %s", c.key, rec.Code, rec.Body.String())
+		}
+	}
+
+	// другой пользователь с тем же ключом выполняет метод сам
+	req = postForm(ApiUserCreate, "login=cors_idempotent_user&age=20")
+	req.Header.Set(IdempotencyKeyHeader, "key-3")
+	swap(t, &PrincipalFunc, func(r *http.Request) string { return "other-user" })
+	if rec := serve(api, req); rec.Code != http.StatusConflict || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected own call for other principal, got %d %s", rec.Code, rec.Body.String())
+	}
+	// без пользователя ключ не принимается
+	swap(t, &PrincipalFunc, func(r *http.Request) string { return "" })
+	if rec := create("key-4", "login=anonymous_user&age=20"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for anonymous key, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryIdempotencyStore(time.Minute)
+	store.Now = func() time.Time { return now }
+
+	if stored, err := store.Begin("key", "a"); stored != nil || err != nil {
+		t.Fatalf("expected free key, got %v %v", stored, err)
+	}
+	if _, err := store.Begin("key", "a"); !errors.Is(err, ErrIdempotencyKeyInUse) {
+		t.Errorf("expected ErrIdempotencyKeyInUse, got %v", err)
+	}
+	store.Save("key", StoredResponse{Status: http.StatusCreated, Body: []byte("ok")})
+	if stored, err := store.Begin("key", "a"); err != nil || stored.Status != http.StatusCreated {
+		t.Errorf("expected stored response, got %v %v", stored, err)
+	}
+	if _, err := store.Begin("key", "b"); !errors.Is(err, ErrIdempotencyKeyMismatch) {
+		t.Errorf("expected ErrIdempotencyKeyMismatch, got %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if stored, err := store.Begin("key", "b"); stored != nil || err != nil {
+		t.Errorf("expected expired key to be free, got %v %v", stored, err)
+	}
+	store.Release("key")
+	if stored, err := store.Begin("key", "c"); stored != nil || err != nil {
+		t.Errorf("expected released key to be free, got %v %v", stored, err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	api := NewMyApi()
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/user/profile?login=rvasily", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		return serve(api, req)
+	}
+
+	plain := get("")
+	if plain.Header().Get("Content-Encoding") != "" || plain.Header().Values("Vary")[0] != "Accept-Encoding" {
+		t.Fatalf("unexpected headers without Accept-Encoding: %v", plain.Header())
+	}
+	// ответ профиля меньше порога
+	if rec := get("gzip"); rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != plain.Body.String() {
+		t.Errorf("small response must not be compressed, got %v", rec.Header())
+	}
+
+	swap(t, &CompressMinSize, 16)
+
+	readers := map[string]func(io.Reader) (io.Reader, error){
+		"gzip":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"deflate": func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+	}
+	for acceptEncoding, encoding := range map[string]string{
+		"gzip, deflate":             "gzip",
+		"deflate, gzip;q=0.5":       "deflate",
+		"br;q=1, *;q=0.1":           "gzip",
+		"gzip;q=0, identity":        "",
+		"gzip;q=0, *":               "deflate",
+		"deflate;q=0.8, gzip;q=0.8": "gzip",
+	} {
+		rec := get(acceptEncoding)
+		if got := rec.Header().Get("Content-Encoding"); got != encoding {
+			t.Errorf("%q: expected encoding %q, got %q", acceptEncoding, encoding, got)
+			continue
+		}
+		if encoding == "" {
+			continue
+		}
+		if etag := rec.Header().Get("ETag"); !strings.HasPrefix(etag, "W/") {
+			t.Errorf("%q: compressed response must have weak ETag, got %q", acceptEncoding, etag)
+		}
+		reader, err := readers[encoding](rec.Body)
+		if err != nil {
+			t.Fatalf("%q: bad compressed body: %v", acceptEncoding, err)
+		}
+		body, _ := io.ReadAll(reader)
+		if string(body) != plain.Body.String() {
+			t.Errorf("%q: expected %s, got %s", acceptEncoding, plain.Body.String(), body)
+		}
+	}
+
+	// weak ETag сжатого ответа подходит для If-None-Match
+	req := httptest.NewRequest(http.MethodGet, "/user/profile?login=rvasily", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", get("gzip").Header().Get("ETag"))
+	rec := serve(api, req)
+	if rec.Code != http.StatusNotModified || rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected 304 without Content-Encoding, got %d %v", rec.Code, rec.Header())
+	}
+
+	for contentType, expected := range map[string]bool{
+		"application/json":         true,
+		"image/svg+xml":            true,
+		"image/png":                false,
+		"application/zip":          false,
+		"application/gzip; q=1":    false,
+		"text/plain; charset=utf8": true,
+	} {
+		if got := compressible(contentType); got != expected {
+			t.Errorf("compressible(%q): expected %v, got %v", contentType, expected, got)
+		}
+	}
+}
@@ -11,8 +11,17 @@ import (
 )
 
 func main() {
-	// будет вызван метод ServeHTTP у структуры MyApi
-	http.Handle("/user/", NewMyApi())
+	// MyApi обслуживается от корня вместе со своими /v2/, OtherApi - под /other/
+	mux, err := NewMux(
+		Mount{Prefix: "", API: NewMyApi()},
+		Mount{Prefix: "/other", API: NewOtherApi()},
+	)
+	if err != nil {
+		panic(err)
+	}
+	http.Handle("/", mux)
+	// метрики сгенерированных обработчиков в формате Prometheus
+	http.Handle("/metrics", DefaultMetrics)
 
 	fmt.Println("starting server at :8080")
 	http.ListenAndServe(":8080", nil)